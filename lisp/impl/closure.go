@@ -0,0 +1,545 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// closure evaluates a piece of code compiled by the closure engine in env.
+// Unlike the VM, the closure engine turns code into a tree of Go closures
+// once, resolving operands in advance, and then runs the tree using the Go
+// stack for function calls.
+type closure func(m *machine, env *Env) (Object, error)
+
+// machine is the state shared by the closures while running.
+type machine struct {
+	// vm is passed to primitives and runs functions created by the VM
+	vm          *VM
+	frames      []*Func
+	interrupted *int32
+	// callers returns the calls the machine was started from, if any
+	callers func() []*Func
+}
+
+// maxCallDepth limits the nesting of calls in the closure engine, which
+// would otherwise crash the process by overflowing the Go stack.
+const maxCallDepth = 100000
+
+func newMachine(interrupted *int32) *machine {
+	m := &machine{interrupted: interrupted}
+	m.vm = NewVM(nil)
+	m.vm.interrupted = interrupted
+	m.vm.callers = m.calls
+	return m
+}
+
+// calls returns the functions being called, innermost first, followed by
+// the calls the machine was started from.
+func (m *machine) calls() []*Func {
+	fns := make([]*Func, 0, len(m.frames)+1)
+	for i := len(m.frames) - 1; i >= 0; i-- {
+		fns = append(fns, m.frames[i])
+	}
+	if m.callers != nil {
+		return append(fns, m.callers()...)
+	}
+	return append(fns, nil)
+}
+
+func (m *machine) backtrace() []string {
+	return backtraceOf(m.calls())
+}
+
+// error attaches the backtrace to err unless it already has one from a
+// more deeply nested call.
+func (m *machine) error(err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{err, m.backtrace()}
+}
+
+// run evaluates the closure compiled from top-level code. Panics are left
+// to propagate as the VM does.
+func (m *machine) run(c closure) (Object, error) {
+	v, err := c(m, nil)
+	if err != nil {
+		return nil, m.error(err)
+	}
+	return v, nil
+}
+
+func (m *machine) call(obj Object, args Frame) (Object, error) {
+	if f, ok := obj.(applicable); ok {
+		return f.call(m.vm, args)
+	}
+	fn, ok := obj.(*Func)
+	if !ok {
+		return nil, errors.New("cannot apply object other than function")
+	}
+	if len(args) != fn.info.arity {
+		return nil, fmt.Errorf("wrong number of arguments to %s: expected %d, got %d", fn.Name(), fn.info.arity, len(args))
+	}
+	if fn.body == nil {
+		return m.vm.apply(fn, args)
+	}
+	if atomic.LoadInt32(m.interrupted) != 0 {
+		return nil, ErrInterrupted
+	}
+	if len(m.frames) >= maxCallDepth {
+		return nil, errors.New("stack overflow")
+	}
+	m.frames = append(m.frames, fn)
+	v, err := fn.body(m, fn.env.Push(args))
+	if err != nil {
+		err = m.error(err)
+	}
+	m.frames = m.frames[:len(m.frames)-1]
+	return v, err
+}
+
+// closureCompiler turns a range of code into a closure by tracking the
+// closures that compute the values on the VM stack at each instruction.
+type closureCompiler struct {
+	code  Code
+	stack []closure
+	// effects are closures whose values were popped, to be run before the
+	// next value is computed
+	effects []closure
+}
+
+// compileClosure compiles code for the closure engine. It fails if the code
+// uses instructions the compiler never emits, such as DUM and RAP.
+func compileClosure(code Code) (ret closure, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ret, err = nil, fmt.Errorf("cannot compile code into closures: %v", r)
+		}
+	}()
+	return compileClosureRange(code, 0, len(code)), nil
+}
+
+func compileClosureRange(code Code, start, end int) closure {
+	cc := &closureCompiler{code: code}
+	for pc := start; pc < end; {
+		pc = cc.compileInsn(pc)
+	}
+	if len(cc.stack) != 1 || len(cc.effects) > 0 {
+		panic("code must compute exactly one value")
+	}
+	return cc.stack[0]
+}
+
+func (cc *closureCompiler) push(c closure) {
+	if effects := cc.effects; len(effects) > 0 {
+		cc.effects = nil
+		next := c
+		c = func(m *machine, env *Env) (Object, error) {
+			for _, effect := range effects {
+				if _, err := effect(m, env); err != nil {
+					return nil, err
+				}
+			}
+			return next(m, env)
+		}
+	}
+	cc.stack = append(cc.stack, c)
+}
+
+func (cc *closureCompiler) pop() closure {
+	if len(cc.stack) == 0 {
+		panic("stack underflow")
+	}
+	c := cc.stack[len(cc.stack)-1]
+	cc.stack = cc.stack[:len(cc.stack)-1]
+	return c
+}
+
+// popN pops the closures for the top n values on the stack, keeping their
+// order.
+func (cc *closureCompiler) popN(n int) []closure {
+	if len(cc.stack) < n {
+		panic("stack underflow")
+	}
+	cs := append([]closure(nil), cc.stack[len(cc.stack)-n:]...)
+	cc.stack = cc.stack[:len(cc.stack)-n]
+	return cs
+}
+
+// evalFrame evaluates cs in order into a new frame.
+func evalFrame(m *machine, env *Env, cs []closure) (Frame, error) {
+	frame := make(Frame, len(cs))
+	for i, c := range cs {
+		v, err := c(m, env)
+		if err != nil {
+			return nil, err
+		}
+		frame[i] = v
+	}
+	return frame, nil
+}
+
+// discard arranges for effect to run right after the value below it on the
+// stack is computed, or before the next value if there is none.
+func (cc *closureCompiler) discard(effect closure) {
+	if len(cc.stack) == 0 {
+		cc.effects = append(cc.effects, effect)
+		return
+	}
+	prev := cc.stack[len(cc.stack)-1]
+	cc.stack[len(cc.stack)-1] = func(m *machine, env *Env) (Object, error) {
+		v, err := prev(m, env)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := effect(m, env); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// leaveIndex returns the index of the LEAVE matching the TRY or WIND at pc.
+func (cc *closureCompiler) leaveIndex(pc int) int {
+	depth := 0
+	for i := pc + 1; i < len(cc.code); i++ {
+		switch cc.code[i].operator {
+		case TRY, WIND:
+			depth++
+		case LEAVE:
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	panic("missing LEAVE")
+}
+
+// exitIndex returns the index of the EXIT matching the ENTER at pc.
+func (cc *closureCompiler) exitIndex(pc int) int {
+	depth := 0
+	for i := pc + 1; i < len(cc.code); i++ {
+		switch cc.code[i].operator {
+		case ENTER:
+			depth++
+		case EXIT:
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	panic("missing EXIT")
+}
+
+// compileInsn compiles the instruction at pc, along with the instructions
+// it controls, and returns the index of the next instruction to compile.
+func (cc *closureCompiler) compileInsn(pc int) int {
+	insn := cc.code[pc]
+	switch insn.operator {
+	case NIL:
+		cc.push(constantClosure(nil))
+	case LDC:
+		v := insn.operands[0]
+		switch v.(type) {
+		case *Cons, *Vector, *MutableString:
+			cc.push(func(m *machine, env *Env) (Object, error) {
+				return copyLiteral(v), nil
+			})
+		default:
+			cc.push(constantClosure(v))
+		}
+	case LD:
+		cc.push(localRefClosure(insn.operands[0].(*Location)))
+	case LDG:
+		sym := insn.operands[0].(*Symbol)
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			if !sym.bound {
+				return nil, fmt.Errorf("unbound variable: %s", sym.name)
+			}
+			return sym.value, nil
+		})
+	case SV:
+		loc := insn.operands[0].(*Location)
+		value := cc.pop()
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			v, err := value(m, env)
+			if err != nil {
+				return nil, err
+			}
+			env.Update(loc, v)
+			return v, nil
+		})
+	case SVG, DEF:
+		sym := insn.operands[0].(*Symbol)
+		define := insn.operator == DEF
+		value := cc.pop()
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			v, err := value(m, env)
+			if err != nil {
+				return nil, err
+			}
+			if !define && !sym.bound {
+				return nil, fmt.Errorf("cannot set! unbound variable: %s", sym.name)
+			}
+			if err := assignGlobal(m.vm, sym, v, define); err != nil {
+				return nil, err
+			}
+			return v, nil
+		})
+	case POP:
+		cc.discard(cc.pop())
+	case ATOM:
+		cc.push(unaryClosure(cc.pop(), func(v Object) (Object, error) {
+			return FromBool(IsAtom(v)), nil
+		}))
+	case NULL:
+		cc.push(unaryClosure(cc.pop(), func(v Object) (Object, error) {
+			return FromBool(IsNull(v)), nil
+		}))
+	case CAR:
+		cc.push(unaryClosure(cc.pop(), Car))
+	case CDR:
+		cc.push(unaryClosure(cc.pop(), Cdr))
+	case CONS:
+		y := cc.pop()
+		x := cc.pop()
+		cc.push(binaryClosure(x, y, func(a, b Object) (Object, error) {
+			return NewCons(a, b), nil
+		}))
+	case ADD:
+		cc.compileArith(func(x, y int) Object { return x + y })
+	case SUB:
+		cc.compileArith(func(x, y int) Object { return x - y })
+	case MUL:
+		cc.compileArith(func(x, y int) Object { return x * y })
+	case DIV:
+		y := cc.pop()
+		x := cc.pop()
+		cc.push(binaryClosure(x, y, func(a, b Object) (Object, error) {
+			if b == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return arith(a, b, func(x, y int) Object { return x / y })
+		}))
+	case EQ:
+		cc.compileArith(func(x, y int) Object { return FromBool(x == y) })
+	case GT:
+		cc.compileArith(func(x, y int) Object { return FromBool(x > y) })
+	case LT:
+		cc.compileArith(func(x, y int) Object { return FromBool(x < y) })
+	case GTE:
+		cc.compileArith(func(x, y int) Object { return FromBool(x >= y) })
+	case LTE:
+		cc.compileArith(func(x, y int) Object { return FromBool(x <= y) })
+	case JMPF:
+		// (if test then else) is compiled into
+		//   test; JMPF else; then...; JMP end; else: else...; end:
+		test := cc.pop()
+		elseStart := pc + insn.operands[0].(int)
+		jmp := cc.code[elseStart-1]
+		if jmp.operator != JMP {
+			panic("conditional without JMP at the end of the then clause")
+		}
+		end := elseStart - 1 + jmp.operands[0].(int)
+		then := compileClosureRange(cc.code, pc+1, elseStart-1)
+		els := compileClosureRange(cc.code, elseStart, end)
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			v, err := test(m, env)
+			if err != nil {
+				return nil, err
+			}
+			if ToBool(v) {
+				return then(m, env)
+			}
+			return els(m, env)
+		})
+		return end
+	case LDF:
+		code := insn.operands[0].(Code)
+		info := insn.operands[1].(*LambdaInfo)
+		if len(code) == 0 || code[len(code)-1].operator != RTN {
+			panic("function body without RTN at the end")
+		}
+		body := compileClosureRange(code, 0, len(code)-1)
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			return &Func{code: code, env: env, info: info, body: body}, nil
+		})
+	case CLOS:
+		code := insn.operands[0].(Code)
+		info := insn.operands[1].(*LambdaInfo)
+		if len(code) == 0 || code[len(code)-1].operator != RTN {
+			panic("function body without RTN at the end")
+		}
+		body := compileClosureRange(code, 0, len(code)-1)
+		vars := cc.popN(insn.operands[2].(int))
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			frame, err := evalFrame(m, env, vars)
+			if err != nil {
+				return nil, err
+			}
+			return &Func{code: code, env: (*Env)(nil).Push(frame), info: info, body: body}, nil
+		})
+	case BOX:
+		cc.push(unaryClosure(cc.pop(), func(v Object) (Object, error) {
+			return &box{v}, nil
+		}))
+	case UNBOX:
+		cc.push(unaryClosure(cc.pop(), func(v Object) (Object, error) {
+			return v.(*box).value, nil
+		}))
+	case SETBOX:
+		value := cc.pop()
+		b := cc.pop()
+		cc.push(binaryClosure(b, value, func(b, v Object) (Object, error) {
+			b.(*box).value = v
+			return v, nil
+		}))
+	case AP:
+		fn := cc.pop()
+		args := cc.popN(insn.operands[0].(int))
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			frame, err := evalFrame(m, env, args)
+			if err != nil {
+				return nil, err
+			}
+			f, err := fn(m, env)
+			if err != nil {
+				return nil, err
+			}
+			return m.call(f, frame)
+		})
+	case ENTER:
+		args := cc.popN(insn.operands[0].(int))
+		exit := cc.exitIndex(pc)
+		body := compileClosureRange(cc.code, pc+1, exit)
+		cc.push(func(m *machine, env *Env) (Object, error) {
+			frame, err := evalFrame(m, env, args)
+			if err != nil {
+				return nil, err
+			}
+			return body(m, env.Push(frame))
+		})
+		return exit + 1
+	case TRY:
+		handler := cc.pop()
+		leave := pc + insn.operands[0].(int)
+		if cc.code[leave].operator != LEAVE {
+			panic("TRY without LEAVE at the end of the body")
+		}
+		body := compileClosureRange(cc.code, pc+1, leave)
+		cc.push(tryClosure(handler, body))
+		return leave + 1
+	case WIND:
+		after := cc.pop()
+		leave := cc.leaveIndex(pc)
+		body := compileClosureRange(cc.code, pc+1, leave)
+		cc.push(windClosure(after, body))
+		return leave + 1
+	default:
+		panic(fmt.Sprintf("unexpected instruction %d", insn.operator))
+	}
+	return pc + 1
+}
+
+func constantClosure(v Object) closure {
+	return func(m *machine, env *Env) (Object, error) {
+		return v, nil
+	}
+}
+
+func localRefClosure(loc *Location) closure {
+	level, offset := loc.level, loc.offset
+	if level == 0 {
+		return func(m *machine, env *Env) (Object, error) {
+			return env.frame[offset], nil
+		}
+	}
+	return func(m *machine, env *Env) (Object, error) {
+		for i := 0; i < level; i++ {
+			env = env.next
+		}
+		return env.frame[offset], nil
+	}
+}
+
+func unaryClosure(x closure, op func(Object) (Object, error)) closure {
+	return func(m *machine, env *Env) (Object, error) {
+		v, err := x(m, env)
+		if err != nil {
+			return nil, err
+		}
+		return op(v)
+	}
+}
+
+func binaryClosure(x, y closure, op func(Object, Object) (Object, error)) closure {
+	return func(m *machine, env *Env) (Object, error) {
+		a, err := x(m, env)
+		if err != nil {
+			return nil, err
+		}
+		b, err := y(m, env)
+		if err != nil {
+			return nil, err
+		}
+		return op(a, b)
+	}
+}
+
+// arith applies op to a and b in the same way as VM.binaryOp, which checks
+// the operand on top of the stack first.
+func arith(a, b Object, op func(int, int) Object) (Object, error) {
+	y, err := ToNumber(b)
+	if err != nil {
+		return nil, err
+	}
+	x, err := ToNumber(a)
+	if err != nil {
+		return nil, err
+	}
+	return op(x, y), nil
+}
+
+func (cc *closureCompiler) compileArith(op func(int, int) Object) {
+	y := cc.pop()
+	x := cc.pop()
+	cc.push(binaryClosure(x, y, func(a, b Object) (Object, error) {
+		return arith(a, b, op)
+	}))
+}
+
+func tryClosure(handler, body closure) closure {
+	return func(m *machine, env *Env) (Object, error) {
+		h, err := handler(m, env)
+		if err != nil {
+			return nil, err
+		}
+		v, err := body(m, env)
+		if err == nil || errors.Is(err, ErrInterrupted) {
+			return v, err
+		}
+		return m.call(h, Frame{raisedValue(err)})
+	}
+}
+
+// windClosure calls after when an error unwinds through body. The cleanup
+// for normal completion follows the body in the code.
+func windClosure(after, body closure) closure {
+	return func(m *machine, env *Env) (Object, error) {
+		thunk, err := after(m, env)
+		if err != nil {
+			return nil, err
+		}
+		v, err := body(m, env)
+		if err == nil || errors.Is(err, ErrInterrupted) {
+			return v, err
+		}
+		if _, cerr := m.call(thunk, nil); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,229 @@
+package lisp
+
+type codegen struct {
+	insns []Insn
+	// closures is non-nil if functions are to be flat closures
+	closures *closureInfo
+	// fn is the lambda expression whose body is being generated
+	fn *Lambda
+	// scopes are the variables of the Lets around the node being generated
+	// in the body of fn, innermost last
+	scopes [][]*Var
+}
+
+// Generate generates the code for node. The functions it creates capture
+// the whole environment they are created in, and access outer variables
+// by following the links between the frames.
+func Generate(node Node) Code {
+	g := &codegen{}
+	g.gen(node)
+	return g.insns
+}
+
+// GenerateFlat generates the code for node, where the functions are flat
+// closures instead: they copy only the free variables they use into a
+// frame of their own, so that variables are never more than one link away
+// and unused frames can be collected. Variables both captured and assigned
+// are put in boxes the copies share.
+func GenerateFlat(node Node) Code {
+	g := &codegen{closures: analyzeClosures(node)}
+	g.gen(node)
+	return g.insns
+}
+
+func (g *codegen) pushInsn(op Op, operands []Operand) {
+	g.insns = append(g.insns, Insn{op, operands})
+}
+
+// pushJump emits an instruction with an offset to be filled in later by
+// patchJump, and returns its index.
+func (g *codegen) pushJump(op Op) int {
+	g.pushInsn(op, []Operand{0})
+	return len(g.insns) - 1
+}
+
+// patchJump sets the offset of the instruction at i so that it refers to
+// the next instruction to be emitted.
+func (g *codegen) patchJump(i int) {
+	g.insns[i].operands[0] = len(g.insns) - i
+}
+
+func (g *codegen) gen(node Node) {
+	switch n := node.(type) {
+	case *Const:
+		if n.value == nil {
+			g.pushInsn(NIL, nil)
+		} else {
+			g.pushInsn(LDC, []Operand{n.value})
+		}
+	case *LocalRef:
+		g.pushInsn(LD, []Operand{g.locate(n.v, n.depth)})
+		if g.boxed(n.v) {
+			g.pushInsn(UNBOX, nil)
+		}
+	case *GlobalRef:
+		g.pushInsn(LDG, []Operand{n.sym})
+	case *If:
+		g.gen(n.test)
+		jmpf := g.pushJump(JMPF)
+		g.gen(n.then)
+		jmp := g.pushJump(JMP)
+		g.patchJump(jmpf)
+		g.gen(n.els)
+		g.patchJump(jmp)
+	case *Lambda:
+		g.genLambda(n)
+	case *App:
+		for _, arg := range n.args {
+			g.gen(arg)
+		}
+		g.gen(n.fn)
+		g.pushInsn(AP, []Operand{len(n.args)})
+	case *PrimApp:
+		for _, arg := range n.args {
+			g.gen(arg)
+		}
+		g.pushInsn(n.op, nil)
+	case *Set:
+		if n.local != nil && g.boxed(n.local) {
+			g.pushInsn(LD, []Operand{g.locate(n.local, n.depth)})
+			g.gen(n.value)
+			g.pushInsn(SETBOX, nil)
+			break
+		}
+		g.gen(n.value)
+		switch {
+		case n.local != nil:
+			g.pushInsn(SV, []Operand{g.locate(n.local, n.depth)})
+		case n.define:
+			g.pushInsn(DEF, []Operand{n.global})
+		default:
+			g.pushInsn(SVG, []Operand{n.global})
+		}
+	case *Seq:
+		g.genSeq(n.exprs)
+	case *Let:
+		g.genLet(n)
+	case *Try:
+		g.genTry(n)
+	}
+}
+
+func (g *codegen) genSeq(exprs []Node) {
+	for i, expr := range exprs {
+		g.gen(expr)
+		if i < len(exprs)-1 {
+			g.pushInsn(POP, nil)
+		}
+	}
+}
+
+// locate returns the location of v, which is depth frames out in the
+// linked environment.
+func (g *codegen) locate(v *Var, depth int) *Location {
+	if g.closures == nil {
+		return &Location{depth, v.index}
+	}
+	// a flat closure runs with the frames of the Lets in front of its
+	// arguments, followed by the frame of the free variables
+	level := 0
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if index, ok := indexOf(v, g.scopes[i]); ok {
+			return &Location{level, index}
+		}
+		level++
+	}
+	if g.fn != nil {
+		if index, ok := indexOf(v, g.fn.params); ok {
+			return &Location{level, index}
+		}
+		if index, ok := indexOf(v, g.closures.free[g.fn]); ok {
+			return &Location{level + 1, index}
+		}
+	}
+	panic("variable " + v.name + " is not captured")
+}
+
+func indexOf(v *Var, vars []*Var) (int, bool) {
+	for i, w := range vars {
+		if w == v {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (g *codegen) boxed(v *Var) bool {
+	return g.closures != nil && g.closures.boxed[v]
+}
+
+func (g *codegen) genLambda(n *Lambda) {
+	body := &codegen{closures: g.closures, fn: n}
+	body.boxParams(n.params)
+	body.gen(n.body)
+	body.pushInsn(RTN, nil)
+	if g.closures == nil {
+		g.pushInsn(LDF, []Operand{Code(body.insns), n.info})
+		return
+	}
+	free := g.closures.free[n]
+	for _, v := range free {
+		// copies the box rather than its content if the variable is boxed
+		g.pushInsn(LD, []Operand{g.locate(v, 0)})
+	}
+	g.pushInsn(CLOS, []Operand{Code(body.insns), n.info, len(free)})
+}
+
+// boxParams puts the variables in the innermost frame that need boxes in
+// ones.
+func (g *codegen) boxParams(params []*Var) {
+	for i, param := range params {
+		if g.boxed(param) {
+			loc := &Location{0, i}
+			g.pushInsn(LD, []Operand{loc})
+			g.pushInsn(BOX, nil)
+			g.pushInsn(SV, []Operand{loc})
+			g.pushInsn(POP, nil)
+		}
+	}
+}
+
+// genLet generates the code pushing the frame for a Let onto the
+// environment while its body runs.
+func (g *codegen) genLet(n *Let) {
+	for _, arg := range n.args {
+		g.gen(arg)
+	}
+	g.pushInsn(ENTER, []Operand{len(n.args)})
+	g.scopes = append(g.scopes, n.params)
+	g.boxParams(n.params)
+	g.gen(n.body)
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.pushInsn(EXIT, nil)
+}
+
+// genTry generates the code for a Try. The handler is a closure that TRY
+// installs on the dump until the LEAVE following the body. The cleanup
+// runs inline after the body completes, and the finally thunk is installed
+// by WIND to be called when an error unwinds through it.
+func (g *codegen) genTry(n *Try) {
+	if n.finally != nil {
+		g.genLambda(n.finally)
+		g.pushInsn(WIND, nil)
+	}
+	try := -1
+	if n.handler != nil {
+		g.genLambda(n.handler)
+		try = g.pushJump(TRY)
+	}
+	g.gen(n.body)
+	if n.handler != nil {
+		g.patchJump(try)
+		g.pushInsn(LEAVE, nil)
+	}
+	if n.finally != nil {
+		g.pushInsn(LEAVE, nil)
+		g.gen(n.cleanup)
+		g.pushInsn(POP, nil)
+	}
+}
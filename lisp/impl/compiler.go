@@ -3,18 +3,45 @@ package lisp
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"strings"
 )
 
-type CEnv = map[string]*Location
+type CEnv = map[*Symbol]*Var
 
+// Compiler compiles expressions in two phases. Expand checks the syntax of
+// an expression and turns it into a Node, reporting warnings to the
+// diagnostics if any, and then Generate generates the code from the Node.
 type Compiler struct {
-	insns []Insn
-	cenv  CEnv
-	level int
+	cenv   CEnv
+	macros map[*Symbol]*Macro
+	moduleEnv
+	// libraryPath is searched for the files of the libraries imported,
+	// whose forms are evaluated by evalLibrary if it is not nil, or only
+	// compiled otherwise
+	libraryPath []fs.FS
+	evalLibrary func(obj Object) error
+	// macroDepth is the number of macro expansions being expanded
+	macroDepth int
+	level      int
+	srcmap     SourceMap
+	diags      *Diagnostics
+	pos        Pos
+
+	optimize bool
+	flat     bool
+	// inlineDefs are the definitions of the global functions that may be
+	// inlined, and inlined the functions defined by them so far
+	inlineDefs map[*Symbol]*Cons
+	inlined    map[*Symbol]*Lambda
 }
 
 func NewCompiler() *Compiler {
-	return &Compiler{cenv: CEnv{}}
+	return &Compiler{
+		cenv:      CEnv{},
+		macros:    map[*Symbol]*Macro{},
+		moduleEnv: newModuleEnv(),
+	}
 }
 
 func (c *Compiler) clone() *Compiler {
@@ -22,87 +49,199 @@ func (c *Compiler) clone() *Compiler {
 	for k, v := range c.cenv {
 		cenv[k] = v
 	}
-	return &Compiler{nil, cenv, c.level}
+	return &Compiler{
+		cenv:        cenv,
+		macros:      c.macros,
+		moduleEnv:   c.moduleEnv,
+		libraryPath: c.libraryPath,
+		evalLibrary: c.evalLibrary,
+		macroDepth:  c.macroDepth,
+		level:       c.level,
+		srcmap:      c.srcmap,
+		diags:       c.diags,
+		pos:         c.pos,
+	}
+}
+
+// SetSourceMap makes the compiler record source positions of lambda
+// expressions from sm. Compile removes the positions of each form it
+// compiles from sm, so that sm holds only the forms not compiled yet.
+func (c *Compiler) SetSourceMap(sm SourceMap) {
+	c.srcmap = sm
 }
 
-func (c *Compiler) pushInsn(op Op, operands []Operand) {
-	c.insns = append(c.insns, Insn{op, operands})
+// SetOptimize turns on or off the optimization of compiled code, which
+// includes inlining the applications of lambda expressions.
+func (c *Compiler) SetOptimize(optimize bool) {
+	c.optimize = optimize
 }
 
-func (c *Compiler) compile(expr Object) error {
+// SetFlatClosures makes the compiler generate flat closures, which copy
+// the variables they use, instead of closures capturing the environment.
+func (c *Compiler) SetFlatClosures(flat bool) {
+	c.flat = flat
+}
+
+// InlineGlobals lets the compiler inline calls to the small functions
+// defined at the top level of forms, which are the top-level forms of a
+// file to be compiled in order. Functions that forms assign or define more
+// than once are never inlined, and neither is any function if forms define
+// or use macros. Calling it again, with nil for example,
+// forgets about the previous forms.
+func (c *Compiler) InlineGlobals(forms []Object) {
+	c.inlineDefs = inlinableDefinitions(forms, c.macros)
+	c.inlined = map[*Symbol]*Lambda{}
+}
+
+// SetDiagnostics makes the compiler report warnings to d.
+func (c *Compiler) SetDiagnostics(d *Diagnostics) {
+	c.diags = d
+}
+
+func (c *Compiler) warn(format string, args ...interface{}) {
+	if c.diags != nil {
+		c.diags.warn(c.pos, format, args...)
+	}
+}
+
+func (c *Compiler) expand(expr Object) (Node, error) {
 	switch e := expr.(type) {
-	case nil:
-		c.pushInsn(NIL, nil)
-	case bool, int:
-		c.pushInsn(LDC, []Operand{e})
 	case *Symbol:
-		loc := c.cenv[e.name]
-		if loc == nil {
-			c.pushInsn(LDG, []Operand{e})
-		} else {
-			c.pushInsn(LD, []Operand{&Location{c.level - loc.level, loc.offset}})
+		v := c.cenv[e]
+		if v == nil {
+			// symbols renamed by macro expansions and not bound by them
+			// refer to the global variables they were renamed from
+			global, err := c.global(e)
+			if err != nil {
+				return nil, err
+			}
+			if c.diags != nil {
+				c.diags.referGlobal(global, c.pos)
+			}
+			return &GlobalRef{global}, nil
 		}
+		if c.diags != nil {
+			c.diags.used[v] = true
+		}
+		return &LocalRef{v, c.level - v.level}, nil
 	case *Cons:
-		return c.compileList(e.car, e.cdr)
+		return c.expandList(e)
+	default:
+		return &Const{e}, nil
 	}
-	return nil
 }
 
-func (c *Compiler) compileList(car Object, cdr Object) error {
+func (c *Compiler) expandAll(exprs []Object) ([]Node, error) {
+	nodes := make([]Node, len(exprs))
+	for i, expr := range exprs {
+		node, err := c.expand(expr)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+var specialForms = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true,
+	"=": true, "<": true, ">": true, "<=": true, ">=": true,
+	"cons": true, "car": true, "cdr": true, "null": true, "atom": true,
+	"quote": true, "if": true, "set!": true, "begin": true,
+	"lambda": true, "define": true, "try": true, "define-syntax": true,
+	"parameterize": true, "module": true, "import": true,
+}
+
+// keyword returns the name of the special form sym stands for if any.
+// Uninterned symbols never stand for special forms.
+func keyword(sym *Symbol) string {
+	if orig := sym.original(); orig.IsInterned() {
+		return orig.name
+	}
+	return ""
+}
+
+// macroOf returns the macro sym refers to, unless it names a variable.
+func (c *Compiler) macroOf(sym *Symbol) *Macro {
+	if c.cenv[sym] != nil {
+		return nil
+	}
+	return c.macros[sym.original()]
+}
+
+func (c *Compiler) expandList(form *Cons) (Node, error) {
+	if pos := c.srcmap.PosOf(form); pos.IsValid() {
+		defer func(pos Pos) { c.pos = pos }(c.pos)
+		c.pos = pos
+	}
+	car, cdr := form.car, form.cdr
 	switch obj := car.(type) {
 	case *Symbol:
-		switch obj.name {
+		switch keyword(obj) {
 		case "+":
-			return c.compileOp(2, cdr, ADD)
+			return c.expandOp(2, cdr, ADD)
 		case "-":
-			return c.compileOp(2, cdr, SUB)
+			return c.expandOp(2, cdr, SUB)
 		case "*":
-			return c.compileOp(2, cdr, MUL)
+			return c.expandOp(2, cdr, MUL)
 		case "/":
-			return c.compileOp(2, cdr, DIV)
+			return c.expandOp(2, cdr, DIV)
 		case "=":
-			return c.compileOp(2, cdr, EQ)
+			return c.expandOp(2, cdr, EQ)
 		case "<":
-			return c.compileOp(2, cdr, LT)
+			return c.expandOp(2, cdr, LT)
 		case ">":
-			return c.compileOp(2, cdr, GT)
+			return c.expandOp(2, cdr, GT)
 		case "<=":
-			return c.compileOp(2, cdr, LTE)
+			return c.expandOp(2, cdr, LTE)
 		case ">=":
-			return c.compileOp(2, cdr, GTE)
+			return c.expandOp(2, cdr, GTE)
 		case "cons":
-			return c.compileOp(2, cdr, CONS)
+			return c.expandOp(2, cdr, CONS)
 		case "car":
-			return c.compileOp(1, cdr, CAR)
+			return c.expandOp(1, cdr, CAR)
 		case "cdr":
-			return c.compileOp(1, cdr, CDR)
+			return c.expandOp(1, cdr, CDR)
 		case "null":
-			return c.compileOp(1, cdr, NULL)
+			return c.expandOp(1, cdr, NULL)
 		case "atom":
-			return c.compileOp(1, cdr, ATOM)
+			return c.expandOp(1, cdr, ATOM)
 		case "quote":
-			return c.compileQuote(cdr)
+			return c.expandQuote(cdr)
 		case "if":
-			return c.compileIf(cdr)
+			return c.expandIf(cdr)
 		case "set!":
-			return c.compileSet(cdr)
+			return c.expandSet(cdr, false)
 		case "begin":
-			return c.compileBegin(cdr)
+			return c.expandBegin(cdr)
 		case "lambda":
-			return c.compileLambda(cdr)
+			return c.expandLambda(cdr, &LambdaInfo{pos: c.srcmap.PosOf(form)})
 		case "define":
-			return c.compileSet(cdr)
+			return c.expandSet(cdr, true)
+		case "try":
+			return c.expandTry(cdr)
+		case "define-syntax":
+			return c.expandDefineSyntax(cdr)
+		case "parameterize":
+			return c.expandParameterize(cdr)
+		case "module":
+			return c.expandModule(cdr)
+		case "import":
+			return c.expandImport(cdr)
 		default:
-			return c.compileApplication(car, cdr)
+			if m := c.macroOf(obj); m != nil {
+				return c.expandMacro(m, form)
+			}
+			return c.expandApplication(car, cdr)
 		}
 	case *Cons:
-		return c.compileApplication(car, cdr)
+		return c.expandApplication(car, cdr)
 	default:
-		return fmt.Errorf("%s is not applicable", ToString(car))
+		return nil, fmt.Errorf("%s is not applicable", ToString(car))
 	}
 }
 
-func (c *Compiler) takeArgs(n int, argList Object) ([]Object, error) {
+func takeArgs(n int, argList Object) ([]Object, error) {
 	ret, improper, err := ListToSlice(argList)
 	if improper != nil || err != nil {
 		return nil, errors.New("arglist must be proper list")
@@ -116,144 +255,377 @@ func (c *Compiler) takeArgs(n int, argList Object) ([]Object, error) {
 	return ret, nil
 }
 
-func (c *Compiler) compileOp(nargs int, argList Object, op Op) error {
-	args, err := c.takeArgs(nargs, argList)
+func (c *Compiler) expandOp(nargs int, argList Object, op Op) (Node, error) {
+	args, err := takeArgs(nargs, argList)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, arg := range args {
-		if err := c.compile(arg); err != nil {
-			return err
-		}
+	nodes, err := c.expandAll(args)
+	if err != nil {
+		return nil, err
 	}
-	c.pushInsn(op, nil)
-	return nil
+	return &PrimApp{op, nodes}, nil
 }
 
-func (c *Compiler) compileQuote(argList Object) error {
-	args, err := c.takeArgs(1, argList)
+func (c *Compiler) expandQuote(argList Object) (Node, error) {
+	args, err := takeArgs(1, argList)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.pushInsn(LDC, []Operand{args[0]})
-	return nil
+	return &Const{stripRenames(args[0], map[*Cons]bool{})}, nil
 }
 
-func (c *Compiler) compileIf(argList Object) error {
-	args, err := c.takeArgs(3, argList)
+func (c *Compiler) expandIf(argList Object) (Node, error) {
+	args, err := takeArgs(3, argList)
 	if err != nil {
-		return err
-	}
-	c1 := c.clone()
-	c2 := c.clone()
-	if err := c.compile(args[0]); err != nil {
-		return err
+		return nil, err
 	}
-	if err := c1.compile(args[1]); err != nil {
-		return err
+	if truth, ok := constantTruth(args[0]); ok {
+		if truth {
+			c.warn("if condition is always true")
+		} else {
+			c.warn("if condition is always false")
+		}
 	}
-	c1.pushInsn(JOIN, nil)
-	if err := c2.compile(args[2]); err != nil {
-		return err
+	nodes, err := c.expandAll(args)
+	if err != nil {
+		return nil, err
 	}
-	c2.pushInsn(JOIN, nil)
-	c.pushInsn(SEL, []Operand{Code(c1.insns), Code(c2.insns)})
-	return nil
+	return &If{nodes[0], nodes[1], nodes[2]}, nil
 }
 
-func (c *Compiler) compileSet(argList Object) error {
-	args, err := c.takeArgs(2, argList)
+// expandSet expands set! and define, which differ only in that define
+// may create a new global variable.
+func (c *Compiler) expandSet(argList Object, define bool) (Node, error) {
+	args, err := takeArgs(2, argList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	binding, ok := args[0].(*Symbol)
 	if !ok {
-		return errors.New("first argument of set! must be a symbol")
+		return nil, errors.New("first argument of set! must be a symbol")
 	}
-	if err = c.compile(args[1]); err != nil {
-		return err
+	arity := -1
+	var value Node
+	if lambda, ok := clauseOf(args[1], "lambda"); ok && define {
+		info := &LambdaInfo{name: binding.name, pos: c.srcmap.PosOf(lambda)}
+		value, err = c.expandLambda(lambda.cdr, info)
+		arity = info.arity
+	} else {
+		value, err = c.expand(args[1])
 	}
-	loc := c.cenv[binding.name]
-	if loc == nil {
-		c.pushInsn(SVG, []Operand{binding})
-		return nil
+	if err != nil {
+		return nil, err
 	}
-	c.pushInsn(SV, []Operand{&Location{c.level - loc.level, loc.offset}})
-	return nil
+	v := c.cenv[binding]
+	if v != nil {
+		return &Set{local: v, depth: c.level - v.level, value: value}, nil
+	}
+	global, err := c.assignee(binding, define)
+	if err != nil {
+		return nil, err
+	}
+	if c.diags != nil {
+		if define {
+			c.diags.defineGlobal(global, arity)
+			if specialForms[binding.name] {
+				c.warn("definition of %s is shadowed by the special form of the same name", binding.name)
+			}
+		} else {
+			c.diags.assigned[global] = true
+			c.diags.referGlobal(global, c.pos)
+		}
+	}
+	if p := parameterVariables[global]; p != nil {
+		return &App{&Const{setParameterPrimitive}, []Node{&Const{p}, value}}, nil
+	}
+	return &Set{global: global, define: define, value: value}, nil
 }
 
-func (c *Compiler) compileExprs(exprs []Object) error {
-	for i, expr := range exprs {
-		if err := c.compile(expr); err != nil {
-			return err
-		}
-		if i < len(exprs)-1 {
-			c.pushInsn(POP, nil)
-		}
+func (c *Compiler) expandExprs(exprs []Object) (Node, error) {
+	nodes, err := c.expandAll(exprs)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
 	}
-	return nil
+	return &Seq{nodes}, nil
 }
 
-func (c *Compiler) compileBegin(argList Object) error {
+func (c *Compiler) expandBegin(argList Object) (Node, error) {
 	exprs, improper, err := ListToSlice(argList)
 	if improper != nil || err != nil {
-		return errors.New("arglist must be proper list")
+		return nil, errors.New("arglist must be proper list")
 	}
-	return c.compileExprs(exprs)
+	return c.expandExprs(exprs)
 }
 
-func (c *Compiler) compileLambda(argList Object) error {
+func (c *Compiler) expandLambda(argList Object, info *LambdaInfo) (*Lambda, error) {
+	if info.pos.IsValid() {
+		defer func(pos Pos) { c.pos = pos }(c.pos)
+		c.pos = info.pos
+	}
 	args, improper, err := ListToSlice(argList)
 	if improper != nil || err != nil {
-		return errors.New("arglist must be proper list")
+		return nil, errors.New("arglist must be proper list")
+	}
+	if len(args) == 0 {
+		return nil, errors.New("lambda needs parameters")
 	}
 	cbody := c.clone()
 	cbody.level++
 	params, improper, err := ListToSlice(args[0])
 	if improper != nil || err != nil {
-		return errors.New("arglist must be proper list")
+		return nil, errors.New("arglist must be proper list")
 	}
+	vars := make([]*Var, len(params))
 	for i, param := range params {
 		switch obj := param.(type) {
 		case *Symbol:
-			cbody.cenv[obj.name] = &Location{cbody.level, i}
+			vars[i] = &Var{obj.name, cbody.level, i}
+			cbody.cenv[obj] = vars[i]
+			if specialForms[obj.name] && obj.alias == nil {
+				c.warn("parameter %s is shadowed by the special form of the same name", obj.name)
+			}
 		default:
-			return errors.New("fn argument must be symbol")
+			return nil, errors.New("fn argument must be symbol")
+		}
+	}
+	body, err := cbody.expandExprs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	if c.diags != nil {
+		for _, param := range params {
+			sym := param.(*Symbol)
+			// parameters introduced by macros are left to their authors
+			if sym.alias != nil || strings.HasPrefix(sym.name, "_") {
+				continue
+			}
+			if !c.diags.used[cbody.cenv[sym]] {
+				c.warn("unused parameter %s", sym.name)
+			}
+		}
+	}
+	info.arity = len(params)
+	return &Lambda{vars, body, info}, nil
+}
+
+func clauseOf(obj Object, name string) (*Cons, bool) {
+	clause, ok := obj.(*Cons)
+	if !ok {
+		return nil, false
+	}
+	if sym, ok := clause.car.(*Symbol); !ok || sym.original() != Intern(name) {
+		return nil, false
+	}
+	return clause, true
+}
+
+// expandTry expands (try body... (catch var handler...) (finally cleanup...))
+// where either clause may be omitted. The handler becomes a function of
+// the error object, and the cleanup a thunk as well as an expression.
+func (c *Compiler) expandTry(argList Object) (Node, error) {
+	body, catch, finally, err := tryClauses(argList)
+	if err != nil {
+		return nil, err
+	}
+	node := &Try{}
+	if finally != nil {
+		cleanup, improper, err := ListToSlice(finally.cdr)
+		if improper != nil || err != nil {
+			return nil, errors.New("arglist must be proper list")
+		}
+		if len(cleanup) == 0 {
+			cleanup = []Object{nil}
 		}
+		node.finally, err = c.expandLambda(&Cons{nil, SliceToList(cleanup)}, &LambdaInfo{name: "finally"})
+		if err != nil {
+			return nil, err
+		}
+		// the cleanup expanded once more reports nothing new
+		diags := c.diags
+		c.diags = nil
+		node.cleanup, err = c.expandExprs(cleanup)
+		c.diags = diags
+		if err != nil {
+			return nil, err
+		}
+	}
+	if catch != nil {
+		clause, ok := catch.cdr.(*Cons)
+		if !ok {
+			return nil, errors.New("catch clause must have a variable")
+		}
+		if _, ok := clause.car.(*Symbol); !ok {
+			return nil, errors.New("catch variable must be a symbol")
+		}
+		handler := clause.cdr
+		if handler == nil {
+			handler = &Cons{nil, nil}
+		}
+		node.handler, err = c.expandLambda(&Cons{&Cons{clause.car, nil}, handler}, &LambdaInfo{name: "catch"})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(body) == 0 {
+		body = []Object{nil}
+	}
+	if node.body, err = c.expandExprs(body); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// expandParameterize expands (parameterize ((param value)...) body...)
+// into a call to parameterizePrimitive with the body as a thunk, followed
+// by the parameters and the values.
+func (c *Compiler) expandParameterize(argList Object) (Node, error) {
+	bindings, body, err := parameterizeClauses(argList)
+	if err != nil {
+		return nil, err
+	}
+	thunk, err := c.expandLambda(&Cons{nil, SliceToList(body)}, &LambdaInfo{name: "parameterize"})
+	if err != nil {
+		return nil, err
+	}
+	args := []Node{thunk}
+	for _, binding := range bindings {
+		nodes, err := c.expandAll(binding)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, nodes...)
+	}
+	return &App{&Const{parameterizePrimitive}, args}, nil
+}
+
+// expandDefineSyntax expands (define-syntax name (syntax-rules ...)), which
+// defines a macro for the forms compiled after it.
+func (c *Compiler) expandDefineSyntax(argList Object) (Node, error) {
+	args, err := takeArgs(2, argList)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := args[0].(*Symbol)
+	if !ok {
+		return nil, errors.New("first argument of define-syntax must be a symbol")
 	}
-	if err := cbody.compileExprs(args[1:]); err != nil {
-		return err
+	if c.level > 0 {
+		return nil, errors.New("define-syntax must be at the top level")
 	}
-	cbody.pushInsn(RTN, nil)
-	c.pushInsn(LDF, []Operand{Code(cbody.insns)})
-	return nil
+	m, err := parseSyntaxRules(name, args[1])
+	if err != nil {
+		return nil, err
+	}
+	if specialForms[name.name] {
+		c.warn("definition of %s is shadowed by the special form of the same name", name.name)
+	}
+	c.macros[name.original()] = m
+	return &Const{name.original()}, nil
 }
 
-func (c *Compiler) compileApplication(fn Object, argList Object) error {
+// maxMacroDepth limits the nesting of macro expansions, which would go on
+// forever for macros expanding into themselves.
+const maxMacroDepth = 1000
+
+func (c *Compiler) expandMacro(m *Macro, form *Cons) (Node, error) {
+	if c.macroDepth >= maxMacroDepth {
+		return nil, fmt.Errorf("macro expansion of %s is nested too deeply", m.name.name)
+	}
+	expanded, err := m.Expand(form)
+	if err != nil {
+		return nil, err
+	}
+	c.macroDepth++
+	defer func() { c.macroDepth-- }()
+	return c.expand(expanded)
+}
+
+func (c *Compiler) expandApplication(fn Object, argList Object) (Node, error) {
 	args, improper, err := ListToSlice(argList)
 	if improper != nil || err != nil {
-		return errors.New("arglist must be proper list")
+		return nil, errors.New("arglist must be proper list")
+	}
+	if c.diags != nil {
+		c.checkCall(fn, len(args))
+	}
+	nodes, err := c.expandAll(args)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.expand(fn)
+	if err != nil {
+		return nil, err
 	}
-	for _, arg := range args {
-		if err := c.compile(arg); err != nil {
-			return err
+	return &App{f, nodes}, nil
+}
+
+// checkCall warns about calls to functions known to take a different
+// number of arguments.
+func (c *Compiler) checkCall(fn Object, nargs int) {
+	switch f := fn.(type) {
+	case *Symbol:
+		if c.cenv[f] == nil {
+			if global, err := c.global(f); err == nil {
+				c.diags.callGlobal(global, nargs, c.pos)
+			}
+		}
+	case *Cons:
+		lambda, ok := clauseOf(f, "lambda")
+		if !ok {
+			return
+		}
+		if args, ok := lambda.cdr.(*Cons); ok {
+			params, _, err := ListToSlice(args.car)
+			if err == nil && len(params) != nargs {
+				c.warn("lambda called with %d arguments, but takes %d", nargs, len(params))
+			}
 		}
 	}
-	c.pushInsn(NIL, nil)
-	for range args {
-		c.pushInsn(CONS, nil)
+}
+
+// recordInlinable remembers the function node defines if it may be inlined
+// into the following forms.
+func (c *Compiler) recordInlinable(expr Object, node Node) {
+	set, ok := node.(*Set)
+	if !ok || !set.define || c.inlineDefs[set.global] != expr {
+		return
 	}
-	if err := c.compile(fn); err != nil {
-		return err
+	if lambda, ok := set.value.(*Lambda); ok && nodeSize(lambda.body) <= maxInlineSize {
+		c.inlined[set.global] = lambda
 	}
-	c.pushInsn(AP, nil)
-	return nil
 }
 
-func Compile(expr Object) (Code, error) {
-	compiler := NewCompiler()
-	if err := compiler.compile(expr); err != nil {
+// Expand checks the syntax of expr and turns it into a Node.
+func (c *Compiler) Expand(expr Object) (Node, error) {
+	return c.expand(expr)
+}
+
+func (c *Compiler) Compile(expr Object) (Code, error) {
+	defer c.srcmap.forget(expr)
+	node, err := c.expand(expr)
+	if err != nil {
 		return nil, err
 	}
-	return compiler.insns, nil
+	if c.optimize || len(c.inlineDefs) > 0 {
+		node = inline(node, c.inlined)
+		c.recordInlinable(expr, node)
+	}
+	var code Code
+	if c.flat {
+		code = GenerateFlat(node)
+	} else {
+		code = Generate(node)
+	}
+	if c.optimize {
+		return Optimize(code), nil
+	}
+	return code, nil
+}
+
+func Compile(expr Object) (Code, error) {
+	return NewCompiler().Compile(expr)
 }
@@ -14,6 +14,7 @@ func TestCompile(t *testing.T) {
 		{nil, Code{{NIL, nil}}},
 		{true, Code{{LDC, []Operand{true}}}},
 		{42, Code{{LDC, []Operand{42}}}},
+		{"foo", Code{{LDC, []Operand{"foo"}}}},
 		{
 			&Cons{Intern("+"), &Cons{1, &Cons{2, nil}}},
 			Code{
@@ -118,10 +119,10 @@ func TestCompile(t *testing.T) {
 			&Cons{Intern("if"), &Cons{true, &Cons{1, &Cons{2, nil}}}},
 			Code{
 				{LDC, []Operand{true}},
-				{SEL, []Operand{
-					Code{{LDC, []Operand{1}}, {JOIN, nil}},
-					Code{{LDC, []Operand{2}}, {JOIN, nil}},
-				}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{1}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{2}},
 			},
 		},
 		{
@@ -143,8 +144,6 @@ func TestCompile(t *testing.T) {
 			},
 			Code{
 				{LDC, []Operand{2}},
-				{NIL, nil},
-				{CONS, nil},
 				{LDF, []Operand{
 					Code{
 						{LD, []Operand{&Location{0, 0}}},
@@ -152,8 +151,9 @@ func TestCompile(t *testing.T) {
 						{MUL, nil},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
 				}},
-				{AP, nil},
+				{AP, []Operand{1}},
 			},
 		},
 		{
@@ -187,8 +187,6 @@ func TestCompile(t *testing.T) {
 			},
 			[]Insn{
 				{LDC, []Operand{42}},
-				{NIL, nil},
-				{CONS, nil},
 				{LDF, []Operand{
 					Code{
 						{LD, []Operand{&Location{0,0}}},
@@ -199,8 +197,41 @@ func TestCompile(t *testing.T) {
 						{LD, []Operand{&Location{0,0}}},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
+				}},
+				{AP, []Operand{1}},
+			},
+		},
+		{
+			&Cons{Intern("define"), &Cons{Intern("x"), &Cons{1, nil}}},
+			Code{
+				{LDC, []Operand{1}},
+				{DEF, []Operand{Intern("x")}},
+			},
+		},
+		{
+			&Cons{Intern("set!"), &Cons{Intern("x"), &Cons{1, nil}}},
+			Code{
+				{LDC, []Operand{1}},
+				{SVG, []Operand{Intern("x")}},
+			},
+		},
+		{
+			&Cons{
+				Intern("try"),
+				&Cons{1, &Cons{&Cons{Intern("catch"), &Cons{Intern("e"), &Cons{Intern("e"), nil}}}, nil}},
+			},
+			Code{
+				{LDF, []Operand{
+					Code{
+						{LD, []Operand{&Location{0, 0}}},
+						{RTN, nil},
+					},
+					&LambdaInfo{name: "catch", arity: 1},
 				}},
-				{AP, nil},
+				{TRY, []Operand{2}},
+				{LDC, []Operand{1}},
+				{LEAVE, nil},
 			},
 		},
 	}
@@ -212,3 +243,75 @@ func TestCompile(t *testing.T) {
 		})
 	}
 }
+
+func TestCompileFlatClosures(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Code
+	}{
+		{
+			"(lambda (x) (lambda (y) (+ x y)))",
+			Code{
+				{CLOS, []Operand{
+					Code{
+						{LD, []Operand{&Location{0, 0}}},
+						{CLOS, []Operand{
+							Code{
+								{LD, []Operand{&Location{1, 0}}},
+								{LD, []Operand{&Location{0, 0}}},
+								{ADD, nil},
+								{RTN, nil},
+							},
+							&LambdaInfo{arity: 1},
+							1,
+						}},
+						{RTN, nil},
+					},
+					&LambdaInfo{arity: 1},
+					0,
+				}},
+			},
+		},
+		{
+			"(lambda (n) (lambda () (set! n (+ n 1))))",
+			Code{
+				{CLOS, []Operand{
+					Code{
+						{LD, []Operand{&Location{0, 0}}},
+						{BOX, nil},
+						{SV, []Operand{&Location{0, 0}}},
+						{POP, nil},
+						{LD, []Operand{&Location{0, 0}}},
+						{CLOS, []Operand{
+							Code{
+								{LD, []Operand{&Location{1, 0}}},
+								{LD, []Operand{&Location{1, 0}}},
+								{UNBOX, nil},
+								{LDC, []Operand{1}},
+								{ADD, nil},
+								{SETBOX, nil},
+								{RTN, nil},
+							},
+							&LambdaInfo{},
+							1,
+						}},
+						{RTN, nil},
+					},
+					&LambdaInfo{arity: 1},
+					0,
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			expr, err := ReadFromString(tt.in)
+			assert.Nil(t, err)
+			c := NewCompiler()
+			c.SetFlatClosures(true)
+			code, err := c.Compile(expr)
+			assert.Equal(t, tt.out, code)
+			assert.Nil(t, err)
+		})
+	}
+}
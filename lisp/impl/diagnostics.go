@@ -0,0 +1,137 @@
+package lisp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Diagnostic is a warning about a program that compiles but likely does
+// not do what was intended.
+type Diagnostic struct {
+	Pos     Pos
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: warning: %s", d.Pos, d.Message)
+}
+
+type globalCall struct {
+	sym   *Symbol
+	nargs int
+	pos   Pos
+}
+
+// Diagnostics collects warnings from compilers it is attached to. Warnings
+// that depend on the whole program, such as references to globals that are
+// never defined, are worked out when Report is called, so a Diagnostics
+// should see every top-level form of a program before that.
+type Diagnostics struct {
+	warnings []Diagnostic
+	used     map[*Var]bool
+	defined  map[*Symbol]int
+	assigned map[*Symbol]bool
+	arities  map[*Symbol]int
+	refs     map[*Symbol]Pos
+	calls    []globalCall
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{
+		used:     map[*Var]bool{},
+		defined:  map[*Symbol]int{},
+		assigned: map[*Symbol]bool{},
+		arities:  map[*Symbol]int{},
+		refs:     map[*Symbol]Pos{},
+	}
+}
+
+func (d *Diagnostics) warn(pos Pos, format string, args ...interface{}) {
+	d.warnings = append(d.warnings, Diagnostic{pos, fmt.Sprintf(format, args...)})
+}
+
+func (d *Diagnostics) referGlobal(sym *Symbol, pos Pos) {
+	if _, ok := d.refs[sym]; !ok {
+		d.refs[sym] = pos
+	}
+}
+
+func (d *Diagnostics) defineGlobal(sym *Symbol, arity int) {
+	d.defined[sym]++
+	if arity >= 0 {
+		d.arities[sym] = arity
+	}
+}
+
+func (d *Diagnostics) callGlobal(sym *Symbol, nargs int, pos Pos) {
+	d.calls = append(d.calls, globalCall{sym, nargs, pos})
+}
+
+// knownArity returns the arity of the function a global is known to hold
+// throughout the program.
+func (d *Diagnostics) knownArity(sym *Symbol) (min, max int, ok bool) {
+	if d.defined[sym] == 1 && !d.assigned[sym] {
+		if arity, ok := d.arities[sym]; ok {
+			return arity, arity, true
+		}
+		return 0, 0, false
+	}
+	if d.defined[sym] == 0 && !d.assigned[sym] {
+		if prim, ok := sym.value.(*Primitive); ok {
+			return prim.minArgs, prim.maxArgs, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Report returns all the warnings found so far, ordered by position.
+func (d *Diagnostics) Report() []Diagnostic {
+	ret := append([]Diagnostic(nil), d.warnings...)
+	for sym, pos := range d.refs {
+		if d.defined[sym] == 0 && !sym.IsBound() {
+			ret = append(ret, Diagnostic{pos, "reference to undefined global variable " + sym.name})
+		}
+	}
+	for _, call := range d.calls {
+		min, max, ok := d.knownArity(call.sym)
+		if ok && (call.nargs < min || (max >= 0 && call.nargs > max)) {
+			msg := fmt.Sprintf("%s called with %d arguments, but takes %s", call.sym.name, call.nargs, arityString(min, max))
+			ret = append(ret, Diagnostic{call.pos, msg})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		p, q := ret[i].Pos, ret[j].Pos
+		if p.File != q.File {
+			return p.File < q.File
+		}
+		if p.Line != q.Line {
+			return p.Line < q.Line
+		}
+		if p.Col != q.Col {
+			return p.Col < q.Col
+		}
+		return strings.Compare(ret[i].Message, ret[j].Message) < 0
+	})
+	return ret
+}
+
+// constantTruth tells whether expr always evaluates to a true or a false
+// value, if that is known at compile time.
+func constantTruth(expr Object) (truth bool, ok bool) {
+	switch e := expr.(type) {
+	case nil:
+		return false, true
+	case *Symbol:
+		return false, false
+	case *Cons:
+		if quoted, ok := clauseOf(e, "quote"); ok {
+			if arg, ok := quoted.cdr.(*Cons); ok {
+				return arg.car != nil, true
+			}
+		}
+		return false, false
+	default:
+		return true, true
+	}
+}
@@ -0,0 +1,129 @@
+package lisp
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func check(t *testing.T, input string, path ...fs.FS) []string {
+	r := NewReader(strings.NewReader(input))
+	r.SetFilename("test.lisp")
+	d := NewDiagnostics()
+	c := NewCompiler()
+	c.SetLibraryPath(path...)
+	c.SetSourceMap(r.SourceMap())
+	c.SetDiagnostics(d)
+	for {
+		obj, err := r.Read()
+		if err != nil {
+			break
+		}
+		_, err = c.Compile(obj)
+		assert.Nil(t, err)
+	}
+	var ret []string
+	for _, diag := range d.Report() {
+		ret = append(ret, diag.String())
+	}
+	return ret
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		title string
+		in    string
+		out   []string
+	}{
+		{
+			"no warnings",
+			"(define sq (lambda (x) (* x x)))\n(sq 3)",
+			nil,
+		},
+		{
+			"undefined globals",
+			"(define f (lambda (xs) (lenght xs)))\n(set! g 1)",
+			[]string{
+				"test.lisp:1:24: warning: reference to undefined global variable lenght",
+				"test.lisp:2:1: warning: reference to undefined global variable g",
+			},
+		},
+		{
+			"globals defined later",
+			"(define f (lambda () (g)))\n(define g (lambda () 1))",
+			nil,
+		},
+		{
+			"wrong number of arguments to global functions",
+			"(f 1 2)\n(define f (lambda (x) x))\n(vector-ref #(1))",
+			[]string{
+				"test.lisp:1:1: warning: f called with 2 arguments, but takes 1",
+				"test.lisp:3:1: warning: vector-ref called with 1 arguments, but takes 2",
+			},
+		},
+		{
+			"reassigned globals are not checked",
+			"(define f (lambda (x) x))\n(set! f (lambda (x y) (+ x y)))\n(f 1 2)",
+			nil,
+		},
+		{
+			"wrong number of arguments to lambda",
+			"((lambda (x y) (+ x y)) 1)",
+			[]string{"test.lisp:1:1: warning: lambda called with 1 arguments, but takes 2"},
+		},
+		{
+			"unused parameters",
+			"(lambda (x y _z)\n  (lambda (w) x))",
+			[]string{
+				"test.lisp:1:1: warning: unused parameter y",
+				"test.lisp:2:3: warning: unused parameter w",
+			},
+		},
+		{
+			"constant conditions",
+			"(if 1 2 3)\n(if nil 2 3)\n(if '(a) 2 3)\n(if (null 1) 2 3)",
+			[]string{
+				"test.lisp:1:1: warning: if condition is always true",
+				"test.lisp:2:1: warning: if condition is always false",
+				"test.lisp:3:1: warning: if condition is always true",
+			},
+		},
+		{
+			"shadowed special forms",
+			"(define if (lambda (car) car))",
+			[]string{
+				"test.lisp:1:1: warning: definition of if is shadowed by the special form of the same name",
+				"test.lisp:1:12: warning: parameter car is shadowed by the special form of the same name",
+			},
+		},
+		{
+			"macro expansions",
+			"(define-syntax ignore (syntax-rules () ((_ e) ((lambda (x) e) 1))))\n(ignore (lenght 1))",
+			[]string{"test.lisp:2:9: warning: reference to undefined global variable lenght"},
+		},
+		{
+			"finally clauses",
+			"(try 1 (finally (vector-ref #(1)) (if 1 2 3)))",
+			[]string{
+				"test.lisp:1:17: warning: vector-ref called with 1 arguments, but takes 2",
+				"test.lisp:1:35: warning: if condition is always true",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			assert.Equal(t, tt.out, check(t, tt.in))
+		})
+	}
+}
+
+func TestDiagnosticsWithImports(t *testing.T) {
+	out := check(t, "(import (other lib))\n(helper 1)\n(call-utils 1 2)\n(mylib/utils/twice 1)\n(mylib/utils/helper)", testLibraries)
+	assert.Equal(t, []string{
+		"mylib/utils.lisp:2:22: warning: reference to undefined global variable mod-load-count",
+		"test.lisp:3:1: warning: other/lib/call-utils called with 2 arguments, but takes 1",
+		"test.lisp:5:1: warning: mylib/utils/helper called with 0 arguments, but takes 1",
+	}, out)
+}
@@ -6,6 +6,12 @@ type Env struct {
 	next  *Env
 }
 
+// box holds a variable captured by flat closures that is also assigned, so
+// that the closures and the function binding the variable share it.
+type box struct {
+	value Object
+}
+
 type Location struct {
 	level, offset int
 }
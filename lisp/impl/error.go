@@ -0,0 +1,108 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInterrupted = errors.New("interrupted")
+
+type Error struct {
+	err       error
+	backtrace []string
+}
+
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+func (e *Error) Backtrace() []string {
+	return e.backtrace
+}
+
+// Condition is the error object created by the error primitive and by
+// errors that occur inside the VM.
+type Condition struct {
+	message   string
+	irritants []Object
+}
+
+func NewCondition(message string, irritants []Object) *Condition {
+	return &Condition{message, irritants}
+}
+
+func (c *Condition) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.message)
+	for _, irritant := range c.irritants {
+		sb.WriteRune(' ')
+		sb.WriteString(ToString(irritant))
+	}
+	return sb.String()
+}
+
+// Raised carries an object raised from Lisp code through Go code.
+type Raised struct {
+	Value Object
+}
+
+func (e *Raised) Error() string {
+	if c, ok := e.Value.(*Condition); ok {
+		return c.String()
+	}
+	return "uncaught exception: " + ToString(e.Value)
+}
+
+// raisedValue returns the object that Lisp handlers receive for err.
+func raisedValue(err error) Object {
+	var raised *Raised
+	if errors.As(err, &raised) {
+		return raised.Value
+	}
+	return NewCondition(err.Error(), nil)
+}
+
+func toCondition(obj Object) (*Condition, error) {
+	c, ok := obj.(*Condition)
+	if !ok {
+		return nil, fmt.Errorf("error object expected, but got %s", ToString(obj))
+	}
+	return c, nil
+}
+
+func init() {
+	definePrimitive("raise", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		return nil, &Raised{args[0]}
+	})
+	definePrimitive("error", 1, -1, func(_ *VM, args []Object) (Object, error) {
+		message, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		irritants := append([]Object(nil), args[1:]...)
+		return nil, &Raised{NewCondition(string(message), irritants)}
+	})
+	definePrimitive("error?", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		_, ok := args[0].(*Condition)
+		return FromBool(ok), nil
+	})
+	definePrimitive("error-message", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		c, err := toCondition(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return c.message, nil
+	})
+	definePrimitive("error-irritants", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		c, err := toCondition(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return SliceToList(c.irritants), nil
+	})
+}
@@ -0,0 +1,133 @@
+package lisp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTry(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(try 42 (catch e 0))", "42"},
+		{"(try (raise 42) (catch e (+ e 1)))", "43"},
+		{"(+ 1 (try (car 1) (catch e 41)))", "42"},
+		{"(try (car 1) (catch e (error-message e)))", `"cons expected, but got 1"`},
+		{"(try (/ 1 0) (catch e (error-message e)))", `"division by zero"`},
+		{"(try (error \"bad thing\" 1 'x) (catch e e))", `#<error "bad thing" 1 x>`},
+		{"(try (error \"bad thing\" 1 'x) (catch e (error-irritants e)))", "(1 x)"},
+		{"(try (error \"oops\") (catch e (error? e)))", "t"},
+		{"(try (lenght '(1 2)) (catch e (error-message e)))", `"unbound variable: lenght"`},
+		{"(try (raise 'sym) (catch e (error? e)))", "nil"},
+		{
+			// handlers unwind out of nested function calls
+			"(begin (define f (lambda (x) (+ 1 (car x)))) (* 2 (try (f 1) (catch e 21))))",
+			"42",
+		},
+		{
+			// the innermost handler wins
+			"(try (try (raise 1) (catch e (raise (+ e 1)))) (catch e (* e 10)))",
+			"20",
+		},
+		{
+			// handlers see the lexical environment of the try
+			"((lambda (x) (try (raise 1) (catch e (+ x e)))) 41)",
+			"42",
+		},
+		{
+			"(begin (define log nil) (try (set! log (cons 'body log)) (finally (set! log (cons 'cleanup log)))) log)",
+			"(cleanup body)",
+		},
+		{
+			"(begin (define log nil) (try (try (raise 1) (finally (set! log (cons 'cleanup log)))) (catch e (cons e log))))",
+			"(1 cleanup)",
+		},
+		{
+			"(begin (define log nil) (try (raise 1) (catch e (set! log (cons 'caught log))) (finally (set! log (cons 'cleanup log)))) log)",
+			"(cleanup caught)",
+		},
+		{
+			// cleanups see their lexical environment while unwinding
+			"(begin (define log nil) ((lambda (x) (try (try (raise 1) (finally (set! log x))) (catch e log))) 'local))",
+			"local",
+		},
+		{"(try 1 (finally 2))", "1"},
+		{"(try (raise 1) (catch x))", "nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := run(tt.in)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.out, ToString(v))
+		})
+	}
+}
+
+func TestUncaughtErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"(raise 42)", "uncaught exception: 42"},
+		{"(error \"bad thing:\" 42)", "bad thing: 42"},
+		{"(try (car 1) (finally 0))", "cons expected, but got 1"},
+		{"(try (car 1) (catch e (raise e)))", "cons expected, but got 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := run(tt.in)
+			assert.EqualError(t, err, tt.err)
+			var lerr *Error
+			assert.True(t, errors.As(err, &lerr))
+		})
+	}
+
+	v, err := run("(begin (define log nil) (try (raise 1) (finally (set! log 'cleanup))))")
+	assert.Nil(t, v)
+	assert.NotNil(t, err)
+	assert.Equal(t, Intern("cleanup"), Intern("log").value)
+}
+
+func TestPanicsAreNotCaught(t *testing.T) {
+	Intern("buggy-primitive").SetValue(NewPrimitive("buggy-primitive", 0, 0, func(_ *VM, _ []Object) (Object, error) {
+		var c *Cons
+		return c.car, nil
+	}))
+	defer Intern("buggy-primitive").Unbind()
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		assert.Panics(t, func() { evalIn(in, "(try (buggy-primitive) (catch e 'caught))") })
+	}
+
+	// whereas the panics in Go functions are errors
+	in := NewInterpreter()
+	assert.NoError(t, in.DefineGoFunc("panicking-func", func() { panic("oops") }))
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in.SetEngine(engine)
+		out, _ := evalIn(in, "(try (panicking-func) (catch e (error-message e)))")
+		assert.Equal(t, `"panicking-func panicked: oops"`, out)
+	}
+}
+
+func TestCompileTryErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"(try 1)", "try needs catch or finally clause"},
+		{"(try 1 (catch 2 3))", "catch variable must be a symbol"},
+		{"(try (finally 1) 2)", "catch and finally clauses must come last in try"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			obj, err := ReadFromString(tt.in)
+			assert.Nil(t, err)
+			_, err = Compile(obj)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,776 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Scope binds the parameters of a function to their values for Eval.
+type Scope struct {
+	params []*Symbol
+	frame  Frame
+	next   *Scope
+}
+
+// NewScope returns a scope binding params to the values in frame inside
+// next, which is nil for the top level.
+func NewScope(params []*Symbol, frame Frame, next *Scope) *Scope {
+	return &Scope{params, frame, next}
+}
+
+func (s *Scope) lookup(sym *Symbol) (*Object, bool) {
+	for ; s != nil; s = s.next {
+		// the last of the parameters with the same name wins, as in the
+		// compiler
+		for i := len(s.params) - 1; i >= 0; i-- {
+			if s.params[i] == sym {
+				return &s.frame[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Eval evaluates expr in env by walking the expression itself rather than
+// compiling it. It is the reference implementation of the language that
+// the compiler and the engines are tested against, and reports the same
+// errors as compiling and running expr. The macros are expanded and the
+// modules defined before expr is evaluated, as the compiler does.
+func Eval(expr Object, env *Scope) (Object, error) {
+	core, err := newExpander(env).expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	m := newMachine(new(int32))
+	return m.run(func(m *machine, _ *Env) (Object, error) {
+		return m.eval(core, env)
+	})
+}
+
+func properList(argList Object) ([]Object, error) {
+	args, improper, err := ListToSlice(argList)
+	if improper != nil || err != nil {
+		return nil, errors.New("arglist must be proper list")
+	}
+	return args, nil
+}
+
+var operatorArities = map[string]int{
+	"+": 2, "-": 2, "*": 2, "/": 2,
+	"=": 2, "<": 2, ">": 2, "<=": 2, ">=": 2,
+	"cons": 2, "car": 1, "cdr": 1, "null": 1, "atom": 1,
+}
+
+// globalVar refers to a global variable in the expressions expanded for
+// Eval, where the symbols left refer to the local variables.
+type globalVar struct {
+	sym *Symbol
+}
+
+// expander expands the macros in an expression for Eval into the core
+// forms that evalList evaluates, reporting the first error the compiler
+// would report and visiting the subexpressions in the same order. The core
+// forms are the following, where define-syntax and import expand into
+// quote, and module into begin:
+//
+//	(op arg...)
+//	(quote datum)
+//	(if test then else)
+//	(set! var value)
+//	(define var value name)
+//	(begin expr...)
+//	(lambda (param...) expr...)
+//	(try (expr...) handler thunk)
+//	(parameterize thunk param value...)
+//	(fn arg...)
+//
+// The name of define is the name of the function if value is a lambda
+// expression, or nil otherwise, and the handler and the thunk of try are
+// lambda expressions, or nil for the clauses omitted. The names of the
+// global variables are resolved in the namespaces of the modules as the
+// compiler does, but the libraries imported must be defined in expr.
+type expander struct {
+	macros map[*Symbol]*Macro
+	moduleEnv
+	// locals counts the bindings of the local variables in scope
+	locals     map[*Symbol]int
+	level      int
+	macroDepth int
+}
+
+func newExpander(env *Scope) *expander {
+	e := &expander{macros: map[*Symbol]*Macro{}, moduleEnv: newModuleEnv(), locals: map[*Symbol]int{}}
+	for s := env; s != nil; s = s.next {
+		for _, param := range s.params {
+			e.locals[param]++
+		}
+	}
+	return e
+}
+
+func coreForm(name string, args ...Object) *Cons {
+	return &Cons{Intern(name), SliceToList(args)}
+}
+
+func (e *expander) expand(expr Object) (Object, error) {
+	switch x := expr.(type) {
+	case *Symbol:
+		if e.locals[x] > 0 {
+			return x, nil
+		}
+		global, err := e.global(x)
+		if err != nil {
+			return nil, err
+		}
+		return &globalVar{global}, nil
+	case *Cons:
+		return e.expandList(x)
+	default:
+		return x, nil
+	}
+}
+
+func (e *expander) expandAll(exprs []Object) ([]Object, error) {
+	ret := make([]Object, len(exprs))
+	for i, expr := range exprs {
+		x, err := e.expand(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = x
+	}
+	return ret, nil
+}
+
+func (e *expander) expandList(form *Cons) (Object, error) {
+	switch car := form.car.(type) {
+	case *Symbol:
+		name := keyword(car)
+		if n, ok := operatorArities[name]; ok {
+			args, err := takeArgs(n, form.cdr)
+			if err != nil {
+				return nil, err
+			}
+			if args, err = e.expandAll(args); err != nil {
+				return nil, err
+			}
+			return coreForm(name, args...), nil
+		}
+		switch name {
+		case "quote":
+			args, err := takeArgs(1, form.cdr)
+			if err != nil {
+				return nil, err
+			}
+			return coreForm(name, stripRenames(args[0], map[*Cons]bool{})), nil
+		case "if":
+			args, err := takeArgs(3, form.cdr)
+			if err != nil {
+				return nil, err
+			}
+			if args, err = e.expandAll(args); err != nil {
+				return nil, err
+			}
+			return coreForm(name, args...), nil
+		case "set!", "define":
+			return e.expandSet(form.cdr, name == "define")
+		case "begin":
+			args, err := properList(form.cdr)
+			if err != nil {
+				return nil, err
+			}
+			if args, err = e.expandAll(args); err != nil {
+				return nil, err
+			}
+			return coreForm(name, args...), nil
+		case "lambda":
+			return e.expandLambda(form.cdr)
+		case "try":
+			return e.expandTry(form.cdr)
+		case "parameterize":
+			return e.expandParameterize(form.cdr)
+		case "define-syntax":
+			return e.expandDefineSyntax(form.cdr)
+		case "module":
+			return e.expandModule(form.cdr)
+		case "import":
+			return e.expandImport(form.cdr)
+		}
+		if m := e.macroOf(car); m != nil {
+			return e.expandMacro(m, form)
+		}
+	case *Cons:
+	default:
+		return nil, fmt.Errorf("%s is not applicable", ToString(car))
+	}
+	args, err := properList(form.cdr)
+	if err != nil {
+		return nil, err
+	}
+	if args, err = e.expandAll(args); err != nil {
+		return nil, err
+	}
+	fn, err := e.expand(form.car)
+	if err != nil {
+		return nil, err
+	}
+	return &Cons{fn, SliceToList(args)}, nil
+}
+
+func (e *expander) expandSet(argList Object, define bool) (Object, error) {
+	args, err := takeArgs(2, argList)
+	if err != nil {
+		return nil, err
+	}
+	sym, ok := args[0].(*Symbol)
+	if !ok {
+		return nil, errors.New("first argument of set! must be a symbol")
+	}
+	var value, name Object
+	if lambda, ok := clauseOf(args[1], "lambda"); ok && define {
+		value, err = e.expandLambda(lambda.cdr)
+		name = sym
+	} else {
+		value, err = e.expand(args[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v Object = sym
+	if e.locals[sym] == 0 {
+		global, err := e.assignee(sym, define)
+		if err != nil {
+			return nil, err
+		}
+		v = &globalVar{global}
+	}
+	if !define {
+		return coreForm("set!", v, value), nil
+	}
+	return coreForm("define", v, value, name), nil
+}
+
+func (e *expander) expandLambda(argList Object) (Object, error) {
+	args, err := properList(argList)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("lambda needs parameters")
+	}
+	params, err := properList(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, param := range params {
+		if _, ok := param.(*Symbol); !ok {
+			return nil, errors.New("fn argument must be symbol")
+		}
+	}
+	for _, param := range params {
+		e.locals[param.(*Symbol)]++
+	}
+	e.level++
+	defer func() {
+		e.level--
+		for _, param := range params {
+			e.locals[param.(*Symbol)]--
+		}
+	}()
+	body, err := e.expandAll(args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &Cons{Intern("lambda"), &Cons{SliceToList(params), SliceToList(body)}}, nil
+}
+
+// tryClauses splits the arguments of try into the body and the clauses.
+func tryClauses(argList Object) (body []Object, catch, finally *Cons, err error) {
+	args, err := properList(argList)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, arg := range args {
+		if clause, ok := clauseOf(arg, "catch"); ok && catch == nil && finally == nil {
+			catch = clause
+		} else if clause, ok := clauseOf(arg, "finally"); ok && finally == nil {
+			finally = clause
+		} else if catch == nil && finally == nil {
+			body = append(body, arg)
+		} else {
+			return nil, nil, nil, errors.New("catch and finally clauses must come last in try")
+		}
+	}
+	if catch == nil && finally == nil {
+		return nil, nil, nil, errors.New("try needs catch or finally clause")
+	}
+	return body, catch, finally, nil
+}
+
+func (e *expander) expandTry(argList Object) (Object, error) {
+	body, catch, finally, err := tryClauses(argList)
+	if err != nil {
+		return nil, err
+	}
+	var handler, thunk Object
+	if finally != nil {
+		cleanup, err := properList(finally.cdr)
+		if err != nil {
+			return nil, err
+		}
+		if len(cleanup) == 0 {
+			cleanup = []Object{nil}
+		}
+		// the compiler expands the cleanup once more outside the thunk,
+		// which expands into the same core forms
+		if thunk, err = e.expandLambda(&Cons{nil, SliceToList(cleanup)}); err != nil {
+			return nil, err
+		}
+	}
+	if catch != nil {
+		clause, ok := catch.cdr.(*Cons)
+		if !ok {
+			return nil, errors.New("catch clause must have a variable")
+		}
+		if _, ok := clause.car.(*Symbol); !ok {
+			return nil, errors.New("catch variable must be a symbol")
+		}
+		body := clause.cdr
+		if body == nil {
+			body = &Cons{nil, nil}
+		}
+		if handler, err = e.expandLambda(&Cons{&Cons{clause.car, nil}, body}); err != nil {
+			return nil, err
+		}
+	}
+	if len(body) == 0 {
+		body = []Object{nil}
+	}
+	if body, err = e.expandAll(body); err != nil {
+		return nil, err
+	}
+	return coreForm("try", SliceToList(body), handler, thunk), nil
+}
+
+// parameterizeClauses splits the arguments of parameterize into the
+// bindings, each of a parameter and a value, and the body.
+func parameterizeClauses(argList Object) (bindings [][]Object, body []Object, err error) {
+	args, err := properList(argList)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil, errors.New("parameterize needs bindings")
+	}
+	clauses, err := properList(args[0])
+	if err != nil {
+		return nil, nil, errors.New("parameterize needs bindings")
+	}
+	for _, clause := range clauses {
+		binding, err := takeArgs(2, clause)
+		if err != nil {
+			return nil, nil, errors.New("parameterize binding must be a list of a parameter and a value")
+		}
+		bindings = append(bindings, binding)
+	}
+	body = args[1:]
+	if len(body) == 0 {
+		body = []Object{nil}
+	}
+	return bindings, body, nil
+}
+
+func (e *expander) expandParameterize(argList Object) (Object, error) {
+	bindings, body, err := parameterizeClauses(argList)
+	if err != nil {
+		return nil, err
+	}
+	thunk, err := e.expandLambda(&Cons{nil, SliceToList(body)})
+	if err != nil {
+		return nil, err
+	}
+	args := []Object{thunk}
+	for _, binding := range bindings {
+		values, err := e.expandAll(binding)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, values...)
+	}
+	return coreForm("parameterize", args...), nil
+}
+
+func (e *expander) expandDefineSyntax(argList Object) (Object, error) {
+	args, err := takeArgs(2, argList)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := args[0].(*Symbol)
+	if !ok {
+		return nil, errors.New("first argument of define-syntax must be a symbol")
+	}
+	if e.level > 0 {
+		return nil, errors.New("define-syntax must be at the top level")
+	}
+	m, err := parseSyntaxRules(name, args[1])
+	if err != nil {
+		return nil, err
+	}
+	e.macros[name.original()] = m
+	return coreForm("quote", name.original()), nil
+}
+
+func (e *expander) expandModule(argList Object) (Object, error) {
+	args, err := properList(argList)
+	if err != nil {
+		return nil, err
+	}
+	if e.level > 0 || e.current != nil {
+		return nil, errors.New("module must be at the top level")
+	}
+	m, exports, body, err := e.newModule(args)
+	if err != nil {
+		return nil, err
+	}
+	defer func(current *module, names namespace) {
+		e.current, e.names = current, names
+	}(e.current, e.names)
+	e.current, e.names = m, m.names
+	if body, err = e.expandAll(body); err != nil {
+		return nil, err
+	}
+	if err := e.export(m, exports); err != nil {
+		return nil, err
+	}
+	return coreForm("begin", append(body, coreForm("quote", m.name))...), nil
+}
+
+func (e *expander) expandImport(argList Object) (Object, error) {
+	sets, err := properList(argList)
+	if err != nil {
+		return nil, err
+	}
+	if e.level > 0 {
+		return nil, errors.New("import must be at the top level")
+	}
+	if err := e.importSets(sets, e.loadModule); err != nil {
+		return nil, err
+	}
+	return coreForm("quote", nil), nil
+}
+
+// loadModule returns the module name defined so far. Eval has no library
+// path to load library files from.
+func (e *expander) loadModule(name Object) (*module, error) {
+	key, path, err := libraryKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if m := e.modules[key]; m != nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("library file %s is not found", path)
+}
+
+// macroOf returns the macro sym refers to, unless it names a variable.
+func (e *expander) macroOf(sym *Symbol) *Macro {
+	if e.locals[sym] > 0 {
+		return nil
+	}
+	return e.macros[sym.original()]
+}
+
+func (e *expander) expandMacro(m *Macro, form *Cons) (Object, error) {
+	if e.macroDepth >= maxMacroDepth {
+		return nil, fmt.Errorf("macro expansion of %s is nested too deeply", m.name.name)
+	}
+	expanded, err := m.Expand(form)
+	if err != nil {
+		return nil, err
+	}
+	e.macroDepth++
+	defer func() { e.macroDepth-- }()
+	return e.expand(expanded)
+}
+
+// sliceOrNil returns the elements of a list already known to be proper.
+func sliceOrNil(list Object) []Object {
+	elems, _, _ := ListToSlice(list)
+	return elems
+}
+
+func (m *machine) eval(expr Object, env *Scope) (Object, error) {
+	switch e := expr.(type) {
+	case *Symbol:
+		if v, ok := env.lookup(e); ok {
+			return *v, nil
+		}
+		return nil, fmt.Errorf("unbound variable: %s", e.name)
+	case *globalVar:
+		if !e.sym.bound {
+			return nil, fmt.Errorf("unbound variable: %s", e.sym.name)
+		}
+		return e.sym.value, nil
+	case *Cons:
+		return m.evalList(e, env)
+	default:
+		return copyLiteral(expr), nil
+	}
+}
+
+func (m *machine) evalAll(exprs []Object, env *Scope) (Frame, error) {
+	values := make(Frame, len(exprs))
+	for i, expr := range exprs {
+		v, err := m.eval(expr, env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (m *machine) evalBody(body []Object, env *Scope) (Object, error) {
+	var ret Object
+	for _, expr := range body {
+		v, err := m.eval(expr, env)
+		if err != nil {
+			return nil, err
+		}
+		ret = v
+	}
+	return ret, nil
+}
+
+// evalList evaluates one of the core forms that the expander expands
+// into. The symbols standing for special forms are never variables there.
+func (m *machine) evalList(form *Cons, env *Scope) (Object, error) {
+	args := sliceOrNil(form.cdr)
+	if sym, ok := form.car.(*Symbol); ok {
+		name := keyword(sym)
+		if _, ok := operatorArities[name]; ok {
+			values, err := m.evalAll(args, env)
+			if err != nil {
+				return nil, err
+			}
+			return applyOperator(name, values)
+		}
+		switch name {
+		case "quote":
+			return copyLiteral(args[0]), nil
+		case "if":
+			test, err := m.eval(args[0], env)
+			if err != nil {
+				return nil, err
+			}
+			if ToBool(test) {
+				return m.eval(args[1], env)
+			}
+			return m.eval(args[2], env)
+		case "set!":
+			return m.evalSet(args[0], args[1], nil, false, env)
+		case "define":
+			return m.evalSet(args[0], args[1], args[2], true, env)
+		case "begin":
+			return m.evalBody(args, env)
+		case "lambda":
+			return m.evalLambda(form, env, &LambdaInfo{}), nil
+		case "try":
+			return m.evalTry(args, env)
+		case "parameterize":
+			return m.evalParameterize(args, env)
+		}
+	}
+	values, err := m.evalAll(args, env)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := m.eval(form.car, env)
+	if err != nil {
+		return nil, err
+	}
+	return m.apply(fn, values)
+}
+
+// evalClosure is a function created by Eval: the parameters and the body
+// of a lambda expression, and the scope it was evaluated in.
+type evalClosure struct {
+	params []*Symbol
+	body   []Object
+	scope  *Scope
+}
+
+// apply applies fn to args. The evaluator applies the functions it creates
+// by itself rather than as the engines do, so that function calls in the
+// engines are tested against it. Primitives, and the functions that the
+// engines create, are called as they implement them.
+func (m *machine) apply(fn Object, args Frame) (Object, error) {
+	switch f := fn.(type) {
+	case applicable:
+		return f.call(m.vm, args)
+	case *Func:
+		if f.eval == nil {
+			return m.vm.apply(f, args)
+		}
+		if len(args) != f.info.arity {
+			return nil, fmt.Errorf("wrong number of arguments to %s: expected %d, got %d", f.Name(), f.info.arity, len(args))
+		}
+		if atomic.LoadInt32(m.interrupted) != 0 {
+			return nil, ErrInterrupted
+		}
+		if len(m.frames) >= maxCallDepth {
+			return nil, errors.New("stack overflow")
+		}
+		// the frame is recorded for backtraces, and for the functions that
+		// primitives call back to know where they are called from
+		m.frames = append(m.frames, f)
+		defer func() { m.frames = m.frames[:len(m.frames)-1] }()
+		c := f.eval
+		v, err := m.evalBody(c.body, NewScope(c.params, args, c.scope))
+		if err != nil {
+			return nil, m.error(err)
+		}
+		return v, nil
+	default:
+		return nil, errors.New("cannot apply object other than function")
+	}
+}
+
+// applyOperator applies the special form compiled into a single
+// instruction to its argument values as the VM does.
+func applyOperator(name string, values Frame) (Object, error) {
+	switch name {
+	case "cons":
+		return NewCons(values[0], values[1]), nil
+	case "car":
+		return Car(values[0])
+	case "cdr":
+		return Cdr(values[0])
+	case "null":
+		return FromBool(IsNull(values[0])), nil
+	case "atom":
+		return FromBool(IsAtom(values[0])), nil
+	case "/":
+		if values[1] == 0 {
+			return nil, errors.New("division by zero")
+		}
+	}
+	// the second operand is checked first, as the VM pops it first
+	y, err := ToNumber(values[1])
+	if err != nil {
+		return nil, err
+	}
+	x, err := ToNumber(values[0])
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		return x / y, nil
+	case "=":
+		return FromBool(x == y), nil
+	case "<":
+		return FromBool(x < y), nil
+	case ">":
+		return FromBool(x > y), nil
+	case "<=":
+		return FromBool(x <= y), nil
+	default:
+		return FromBool(x >= y), nil
+	}
+}
+
+// evalSet assigns the value of expr to v, a local variable or a
+// globalVar, for set! and define. A non-nil name is the name of the
+// function that expr creates for define.
+func (m *machine) evalSet(v, expr, name Object, define bool, env *Scope) (Object, error) {
+	var value Object
+	var err error
+	if sym, ok := name.(*Symbol); ok {
+		value = m.evalLambda(expr.(*Cons), env, &LambdaInfo{name: sym.name})
+	} else if value, err = m.eval(expr, env); err != nil {
+		return nil, err
+	}
+	g, ok := v.(*globalVar)
+	if !ok {
+		loc, _ := env.lookup(v.(*Symbol))
+		*loc = value
+		return value, nil
+	}
+	if p := parameterVariables[g.sym]; p != nil {
+		return m.apply(setParameterPrimitive, []Object{p, value})
+	}
+	if !define && !g.sym.bound {
+		return nil, fmt.Errorf("cannot set! unbound variable: %s", g.sym.name)
+	}
+	if err := assignGlobal(m.vm, g.sym, value, define); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// evalLambda creates a function that evaluates the body of the lambda
+// expression in the scope it is created in.
+func (m *machine) evalLambda(lambda *Cons, env *Scope, info *LambdaInfo) *Func {
+	args := lambda.cdr.(*Cons)
+	params := sliceOrNil(args.car)
+	c := &evalClosure{make([]*Symbol, len(params)), sliceOrNil(args.cdr), env}
+	for i, param := range params {
+		c.params[i] = param.(*Symbol)
+	}
+	info.arity = len(params)
+	// the body is for the engines and primitives calling the function
+	return &Func{info: info, eval: c, body: func(m *machine, args *Env) (Object, error) {
+		return m.evalBody(c.body, NewScope(c.params, args.frame, c.scope))
+	}}
+}
+
+func (m *machine) evalParameterize(args []Object, env *Scope) (Object, error) {
+	thunk := m.evalLambda(args[0].(*Cons), env, &LambdaInfo{name: "parameterize"})
+	values, err := m.evalAll(args[1:], env)
+	if err != nil {
+		return nil, err
+	}
+	return m.apply(parameterizePrimitive, append(Frame{thunk}, values...))
+}
+
+func (m *machine) evalTry(args []Object, env *Scope) (Object, error) {
+	body := sliceOrNil(args[0])
+	var thunk *Func
+	var cleanup []Object
+	if finally, ok := args[2].(*Cons); ok {
+		thunk = m.evalLambda(finally, env, &LambdaInfo{name: "finally"})
+		cleanup = thunk.eval.body
+	}
+	var handler *Func
+	if catch, ok := args[1].(*Cons); ok {
+		handler = m.evalLambda(catch, env, &LambdaInfo{name: "catch"})
+	}
+	v, err := m.evalBody(body, env)
+	if err != nil && handler != nil && !errors.Is(err, ErrInterrupted) {
+		v, err = m.apply(handler, Frame{raisedValue(err)})
+	}
+	if thunk == nil {
+		return v, err
+	}
+	if err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			return nil, err
+		}
+		if _, cerr := m.apply(thunk, nil); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+	if _, err := m.evalBody(cleanup, env); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,209 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(+ 1 2)", "3"},
+		{"'(1 2)", "(1 2)"},
+		{"#(1 2)", "#(1 2)"},
+		{"((lambda (x y) (cons x y)) 1 2)", "(1 . 2)"},
+		{"((lambda (x x) x) 1 2)", "2"},
+		{"((lambda (x) ((lambda (y) (+ x y)) 2)) 1)", "3"},
+		{"((lambda (car) (car car)) '(1))", "1"},
+		{"((lambda (x) (begin (define x 5) x)) 1)", "5"},
+		{"(begin (define eval-f (lambda (x) x)) eval-f)", "#<func eval-f/1>"},
+		{"(try (raise 1) (catch e (+ e 1)))", "2"},
+		{"(vector-length (make-vector 3))", "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			expr, err := ReadFromString(tt.in)
+			assert.Nil(t, err)
+			v, err := Eval(expr, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.out, ToString(v))
+		})
+	}
+}
+
+func TestEvalScope(t *testing.T) {
+	x := Intern("x")
+	expr, err := ReadFromString("(begin (set! x (* x 2)) x)")
+	assert.Nil(t, err)
+	v, err := Eval(expr, NewScope([]*Symbol{x}, Frame{21}, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 42, v)
+}
+
+var evalPrograms = []string{
+	"(+ 1)",
+	"(if t 1)",
+	"(if t 1 (+ 1))",
+	"(set! 1 2)",
+	"(begin 1 . 2)",
+	"(lambda)",
+	"(lambda (1) 1)",
+	"(lambda (x) (car))",
+	"(f 1 . 2)",
+	"(\"f\" 1)",
+	"(try 1 (catch))",
+	"(try 1 (catch 1))",
+	"(try 1 (catch e) 2)",
+	"(try (car) (finally (cdr)))",
+	"(quote)",
+	"((lambda (x) (set! x)) 1)",
+	"(begin (define eval-h (lambda (x) (/ 1 x))) (eval-h 0))",
+	"(parameterize ((*print-right-margin* 60)) (set! *print-right-margin* 70) (*print-right-margin*))",
+	"(parameterize ((current-output-port (current-output-port))) (set! current-output-port 1))",
+}
+
+func compileAndRun(expr Object) (Object, error) {
+	code, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return NewVM(code).Run()
+}
+
+func compileAndRunClosure(expr Object) (Object, error) {
+	code, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := compileClosure(code)
+	if err != nil {
+		return nil, err
+	}
+	return newMachine(new(int32)).run(c)
+}
+
+func describeResult(v Object, err error) string {
+	if err == nil {
+		return ToString(v)
+	}
+	var lerr *Error
+	if errors.As(err, &lerr) {
+		return fmt.Sprintf("error: %s at %v", err, lerr.Backtrace())
+	}
+	return "error: " + err.Error()
+}
+
+// assertSameAsEngines asserts that Eval and the engines agree on input.
+func assertSameAsEngines(t *testing.T, input string) {
+	expr, err := ReadFromString(input)
+	assert.Nil(t, err)
+	expected := describeResult(Eval(expr, nil))
+	assert.Equal(t, expected, describeResult(compileAndRun(expr)), input)
+	assert.Equal(t, expected, describeResult(compileAndRunClosure(expr)), input)
+}
+
+func TestEvalDifferential(t *testing.T) {
+	var programs []string
+	programs = append(programs, differentialPrograms...)
+	programs = append(programs, enginePrograms...)
+	programs = append(programs, evalPrograms...)
+	programs = append(programs, modulePrograms...)
+	for _, in := range macroPrograms {
+		programs = append(programs, fmt.Sprintf("(begin %s %s)", testMacros, in))
+	}
+	for _, in := range programs {
+		t.Run(in, func(t *testing.T) {
+			assertSameAsEngines(t, in)
+		})
+	}
+}
+
+// exprGenerator generates random expressions that exercise the special
+// forms, closures and errors.
+type exprGenerator struct {
+	r *rand.Rand
+}
+
+var (
+	genOps   = []string{"+", "-", "*", "/", "=", "<", ">", "<=", ">=", "cons"}
+	genUnary = []string{"car", "cdr", "null", "atom"}
+	genLeafs = []string{"0", "1", "2", "-3", "7", "nil", "t", "'a", "'(1 2)", "\"s\""}
+)
+
+func (g *exprGenerator) leaf(vars []string) string {
+	if len(vars) > 0 && g.r.Intn(2) == 0 {
+		return vars[g.r.Intn(len(vars))]
+	}
+	return genLeafs[g.r.Intn(len(genLeafs))]
+}
+
+func (g *exprGenerator) expr(depth int, vars []string) string {
+	if depth == 0 || g.r.Intn(5) == 0 {
+		return g.leaf(vars)
+	}
+	sub := func() string { return g.expr(depth-1, vars) }
+	switch g.r.Intn(10) {
+	case 0, 1:
+		return fmt.Sprintf("(%s %s %s)", genOps[g.r.Intn(len(genOps))], sub(), sub())
+	case 2:
+		return fmt.Sprintf("(%s %s)", genUnary[g.r.Intn(len(genUnary))], sub())
+	case 3:
+		return fmt.Sprintf("(if %s %s %s)", sub(), sub(), sub())
+	case 4:
+		v := fmt.Sprintf("v%d", len(vars))
+		body := g.expr(depth-1, append(vars[:len(vars):len(vars)], v))
+		return fmt.Sprintf("((lambda (%s) %s) %s)", v, body, sub())
+	case 5:
+		if len(vars) == 0 {
+			return fmt.Sprintf("(begin %s %s)", sub(), sub())
+		}
+		return fmt.Sprintf("(begin (set! %s %s) %s)", vars[g.r.Intn(len(vars))], sub(), sub())
+	case 6:
+		return fmt.Sprintf("(try %s (catch e (cons 'caught e)))", sub())
+	case 7:
+		return fmt.Sprintf("(raise %s)", sub())
+	case 8:
+		if len(vars) == 0 {
+			return fmt.Sprintf("(try %s (finally %s))", sub(), sub())
+		}
+		v := vars[g.r.Intn(len(vars))]
+		return fmt.Sprintf("(try (try %s (finally (set! %s 'done))) (catch e %s))", sub(), v, v)
+	default:
+		v := fmt.Sprintf("v%d", len(vars))
+		body := g.expr(depth-1, append(vars[:len(vars):len(vars)], v))
+		return fmt.Sprintf("((lambda (f) (f %s)) (lambda (%s) %s))", sub(), v, body)
+	}
+}
+
+func TestEvalRandom(t *testing.T) {
+	g := &exprGenerator{rand.New(rand.NewSource(1))}
+	for i := 0; i < 1000; i++ {
+		in := g.expr(5, nil)
+		assertSameAsEngines(t, in)
+		if t.Failed() {
+			t.Logf("failed on expression #%d", i)
+			break
+		}
+	}
+}
+
+func TestExprGenerator(t *testing.T) {
+	g := &exprGenerator{rand.New(rand.NewSource(1))}
+	forms := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		in := g.expr(5, nil)
+		for _, form := range []string{"(if ", "(lambda ", "(try ", "(raise ", "(set! "} {
+			if strings.Contains(in, form) {
+				forms[form] = true
+			}
+		}
+	}
+	assert.Len(t, forms, 5)
+}
@@ -0,0 +1,220 @@
+package lisp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSystem is what scripts access files through. Names are slash
+// separated and relative to the root of the file system, as fs.ValidPath
+// requires, so that scripts cannot reach the files outside it.
+type FileSystem interface {
+	fs.ReadDirFS
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+var (
+	errOutsideRoot  = errors.New("path leads outside the root directory")
+	errDanglingLink = errors.New("symbolic link to a file that does not exist")
+)
+
+type dirFS string
+
+// NewDirFS returns the file system of the files under the directory root.
+// Symbolic links leading outside the directory are not followed, nor are
+// the ones to files that do not exist. Paths are checked before the files
+// are opened, so this does not guard against the directory being changed
+// in between by another process, which must not be able to write into it.
+func NewDirFS(root string) FileSystem {
+	return dirFS(root)
+}
+
+// resolve returns the path in the host file system of the file name.
+func (dir dirFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(string(dir))
+	if err != nil {
+		return "", pathError(op, name, err)
+	}
+	path := filepath.Join(root, filepath.FromSlash(name))
+	// creating a file through a dangling symbolic link would create the
+	// file it points to, wherever that is
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if _, err := filepath.EvalSymlinks(path); errors.Is(err, fs.ErrNotExist) {
+			return "", &fs.PathError{Op: op, Path: name, Err: errDanglingLink}
+		}
+	}
+	// a file to be created does not exist yet, so the nearest existing
+	// ancestor is checked instead
+	for p := path; ; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			if !isWithin(root, real) {
+				return "", &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+			}
+			return path, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", pathError(op, name, err)
+		}
+	}
+}
+
+// pathError reports err in resolving name, leaving out the path in the
+// host file system that the errors of the os functions include.
+func pathError(op, name string, err error) error {
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		err = perr.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// hidePath replaces the path in the host file system in err with name, so
+// that errors do not tell scripts where the root is.
+func hidePath(err error, name string) error {
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		perr.Path = name
+	}
+	return err
+}
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	path, err := dir.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, hidePath(err, name)
+	}
+	return f, nil
+}
+
+func (dir dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := dir.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	return entries, hidePath(err, name)
+}
+
+func (dir dirFS) Create(name string) (io.WriteCloser, error) {
+	path, err := dir.resolve("create", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, hidePath(err, name)
+	}
+	return f, nil
+}
+
+func (dir dirFS) Remove(name string) error {
+	path, err := dir.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	return hidePath(os.Remove(path), name)
+}
+
+// fileSystemOf returns the file system of the interpreter running vm.
+func fileSystemOf(vm *VM) (FileSystem, error) {
+	if vm.interpreter == nil || vm.interpreter.fsys == nil {
+		return nil, errors.New("no file system is available")
+	}
+	return vm.interpreter.fsys, nil
+}
+
+// fileArg returns the file system to access and the name in args[0].
+func fileArg(vm *VM, args []Object) (FileSystem, string, error) {
+	fsys, err := fileSystemOf(vm)
+	if err != nil {
+		return nil, "", err
+	}
+	name, err := toRunes(args[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return fsys, string(name), nil
+}
+
+func init() {
+	definePrimitiveWith(capReadFiles, "open-input-file", 1, 1, func(vm *VM, args []Object) (Object, error) {
+		fsys, name, err := fileArg(vm, args)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		port := NewInputPort(f)
+		port.closer = f
+		return port, nil
+	})
+	definePrimitiveWith(capWriteFiles, "open-output-file", 1, 1, func(vm *VM, args []Object) (Object, error) {
+		fsys, name, err := fileArg(vm, args)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fsys.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		port := NewOutputPort(f)
+		port.closer = f
+		return port, nil
+	})
+	definePrimitiveWith(capReadFiles, "file-exists?", 1, 1, func(vm *VM, args []Object) (Object, error) {
+		fsys, name, err := fileArg(vm, args)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fs.Stat(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return FromBool(err == nil), err
+	})
+	definePrimitiveWith(capReadFiles, "directory-list", 0, 1, func(vm *VM, args []Object) (Object, error) {
+		if len(args) == 0 {
+			args = []Object{"."}
+		}
+		fsys, name, err := fileArg(vm, args)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]Object, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name()
+		}
+		return SliceToList(names), nil
+	})
+	definePrimitiveWith(capWriteFiles, "delete-file", 1, 1, func(vm *VM, args []Object) (Object, error) {
+		fsys, name, err := fileArg(vm, args)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fsys.Remove(name)
+	})
+}
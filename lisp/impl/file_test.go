@@ -0,0 +1,95 @@
+package lisp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilePrimitives(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(file-exists? "data.txt")`, "t"},
+		{`(file-exists? "sub")`, "t"},
+		{`(file-exists? "missing.txt")`, "nil"},
+		{`(read-line (open-input-file "data.txt"))`, `"line 1"`},
+		{`((lambda (p) (read-line p) (read p)) (open-input-file "data.txt"))`, "(a b)"},
+		{`(directory-list)`, `("data.txt" "sub")`},
+		{`(directory-list "sub")`, `("inner.txt")`},
+		{`((lambda (p) (write '(1 "x") p) (close-port p) (close-port p)) (open-output-file "sub/out.txt"))`, "nil"},
+		{`((lambda (p) (read p)) (open-input-file "sub/out.txt"))`, `(1 "x")`},
+		{`(delete-file "sub/out.txt")`, "nil"},
+		{`(file-exists? "sub/out.txt")`, "nil"},
+		{`(directory-list "sub")`, `("inner.txt")`},
+		{`(open-input-file "missing.txt")`, "error: open missing.txt: no such file or directory"},
+		{`(open-input-file "data.txt/x")`, "error: open data.txt/x: not a directory"},
+		{`(open-output-file "data.txt/x")`, "error: create data.txt/x: not a directory"},
+		{`(open-input-file 'data)`, "error: string expected, but got data"},
+		{`(close-port 1)`, "error: port expected, but got 1"},
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.txt"), []byte("line 1\n(a b)\n"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "inner.txt"), nil, 0644))
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		in.SetFileSystem(NewDirFS(dir))
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+}
+
+func TestFileSystemConfinement(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(open-input-file "../secret.txt")`, "error: open ../secret.txt: invalid argument"},
+		{`(open-input-file "root/../../secret.txt")`, "error: open root/../../secret.txt: invalid argument"},
+		{`(open-input-file "/etc/passwd")`, "error: open /etc/passwd: invalid argument"},
+		{`(file-exists? "../secret.txt")`, "error: open ../secret.txt: invalid argument"},
+		{`(directory-list "..")`, "error: readdir ..: invalid argument"},
+		{`(open-output-file "../new.txt")`, "error: create ../new.txt: invalid argument"},
+		{`(delete-file "../secret.txt")`, "error: remove ../secret.txt: invalid argument"},
+		{`(open-input-file "link/secret.txt")`, "error: open link/secret.txt: path leads outside the root directory"},
+		{`(open-output-file "link/new.txt")`, "error: create link/new.txt: path leads outside the root directory"},
+		{`(open-input-file "secret-link")`, "error: open secret-link: path leads outside the root directory"},
+		{`(open-output-file "dangling")`, "error: create dangling: symbolic link to a file that does not exist"},
+		{`(open-output-file "dangling-inside")`, "error: create dangling-inside: symbolic link to a file that does not exist"},
+		{`(open-input-file "dangling")`, "error: open dangling: symbolic link to a file that does not exist"},
+	}
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.txt")
+	require.NoError(t, os.WriteFile(secret, []byte("secret"), 0644))
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink(secret, filepath.Join(dir, "secret-link")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "evil.txt"), filepath.Join(dir, "dangling")))
+	require.NoError(t, os.Symlink("missing.txt", filepath.Join(dir, "dangling-inside")))
+	in := NewInterpreter()
+	in.SetFileSystem(NewDirFS(dir))
+	for _, tt := range tests {
+		out, _ := evalIn(in, tt.in)
+		assert.Equal(t, tt.out, out, tt.in)
+	}
+	for _, name := range []string{"new.txt", "evil.txt"} {
+		_, err := os.Stat(filepath.Join(outside, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// the errors in resolving paths never reveal where the root is
+	in.SetFileSystem(NewDirFS(filepath.Join(dir, "missing")))
+	out, _ := evalIn(in, `(open-input-file "data.txt")`)
+	assert.Equal(t, "error: open data.txt: no such file or directory", out)
+
+	out, _ = evalIn(NewInterpreter(), `(file-exists? "data.txt")`)
+	assert.Equal(t, "error: no file system is available", out)
+}
@@ -0,0 +1,129 @@
+package lisp
+
+// closureInfo is what generating flat closures needs to know about the
+// variables of a program.
+type closureInfo struct {
+	// free lists the variables each lambda expression uses but does not
+	// bind, in the order they are first used
+	free map[*Lambda][]*Var
+	// boxed tells the variables that are both captured by some lambda
+	// expression and assigned
+	boxed map[*Var]bool
+}
+
+// varSet is a set of variables that remembers the order they are added in.
+type varSet struct {
+	vars []*Var
+	seen map[*Var]bool
+}
+
+func newVarSet() *varSet {
+	return &varSet{seen: map[*Var]bool{}}
+}
+
+func (s *varSet) add(v *Var) {
+	if !s.seen[v] {
+		s.seen[v] = true
+		s.vars = append(s.vars, v)
+	}
+}
+
+type closureAnalyzer struct {
+	info     *closureInfo
+	captured map[*Var]bool
+	assigned map[*Var]bool
+}
+
+// analyzeClosures computes the free variables of every lambda expression in
+// node and finds the variables to be boxed.
+func analyzeClosures(node Node) *closureInfo {
+	a := &closureAnalyzer{
+		info:     &closureInfo{free: map[*Lambda][]*Var{}, boxed: map[*Var]bool{}},
+		captured: map[*Var]bool{},
+		assigned: map[*Var]bool{},
+	}
+	a.walk(node, newVarSet())
+	for v := range a.assigned {
+		if a.captured[v] {
+			a.info.boxed[v] = true
+		}
+	}
+	return a.info
+}
+
+// walk adds the variables node uses from outside of it to refs.
+func (a *closureAnalyzer) walk(node Node, refs *varSet) {
+	switch n := node.(type) {
+	case *LocalRef:
+		refs.add(n.v)
+	case *If:
+		a.walk(n.test, refs)
+		a.walk(n.then, refs)
+		a.walk(n.els, refs)
+	case *Lambda:
+		a.walkLambda(n, refs)
+	case *App:
+		a.walkAll(n.args, refs)
+		a.walk(n.fn, refs)
+	case *PrimApp:
+		a.walkAll(n.args, refs)
+	case *Set:
+		if n.local != nil {
+			refs.add(n.local)
+			a.assigned[n.local] = true
+		}
+		a.walk(n.value, refs)
+	case *Seq:
+		a.walkAll(n.exprs, refs)
+	case *Let:
+		a.walkAll(n.args, refs)
+		body := newVarSet()
+		a.walk(n.body, body)
+		// the variables of a Let live in the frame of the function it is
+		// in, so they are not captured
+		for _, v := range unbound(body.vars, n.params) {
+			refs.add(v)
+		}
+	case *Try:
+		if n.finally != nil {
+			a.walkLambda(n.finally, refs)
+			a.walk(n.cleanup, refs)
+		}
+		if n.handler != nil {
+			a.walkLambda(n.handler, refs)
+		}
+		a.walk(n.body, refs)
+	}
+}
+
+func (a *closureAnalyzer) walkAll(nodes []Node, refs *varSet) {
+	for _, node := range nodes {
+		a.walk(node, refs)
+	}
+}
+
+func (a *closureAnalyzer) walkLambda(n *Lambda, refs *varSet) {
+	body := newVarSet()
+	a.walk(n.body, body)
+	free := unbound(body.vars, n.params)
+	for _, v := range free {
+		a.captured[v] = true
+		refs.add(v)
+	}
+	a.info.free[n] = free
+}
+
+// unbound returns the variables in vars other than params.
+func unbound(vars, params []*Var) []*Var {
+	bound := map[*Var]bool{}
+	for _, param := range params {
+		bound[param] = true
+	}
+	var ret []*Var
+	for _, v := range vars {
+		if !bound[v] {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
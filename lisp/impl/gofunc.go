@@ -0,0 +1,91 @@
+package lisp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// NewGoFunc makes a primitive out of the Go function fn. The arguments are
+// converted to the types of the parameters by Unmarshal, with the ones
+// passed to the variadic parameter, if any, converted to its element type.
+// The results are converted by Marshal, into a list if there is more than
+// one. A trailing error result is not converted, but raised as an error
+// unless it is nil, and so is a panic in fn. Only FullProfile grants the
+// primitive, since fn may do anything; interpreters with other profiles
+// can be allowed to call it by name.
+func NewGoFunc(name string, fn interface{}) (*Primitive, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, fmt.Errorf("cannot define %s: %T is not a function", name, fn)
+	}
+	if f.IsNil() {
+		return nil, fmt.Errorf("cannot define %s: function is nil", name)
+	}
+	t := f.Type()
+	minArgs, maxArgs := t.NumIn(), t.NumIn()
+	if t.IsVariadic() {
+		minArgs, maxArgs = t.NumIn()-1, -1
+	}
+	numOut := t.NumOut()
+	failable := numOut > 0 && t.Out(numOut-1) == errorType
+	if failable {
+		numOut--
+	}
+	p := NewPrimitive(name, minArgs, maxArgs, func(_ *VM, args []Object) (ret Object, err error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var pt reflect.Type
+			if t.IsVariadic() && i >= t.NumIn()-1 {
+				pt = t.In(t.NumIn() - 1).Elem()
+			} else {
+				pt = t.In(i)
+			}
+			in[i] = reflect.New(pt).Elem()
+			if err := unmarshalValue(arg, in[i]); err != nil {
+				return nil, fmt.Errorf("wrong type of argument %d to %s: %v", i+1, name, err)
+			}
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				ret, err = nil, fmt.Errorf("%s panicked: %v", name, r)
+			}
+		}()
+		out := f.Call(in)
+		if failable && !out[numOut].IsNil() {
+			return nil, out[numOut].Interface().(error)
+		}
+		results := make([]Object, numOut)
+		for i := range results {
+			if results[i], err = marshalValue(out[i]); err != nil {
+				return nil, err
+			}
+		}
+		switch numOut {
+		case 0:
+			return nil, nil
+		case 1:
+			return results[0], nil
+		default:
+			return SliceToList(results), nil
+		}
+	})
+	p.capability = capGo
+	return p, nil
+}
+
+// DefineGoFunc binds the primitive made out of fn by NewGoFunc to name in
+// all the namespaces of the interpreter. Unlike the global variables, the
+// binding is only visible to the interpreter, and cannot be assigned,
+// although definitions at the top level shadow it.
+func (in *Interpreter) DefineGoFunc(name string, fn interface{}) error {
+	p, err := NewGoFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	global := NewSymbol(name)
+	global.SetValue(p)
+	in.compiler.goFuncs[Intern(name)] = &binding{global: global}
+	return nil
+}
@@ -0,0 +1,129 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefineGoFunc(t *testing.T) {
+	funcs := map[string]interface{}{
+		"go-upcase": strings.ToUpper,
+		"go-join":   strings.Join,
+		"go-sprint": fmt.Sprint,
+		"go-sum": func(base int, ns ...int) int {
+			for _, n := range ns {
+				base += n
+			}
+			return base
+		},
+		"go-div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"go-divmod": func(a, b int) (int, int) { return a / b, a % b },
+		"go-point":  func(x, y int) marshalPoint { return marshalPoint{x, y} },
+		"go-norm":   func(p marshalPoint) int { return p.X*p.X + p.Y*p.Y },
+		"go-check":  func(s string) error { return nil },
+		"go-nop":    func() {},
+		"go-index":  func(xs []int, i int) int { return xs[i] },
+	}
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(go-upcase "hello")`, `"HELLO"`},
+		{`(go-join '("a" "b" "c") "-")`, `"a-b-c"`},
+		{`(go-sprint "a" 1 'b)`, `"a1b"`},
+		{`(go-sprint)`, `""`},
+		{`(go-sum 1)`, "1"},
+		{`(go-sum 1 2 3)`, "6"},
+		{`(go-div 7 2)`, "3"},
+		{`(go-div 1 0)`, "error: division by zero"},
+		{`(try (go-div 1 0) (catch e (error-message e)))`, `"division by zero"`},
+		{`(go-divmod 7 2)`, "(3 1)"},
+		{`(go-point 1 2)`, "((X . 1) (Y . 2))"},
+		{`(go-norm (go-point 3 4))`, "25"},
+		{`(go-check "x")`, "nil"},
+		{`(go-nop)`, "nil"},
+		{`(map-go-upcase)`, "error: unbound variable: map-go-upcase"},
+		{`(go-upcase 1)`, "error: wrong type of argument 1 to go-upcase: cannot unmarshal 1 into Go value of type string"},
+		{`(go-sum 1 2 "3")`, `error: wrong type of argument 3 to go-sum: cannot unmarshal "3" into Go value of type int`},
+		{`(go-upcase "a" "b")`, "error: wrong number of arguments to go-upcase: expected 1, got 2"},
+		{`(go-sum)`, "error: wrong number of arguments to go-sum: expected at least 1, got 0"},
+		{`(go-index '(1 2) 5)`, "error: go-index panicked: runtime error: index out of range [5] with length 2"},
+		{`go-upcase`, "#<primitive go-upcase>"},
+	}
+	in := NewInterpreter()
+	for name, fn := range funcs {
+		assert.NoError(t, in.DefineGoFunc(name, fn))
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in.SetEngine(engine)
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+
+	assert.EqualError(t, in.DefineGoFunc("go-bad", 1), "cannot define go-bad: int is not a function")
+	var nilFunc func()
+	assert.EqualError(t, in.DefineGoFunc("go-bad", nilFunc), "cannot define go-bad: function is nil")
+}
+
+func TestGoFuncPermissions(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		allow   bool
+		out     string
+	}{
+		{FullProfile, false, `"A"`},
+		{PureProfile, false, "error: permission denied: go-perm-upcase"},
+		{IOReadOnlyProfile, false, "error: permission denied: go-perm-upcase"},
+		{PureProfile, true, `"A"`},
+	}
+	for _, tt := range tests {
+		in := NewInterpreter()
+		assert.NoError(t, in.DefineGoFunc("go-perm-upcase", strings.ToUpper))
+		in.SetProfile(tt.profile)
+		if tt.allow {
+			in.Allow("go-perm-upcase")
+		}
+		out, _ := evalIn(in, `(go-perm-upcase "a")`)
+		assert.Equal(t, tt.out, out, tt.profile.String())
+	}
+}
+
+func TestGoFuncScope(t *testing.T) {
+	in := NewInterpreter()
+	assert.NoError(t, in.DefineGoFunc("go-scoped-upcase", strings.ToUpper))
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(go-scoped-upcase "a")`, `"A"`},
+		{`(module (go mod) (export f) (define f (lambda () (go-scoped-upcase "b"))))`, "(go mod)"},
+		{`(go/mod/f)`, `"B"`},
+		{`(set! go-scoped-upcase 1)`, "error: cannot assign Go function go-scoped-upcase"},
+		{`(define go-scoped-upcase (lambda (s) s))`, "#<func go-scoped-upcase/1>"},
+		{`(go-scoped-upcase "a")`, `"a"`},
+	}
+	for _, tt := range tests {
+		out, _ := evalIn(in, tt.in)
+		assert.Equal(t, tt.out, out, tt.in)
+	}
+	Intern("go-scoped-upcase").Unbind()
+
+	// the other interpreters do not see the function
+	in = NewInterpreter()
+	assert.NoError(t, in.DefineGoFunc("go-scoped-upcase", strings.ToUpper))
+	out, _ := evalIn(NewInterpreter(), `(go-scoped-upcase "a")`)
+	assert.Equal(t, "error: unbound variable: go-scoped-upcase", out)
+	out, _ = evalIn(in, `(go-scoped-upcase "a")`)
+	assert.Equal(t, `"A"`, out)
+}
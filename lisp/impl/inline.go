@@ -0,0 +1,192 @@
+package lisp
+
+// maxInlineSize is the largest number of nodes in the body of a global
+// function to be inlined.
+const maxInlineSize = 16
+
+// inline rewrites the applications of lambda expressions in node, and the
+// calls to the global functions in globals, into Lets binding the
+// parameters to the arguments directly. Applications with the wrong number
+// of arguments are left alone to fail at run time.
+func inline(node Node, globals map[*Symbol]*Lambda) Node {
+	switch n := node.(type) {
+	case *If:
+		return &If{inline(n.test, globals), inline(n.then, globals), inline(n.els, globals)}
+	case *Lambda:
+		return inlineLambda(n, globals)
+	case *App:
+		args := inlineAll(n.args, globals)
+		fn := inline(n.fn, globals)
+		var lambda *Lambda
+		switch f := fn.(type) {
+		case *Lambda:
+			lambda = f
+		case *GlobalRef:
+			// the body has been inlined into when the function was defined
+			lambda = globals[f.sym]
+		}
+		if lambda != nil && len(lambda.params) == len(args) {
+			return &Let{lambda.params, args, lambda.body}
+		}
+		return &App{fn, args}
+	case *PrimApp:
+		return &PrimApp{n.op, inlineAll(n.args, globals)}
+	case *Set:
+		set := *n
+		set.value = inline(n.value, globals)
+		return &set
+	case *Seq:
+		return &Seq{inlineAll(n.exprs, globals)}
+	case *Let:
+		return &Let{n.params, inlineAll(n.args, globals), inline(n.body, globals)}
+	case *Try:
+		try := &Try{body: inline(n.body, globals)}
+		if n.handler != nil {
+			try.handler = inlineLambda(n.handler, globals)
+		}
+		if n.finally != nil {
+			try.finally = inlineLambda(n.finally, globals)
+			try.cleanup = inline(n.cleanup, globals)
+		}
+		return try
+	default:
+		return node
+	}
+}
+
+func inlineAll(nodes []Node, globals map[*Symbol]*Lambda) []Node {
+	ret := make([]Node, len(nodes))
+	for i, node := range nodes {
+		ret[i] = inline(node, globals)
+	}
+	return ret
+}
+
+func inlineLambda(n *Lambda, globals map[*Symbol]*Lambda) *Lambda {
+	return &Lambda{n.params, inline(n.body, globals), n.info}
+}
+
+// nodeSize counts the nodes in node.
+func nodeSize(node Node) int {
+	switch n := node.(type) {
+	case *If:
+		return 1 + nodeSize(n.test) + nodeSize(n.then) + nodeSize(n.els)
+	case *Lambda:
+		return 1 + nodeSize(n.body)
+	case *App:
+		return 1 + nodeSize(n.fn) + nodesSize(n.args)
+	case *PrimApp:
+		return 1 + nodesSize(n.args)
+	case *Set:
+		return 1 + nodeSize(n.value)
+	case *Seq:
+		return 1 + nodesSize(n.exprs)
+	case *Let:
+		return 1 + nodesSize(n.args) + nodeSize(n.body)
+	case *Try:
+		size := 1 + nodeSize(n.body)
+		if n.handler != nil {
+			size += nodeSize(n.handler)
+		}
+		if n.finally != nil {
+			size += nodeSize(n.finally) + nodeSize(n.cleanup)
+		}
+		return size
+	default:
+		return 1
+	}
+}
+
+func nodesSize(nodes []Node) int {
+	size := 0
+	for _, node := range nodes {
+		size += nodeSize(node)
+	}
+	return size
+}
+
+// inlinableDefinitions returns the top-level forms among forms that define
+// a global function by (define name (lambda ...)), for the names never
+// defined again nor assigned anywhere in forms. Forms that only look like
+// assignments, such as quoted ones, count too. Since what macros expand
+// into is not known before forms are compiled, none is returned if forms
+// define macros or use any of macros.
+func inlinableDefinitions(forms []Object, macros map[*Symbol]*Macro) map[*Symbol]*Cons {
+	defs := map[*Symbol]*Cons{}
+	for _, form := range forms {
+		if usesMacros(form, macros) {
+			return defs
+		}
+	}
+	for _, form := range forms {
+		if def, ok := clauseOf(form, "define"); ok {
+			args, _, _ := ListToSlice(def.cdr)
+			if len(args) != 2 {
+				continue
+			}
+			if sym, ok := args[0].(*Symbol); ok {
+				if _, ok := clauseOf(args[1], "lambda"); ok {
+					defs[sym] = def
+				}
+			}
+		}
+	}
+	counts := map[*Symbol]int{}
+	for _, form := range forms {
+		countAssignments(form, counts)
+	}
+	for sym := range defs {
+		// the definition itself counts once
+		if counts[sym] != 1 {
+			delete(defs, sym)
+		}
+	}
+	return defs
+}
+
+// countAssignments counts the forms in obj that look like set! or define
+// of each symbol.
+func countAssignments(obj Object, counts map[*Symbol]int) {
+	for {
+		c, ok := obj.(*Cons)
+		if !ok {
+			return
+		}
+		if sym, ok := c.car.(*Symbol); ok && (sym.name == "set!" || sym.name == "define") {
+			if args, ok := c.cdr.(*Cons); ok {
+				if target, ok := args.car.(*Symbol); ok {
+					counts[target]++
+				}
+			}
+		}
+		countAssignments(c.car, counts)
+		obj = c.cdr
+	}
+}
+
+// usesMacros reports whether obj contains define-syntax or the name of any
+// of macros.
+func usesMacros(obj Object, macros map[*Symbol]*Macro) bool {
+	switch o := obj.(type) {
+	case *Symbol:
+		return o.name == "define-syntax" || macros[o.original()] != nil
+	case *Cons:
+		for {
+			if usesMacros(o.car, macros) {
+				return true
+			}
+			next, ok := o.cdr.(*Cons)
+			if !ok {
+				return usesMacros(o.cdr, macros)
+			}
+			o = next
+		}
+	case *Vector:
+		for _, elem := range o.elems {
+			if usesMacros(elem, macros) {
+				return true
+			}
+		}
+	}
+	return false
+}
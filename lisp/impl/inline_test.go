@@ -0,0 +1,210 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compileForms(t *testing.T, c *Compiler, inputs []string) []Code {
+	forms := make([]Object, len(inputs))
+	for i, input := range inputs {
+		expr, err := ReadFromString(input)
+		assert.Nil(t, err)
+		forms[i] = expr
+	}
+	c.InlineGlobals(forms)
+	codes := make([]Code, len(forms))
+	for i, form := range forms {
+		code, err := c.Compile(form)
+		assert.Nil(t, err)
+		codes[i] = code
+	}
+	return codes
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Code
+	}{
+		{
+			"((lambda (x) (+ x 1)) 2)",
+			Code{
+				{LDC, []Operand{2}},
+				{ENTER, []Operand{1}},
+				{LD, []Operand{&Location{0, 0}}},
+				{LDC, []Operand{1}},
+				{ADD, nil},
+				{EXIT, nil},
+			},
+		},
+		{
+			"((lambda (x) x) 1 2)",
+			Code{
+				{LDC, []Operand{1}},
+				{LDC, []Operand{2}},
+				{LDF, []Operand{
+					Code{
+						{LD, []Operand{&Location{0, 0}}},
+						{RTN, nil},
+					},
+					&LambdaInfo{arity: 1},
+				}},
+				{AP, []Operand{2}},
+			},
+		},
+		{
+			"(lambda (x) ((lambda (y) (cons x y)) 1))",
+			Code{
+				{LDF, []Operand{
+					Code{
+						{LDC, []Operand{1}},
+						{ENTER, []Operand{1}},
+						{LD, []Operand{&Location{1, 0}}},
+						{LD, []Operand{&Location{0, 0}}},
+						{CONS, nil},
+						{EXIT, nil},
+						{RTN, nil},
+					},
+					&LambdaInfo{arity: 1},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			c := NewCompiler()
+			c.SetOptimize(true)
+			codes := compileForms(t, c, []string{tt.in})
+			assert.Equal(t, tt.out, codes[0])
+		})
+	}
+}
+
+func TestInlineGlobals(t *testing.T) {
+	inlined := Code{
+		{LDC, []Operand{2}},
+		{ENTER, []Operand{1}},
+		{LD, []Operand{&Location{0, 0}}},
+		{LDC, []Operand{1}},
+		{ADD, nil},
+		{EXIT, nil},
+	}
+	called := Code{
+		{LDC, []Operand{2}},
+		{LDG, []Operand{Intern("inl-inc")}},
+		{AP, []Operand{1}},
+	}
+	tests := []struct {
+		forms []string
+		out   Code
+	}{
+		{[]string{"(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)"}, inlined},
+		{[]string{"(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)", "(set! inl-inc car)"}, called},
+		{[]string{"(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)", "(define inl-inc car)"}, called},
+		{[]string{"(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)", "(lambda () (set! inl-inc car))"}, called},
+		{[]string{"(if t (define inl-inc (lambda (x) (+ x 1))) nil)", "(inl-inc 2)"}, called},
+		{[]string{"(define inl-inc (lambda (x) (begin 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 x)))", "(inl-inc 2)"}, called},
+		{[]string{"(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)", "(define-syntax inl-assign (syntax-rules () ((_ n v) (set! n v))))"}, called},
+	}
+	for _, tt := range tests {
+		codes := compileForms(t, NewCompiler(), tt.forms)
+		assert.Equal(t, tt.out, codes[1], tt.forms)
+	}
+
+	// calls before the definition are not inlined
+	codes := compileForms(t, NewCompiler(), []string{"(inl-inc 2)", "(define inl-inc (lambda (x) (+ x 1)))", "(inl-inc 2)"})
+	assert.Equal(t, called, codes[0])
+	assert.Equal(t, inlined, codes[2])
+
+	// forgets the functions defined in the previous forms
+	c := NewCompiler()
+	compileForms(t, c, []string{"(define inl-inc (lambda (x) (+ x 1)))"})
+	codes = compileForms(t, c, []string{"(inl-inc 2)"})
+	assert.Equal(t, called, codes[0])
+}
+
+func TestInlineDifferential(t *testing.T) {
+	var programs []string
+	programs = append(programs, differentialPrograms...)
+	programs = append(programs, enginePrograms...)
+	programs = append(programs, flatClosurePrograms...)
+	for _, input := range programs {
+		t.Run(input, func(t *testing.T) {
+			expected, _ := evalWith(SECDEngine, input)
+			for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+				for _, flat := range []bool{false, true} {
+					in := NewInterpreter()
+					in.SetEngine(engine)
+					in.Compiler().SetOptimize(true)
+					in.Compiler().SetFlatClosures(flat)
+					actual, _ := evalIn(in, input)
+					assert.Equal(t, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineGlobalsEval(t *testing.T) {
+	inputs := []string{
+		"(define inl-sq (lambda (x) (* x x)))",
+		"(define inl-sum-sq (lambda (x y) (+ (inl-sq x) (inl-sq y))))",
+		"(inl-sum-sq 3 4)",
+	}
+	forms := make([]Object, len(inputs))
+	for i, input := range inputs {
+		expr, err := ReadFromString(input)
+		assert.Nil(t, err)
+		forms[i] = expr
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		in.Compiler().InlineGlobals(forms)
+		var v Object
+		for _, form := range forms {
+			var err error
+			v, err = in.Eval(form)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 25, v)
+	}
+
+	// macros can expand into assignments
+	inputs = []string{
+		"(define-syntax inl-assign (syntax-rules () ((_ n v) (set! n v))))",
+		"(define inl-g (lambda () 1))",
+		"(define inl-call-g (lambda () (inl-g)))",
+		"(inl-assign inl-g (lambda () 2))",
+		"(cons (inl-g) (inl-call-g))",
+	}
+	forms = make([]Object, len(inputs))
+	for i, input := range inputs {
+		expr, err := ReadFromString(input)
+		assert.Nil(t, err)
+		forms[i] = expr
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		in.Compiler().InlineGlobals(forms)
+		var v Object
+		for _, form := range forms {
+			var err error
+			v, err = in.Eval(form)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, "(2 . 2)", ToString(v))
+
+		// the macro is known when the later forms are compiled
+		in.Compiler().InlineGlobals(forms[1:])
+		for _, form := range forms[1:] {
+			var err error
+			v, err = in.Eval(form)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, "(2 . 2)", ToString(v))
+	}
+}
@@ -9,6 +9,7 @@ const (
 	LDG
 	SV
 	SVG
+	DEF
 	POP
 	ATOM
 	NULL
@@ -24,13 +25,22 @@ const (
 	LT
 	GTE
 	LTE
-	SEL
-	JOIN
+	JMP
+	JMPF
 	LDF
 	AP
 	RTN
 	DUM
 	RAP
+	TRY
+	WIND
+	LEAVE
+	CLOS
+	BOX
+	UNBOX
+	SETBOX
+	ENTER
+	EXIT
 )
 
 type Operand interface{}
@@ -0,0 +1,134 @@
+package lisp
+
+import (
+	"io"
+	"io/fs"
+	"sync/atomic"
+)
+
+// Engine selects how an Interpreter runs compiled code.
+type Engine int
+
+const (
+	// SECDEngine runs code instruction by instruction on the VM.
+	SECDEngine Engine = iota
+	// ClosureEngine compiles code into a tree of Go closures first, which
+	// runs faster, but nests at most maxCallDepth calls.
+	ClosureEngine
+)
+
+// Interpreter compiles and runs top-level forms one at a time.
+type Interpreter struct {
+	compiler    *Compiler
+	engine      Engine
+	interrupted *int32
+	fsys        FileSystem
+	profile     Profile
+	// permissions overrides the profile for the primitives named
+	permissions map[string]bool
+	// params are the values of the local parameters set by the
+	// interpreter
+	params map[*Parameter]Object
+	// readtable is what the interpreter reads with, where the reader
+	// macros defined in Lisp go
+	readtable *Readtable
+}
+
+func NewInterpreter() *Interpreter {
+	in := &Interpreter{compiler: NewCompiler(), interrupted: new(int32)}
+	in.compiler.evalLibrary = func(obj Object) error {
+		_, err := in.eval(obj)
+		return err
+	}
+	return in
+}
+
+// Compiler returns the compiler used for the forms, to be configured by
+// the caller.
+func (in *Interpreter) Compiler() *Compiler {
+	return in.compiler
+}
+
+// SetEngine selects the engine to run the following forms with.
+func (in *Interpreter) SetEngine(engine Engine) {
+	in.engine = engine
+}
+
+// SetFileSystem sets the file system that the file primitives access. They
+// fail if there is none, as there is by default.
+func (in *Interpreter) SetFileSystem(fsys FileSystem) {
+	in.fsys = fsys
+}
+
+func (in *Interpreter) setParameter(p *Parameter, v Object) {
+	if in.params == nil {
+		in.params = map[*Parameter]Object{}
+	}
+	in.params[p] = v
+}
+
+// SetLibraryPath sets the file systems searched in order for the files of
+// the libraries imported, which are evaluated when they are imported. See
+// Compiler.SetLibraryPath.
+func (in *Interpreter) SetLibraryPath(path ...fs.FS) {
+	in.compiler.SetLibraryPath(path...)
+}
+
+// Readtable returns the readtable of the readers that the interpreter and
+// its read primitive use, initially a copy of the standard one. The reader
+// macros defined in Lisp are set in it.
+func (in *Interpreter) Readtable() *Readtable {
+	if in.readtable == nil {
+		in.readtable = StandardReadtable()
+	}
+	return in.readtable
+}
+
+// NewReader returns a reader of r that reads with the readtable of the
+// interpreter.
+func (in *Interpreter) NewReader(r io.Reader) *Reader {
+	rd := NewReader(r)
+	rd.SetReadtable(in.Readtable())
+	return rd
+}
+
+// Apply calls fn with args in the interpreter, under its permissions and
+// parameters, as the forms it evaluates would.
+func (in *Interpreter) Apply(fn Object, args []Object) (Object, error) {
+	vm := NewVM(nil)
+	vm.interrupted = in.interrupted
+	vm.interpreter = in
+	return vm.apply(fn, args)
+}
+
+// Interrupt aborts the evaluation in progress. It is safe to call from
+// another goroutine.
+func (in *Interpreter) Interrupt() {
+	atomic.StoreInt32(in.interrupted, 1)
+}
+
+// Eval compiles expr and runs it with the selected engine.
+func (in *Interpreter) Eval(expr Object) (Object, error) {
+	atomic.StoreInt32(in.interrupted, 0)
+	return in.eval(expr)
+}
+
+func (in *Interpreter) eval(expr Object) (Object, error) {
+	code, err := in.compiler.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if in.engine == ClosureEngine {
+		c, err := compileClosure(code)
+		if err != nil {
+			return nil, err
+		}
+		m := newMachine(in.interrupted)
+		m.vm.interpreter = in
+		return m.run(c)
+	}
+	vm := NewVM(code)
+	vm.interrupted = in.interrupted
+	vm.interpreter = in
+	return vm.Run()
+}
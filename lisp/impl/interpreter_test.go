@@ -0,0 +1,289 @@
+package lisp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var enginePrograms = []string{
+	"((lambda (f) (f (f 3))) (lambda (x) (* x 2)))",
+	"(((lambda (x) (lambda (y) (- x y))) 10) 3)",
+	"((lambda (x) (begin (set! x (+ x 1)) (set! x (* x 2)) x)) 4)",
+	"((lambda (x) (+ x (begin (set! x 10) x))) 1)",
+	"((lambda (x y) (cons y x)) 1 2)",
+	"(begin (define eng-f (lambda (n acc) (if (= n 0) acc (eng-f (- n 1) (cons n acc))))) (eng-f 5 nil))",
+	"(vector-ref #(1 2 3) 1)",
+	"((lambda (v) (begin (vector-set! v 0 'x) v)) #(1 2))",
+	"(car 1)",
+	"(undefined-function 1)",
+	"((lambda (x) x) 1 2)",
+	"(1 2)",
+	"(try (error \"bad\" 1 2) (catch e (error-irritants e)))",
+	"(begin (define eng-g (lambda (x) (car x))) (try (eng-g 1) (catch e (error-message e))))",
+	"(try (try (raise 1) (finally (raise 2))) (catch e e))",
+	"(try 1 (catch e))",
+	"(try (raise 'x) (catch e (raise (cons e e))))",
+	"((lambda (x) (try (raise 1) (finally (car x)))) 1)",
+	"((lambda (f) (try (f 1) (finally (car 2)))) (lambda (x) (cdr x)))",
+	"(begin (define eng-p (make-parameter 1)) (cons (parameterize ((eng-p 2)) (eng-p)) (eng-p)))",
+	"(begin (define eng-q (make-parameter 1)) (try (parameterize ((eng-q 2)) (car (eng-q))) (catch e (eng-q))))",
+	"((lambda (p) (parameterize ((p 2)) (try (car 1) (catch e (p))))) (make-parameter 1 (lambda (x) (* x 10))))",
+	"(parameterize ((1 2)) 3)",
+}
+
+func evalWith(engine Engine, input string) (string, []string) {
+	in := NewInterpreter()
+	in.SetEngine(engine)
+	return evalIn(in, input)
+}
+
+func evalIn(in *Interpreter, input string) (string, []string) {
+	obj, err := ReadFromString(input)
+	if err != nil {
+		return "read error: " + err.Error(), nil
+	}
+	v, err := in.Eval(obj)
+	if err != nil {
+		var lerr *Error
+		if errors.As(err, &lerr) {
+			return "error: " + err.Error(), lerr.Backtrace()
+		}
+		return "error: " + err.Error(), nil
+	}
+	return ToString(v), nil
+}
+
+func TestEngines(t *testing.T) {
+	programs := append(append([]string(nil), differentialPrograms...), enginePrograms...)
+	for _, in := range programs {
+		t.Run(in, func(t *testing.T) {
+			expected, expectedTrace := evalWith(SECDEngine, in)
+			actual, actualTrace := evalWith(ClosureEngine, in)
+			assert.Equal(t, expected, actual)
+			assert.Equal(t, expectedTrace, actualTrace)
+		})
+	}
+}
+
+var flatClosurePrograms = []string{
+	"((((lambda (x) (lambda (y) (lambda (z) (cons x (cons y z))))) 1) 2) 3)",
+	"((lambda (n) ((lambda (inc) (begin (inc) (inc) n)) (lambda () (set! n (+ n 1))))) 0)",
+	"((lambda (n) ((lambda (get) (begin (set! n 5) (get))) (lambda () n))) 0)",
+	"((lambda (x) ((lambda (f) (begin (f) x)) (lambda () ((lambda () (set! x (cons x x))))))) 1)",
+	"((lambda (x x) x) 1 2)",
+	"((lambda (x) ((lambda (x) (set! x 2)) 3)) 1)",
+	"((lambda (x) (try (raise 1) (catch e ((lambda () (begin (set! e (+ e x)) e)))))) 10)",
+	"((lambda (x) (try (try (car 1) (finally (set! x 2))) (catch e x))) 1)",
+	"((lambda (x) (try 1 (finally ((lambda () (set! x 2)))))) 1)",
+	"((lambda (a b) ((lambda (f) (f f 3)) (lambda (self n) (if (= n 0) (cons a b) (self self (- n 1)))))) 1 2)",
+}
+
+func TestFlatClosures(t *testing.T) {
+	var programs []string
+	programs = append(programs, differentialPrograms...)
+	programs = append(programs, enginePrograms...)
+	programs = append(programs, flatClosurePrograms...)
+	for _, input := range programs {
+		t.Run(input, func(t *testing.T) {
+			expected, expectedTrace := evalWith(SECDEngine, input)
+			for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+				in := NewInterpreter()
+				in.SetEngine(engine)
+				in.Compiler().SetFlatClosures(true)
+				actual, actualTrace := evalIn(in, input)
+				assert.Equal(t, expected, actual)
+				assert.Equal(t, expectedTrace, actualTrace)
+			}
+		})
+	}
+}
+
+func TestClosureEngineStackOverflow(t *testing.T) {
+	out, _ := evalWith(ClosureEngine, "(begin (define eng-loop (lambda () (+ 1 (eng-loop)))) (eng-loop))")
+	assert.Equal(t, "error: stack overflow", out)
+}
+
+func TestClosureEngineInterrupt(t *testing.T) {
+	obj, err := ReadFromString(`
+(begin
+  (define eng-fib (lambda (n) (if (< n 2) n (+ (eng-fib (- n 1)) (eng-fib (- n 2))))))
+  (eng-fib 100))`)
+	assert.Nil(t, err)
+	in := NewInterpreter()
+	in.SetEngine(ClosureEngine)
+	time.AfterFunc(10*time.Millisecond, in.Interrupt)
+	v, err := in.Eval(obj)
+	assert.Nil(t, v)
+	assert.True(t, errors.Is(err, ErrInterrupted))
+	var lerr *Error
+	assert.True(t, errors.As(err, &lerr))
+	assert.Equal(t, "#<func eng-fib/1>", lerr.Backtrace()[0])
+}
+
+var benchmarkPrograms = []struct {
+	name string
+	def  string
+	expr string
+}{
+	{
+		"fib",
+		`(define bench-fib
+		   (lambda (n)
+		     (if (< n 2) n (+ (bench-fib (- n 1)) (bench-fib (- n 2))))))`,
+		"(bench-fib 20)",
+	},
+	{
+		"tak",
+		`(define bench-tak
+		   (lambda (x y z)
+		     (if (< y x)
+		         (bench-tak (bench-tak (- x 1) y z)
+		                    (bench-tak (- y 1) z x)
+		                    (bench-tak (- z 1) x y))
+		         z)))`,
+		"(bench-tak 18 12 6)",
+	},
+	{
+		"lists",
+		`(define bench-iota
+		   (lambda (n acc) (if (= n 0) acc (bench-iota (- n 1) (cons n acc)))))`,
+		`(begin
+		   (define bench-sum
+		     (lambda (xs) (if (null xs) 0 (+ (car xs) (bench-sum (cdr xs))))))
+		   (bench-sum (bench-iota 1000 nil)))`,
+	},
+	{
+		"closures",
+		`(define bench-compose
+		   (lambda (f g) (lambda (x) (f (g x)))))`,
+		`((lambda (inc)
+		    ((lambda (f) ((lambda (g) (g (g (g 0)))) (bench-compose f f)))
+		     (bench-compose inc inc)))
+		  (lambda (x) (+ x 1)))`,
+	},
+}
+
+func BenchmarkEngines(b *testing.B) {
+	engines := []struct {
+		name   string
+		engine Engine
+	}{
+		{"secd", SECDEngine},
+		{"closure", ClosureEngine},
+	}
+	for _, p := range benchmarkPrograms {
+		for _, e := range engines {
+			b.Run(p.name+"/"+e.name, func(b *testing.B) {
+				in := NewInterpreter()
+				in.SetEngine(e.engine)
+				def, err := ReadFromString(p.def)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := in.Eval(def); err != nil {
+					b.Fatal(err)
+				}
+				expr, err := ReadFromString(p.expr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				code, err := in.Compiler().Compile(expr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				c, err := compileClosure(code)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if e.engine == ClosureEngine {
+						_, err = newMachine(new(int32)).run(c)
+					} else {
+						_, err = NewVM(code).Run()
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+var closureBenchmarkPrograms = []struct {
+	name string
+	def  string
+	expr string
+}{
+	{
+		"nested",
+		`(define bench-nested
+		   (lambda (a)
+		     ((lambda (b)
+		        ((lambda (c)
+		           ((lambda (d)
+		              (lambda (n acc) (if (= n 0) acc (bench-loop (- n 1) (+ acc (+ a d))))))
+		            (+ c 1)))
+		         (+ b 1)))
+		      (+ a 1))))`,
+		"(begin (define bench-loop (bench-nested 1)) (bench-loop 1000 0))",
+	},
+	{
+		"counter",
+		`(define bench-counter
+		   (lambda (n) (lambda () (set! n (+ n 1)))))`,
+		`((lambda (next)
+		    (begin
+		      (define bench-count
+		        (lambda (i) (if (= i 0) (next) (begin (next) (bench-count (- i 1))))))
+		      (bench-count 1000)))
+		  (bench-counter 0))`,
+	},
+}
+
+func BenchmarkClosureRepresentations(b *testing.B) {
+	programs := append(closureBenchmarkPrograms, benchmarkPrograms[3])
+	for _, p := range programs {
+		for _, flat := range []bool{false, true} {
+			for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+				name := p.name + "/linked"
+				if flat {
+					name = p.name + "/flat"
+				}
+				if engine == ClosureEngine {
+					name += "/closure"
+				} else {
+					name += "/secd"
+				}
+				b.Run(name, func(b *testing.B) {
+					in := NewInterpreter()
+					in.SetEngine(engine)
+					in.Compiler().SetFlatClosures(flat)
+					def, err := ReadFromString(p.def)
+					if err != nil {
+						b.Fatal(err)
+					}
+					expr, err := ReadFromString(p.expr)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := in.Eval(def); err != nil {
+						b.Fatal(err)
+					}
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if _, err := in.Eval(expr); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package lisp
+
+// Node is a node of the intermediate representation that the compiler
+// expands s-expressions into. Code is generated from the nodes rather than
+// from the s-expressions, so analyses and transformations can work on a
+// program whose syntax has been checked and whose variables have been
+// resolved.
+type Node interface {
+	node()
+}
+
+// Var is a parameter of a lambda expression.
+type Var struct {
+	name string
+	// level is the nesting level of the lambda expression binding the
+	// variable, and index is the position of the variable in its frame
+	level, index int
+}
+
+// Const is a constant, including quoted data.
+type Const struct {
+	value Object
+}
+
+// LocalRef refers to a local variable bound depth lambda expressions out
+// from the reference.
+type LocalRef struct {
+	v     *Var
+	depth int
+}
+
+// GlobalRef refers to a global variable.
+type GlobalRef struct {
+	sym *Symbol
+}
+
+// If is a conditional expression.
+type If struct {
+	test, then, els Node
+}
+
+// Lambda creates a function.
+type Lambda struct {
+	params []*Var
+	body   Node
+	info   *LambdaInfo
+}
+
+// App applies a function to arguments.
+type App struct {
+	fn   Node
+	args []Node
+}
+
+// PrimApp applies an operator the VM implements as an instruction, such
+// as ADD or CAR, to arguments.
+type PrimApp struct {
+	op   Op
+	args []Node
+}
+
+// Set assigns a value to a variable, which is local if local is non-nil.
+// For globals, define tells whether the variable may be created.
+type Set struct {
+	local  *Var
+	depth  int
+	global *Symbol
+	define bool
+	value  Node
+}
+
+// Seq evaluates expressions in order for the value of the last one.
+type Seq struct {
+	exprs []Node
+}
+
+// Let binds params to the values of args while evaluating body, as the
+// application of a lambda expression does, but without creating a function.
+type Let struct {
+	params []*Var
+	args   []Node
+	body   Node
+}
+
+// Try evaluates body, calling handler with the error object if an error
+// occurs in body. The cleanup is evaluated after body completes, or by
+// calling the finally thunk when an error unwinds through it. Either
+// handler or finally may be nil.
+type Try struct {
+	body    Node
+	handler *Lambda
+	finally *Lambda
+	cleanup Node
+}
+
+func (*Const) node()     {}
+func (*LocalRef) node()  {}
+func (*GlobalRef) node() {}
+func (*If) node()        {}
+func (*Lambda) node()    {}
+func (*App) node()       {}
+func (*PrimApp) node()   {}
+func (*Set) node()       {}
+func (*Seq) node()       {}
+func (*Let) node()       {}
+func (*Try) node()       {}
@@ -0,0 +1,72 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpand(t *testing.T) {
+	x := &Var{"x", 1, 0}
+	y := &Var{"y", 2, 0}
+	tests := []struct {
+		in  string
+		out Node
+	}{
+		{"42", &Const{42}},
+		{"'(1 2)", &Const{&Cons{1, &Cons{2, nil}}}},
+		{"foo", &GlobalRef{Intern("foo")}},
+		{"(+ 1 2)", &PrimApp{ADD, []Node{&Const{1}, &Const{2}}}},
+		{"(begin 1 2)", &Seq{[]Node{&Const{1}, &Const{2}}}},
+		{"(if p 1 2)", &If{&GlobalRef{Intern("p")}, &Const{1}, &Const{2}}},
+		{"(f 1)", &App{&GlobalRef{Intern("f")}, []Node{&Const{1}}}},
+		{"(define foo 1)", &Set{global: Intern("foo"), define: true, value: &Const{1}}},
+		{"(set! foo 1)", &Set{global: Intern("foo"), value: &Const{1}}},
+		{
+			"(lambda (x) (lambda (y) (set! x y)))",
+			&Lambda{[]*Var{x}, &Lambda{
+				[]*Var{y},
+				&Set{local: x, depth: 1, value: &LocalRef{y, 0}},
+				&LambdaInfo{arity: 1},
+			}, &LambdaInfo{arity: 1}},
+		},
+		{
+			"(define id (lambda (x) x))",
+			&Set{global: Intern("id"), define: true, value: &Lambda{
+				[]*Var{x}, &LocalRef{x, 0}, &LambdaInfo{name: "id", arity: 1},
+			}},
+		},
+		{
+			"(try 1 (catch x x) (finally 2))",
+			&Try{
+				body:    &Const{1},
+				handler: &Lambda{[]*Var{x}, &LocalRef{x, 0}, &LambdaInfo{name: "catch", arity: 1}},
+				finally: &Lambda{[]*Var{}, &Const{2}, &LambdaInfo{name: "finally"}},
+				cleanup: &Const{2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		expr, err := ReadFromString(tt.in)
+		assert.Nil(t, err)
+		node, err := NewCompiler().Expand(expr)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.out, node, tt.in)
+	}
+}
+
+func TestAnalyzeClosures(t *testing.T) {
+	expr, err := ReadFromString("(lambda (x y z) (lambda (w) (lambda () (begin (set! y w) (+ x y)))))")
+	assert.Nil(t, err)
+	node, err := NewCompiler().Expand(expr)
+	assert.Nil(t, err)
+	outer := node.(*Lambda)
+	middle := outer.body.(*Lambda)
+	inner := middle.body.(*Lambda)
+	x, y, w := outer.params[0], outer.params[1], middle.params[0]
+	info := analyzeClosures(node)
+	assert.Empty(t, info.free[outer])
+	assert.Equal(t, []*Var{y, x}, info.free[middle])
+	assert.Equal(t, []*Var{y, w, x}, info.free[inner])
+	assert.Equal(t, map[*Var]bool{y: true}, info.boxed)
+}
@@ -0,0 +1,362 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Macro is a macro defined by syntax-rules. Expanding it rewrites a form
+// with the template of the first rule whose pattern matches the form.
+//
+// Expansions are hygienic: the symbols a template introduces are renamed
+// into fresh uninterned symbols, so that the variables the expansion binds
+// never capture those of the user, and the free ones still refer to the
+// global variables or special forms they stand for in the template.
+type Macro struct {
+	name     *Symbol
+	literals []*Symbol
+	rules    []syntaxRule
+}
+
+type syntaxRule struct {
+	pattern  Object
+	template Object
+}
+
+var (
+	ellipsis   = Intern("...")
+	underscore = Intern("_")
+)
+
+// parseSyntaxRules parses (syntax-rules (literal...) (pattern template)...)
+// into a macro named name.
+func parseSyntaxRules(name *Symbol, spec Object) (*Macro, error) {
+	clause, ok := clauseOf(spec, "syntax-rules")
+	if !ok {
+		return nil, errors.New("define-syntax needs syntax-rules")
+	}
+	args, err := properList(clause.cdr)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("syntax-rules needs a list of literals")
+	}
+	lits, err := properList(args[0])
+	if err != nil {
+		return nil, errors.New("syntax-rules needs a list of literals")
+	}
+	m := &Macro{name: name}
+	for _, lit := range lits {
+		sym, ok := lit.(*Symbol)
+		if !ok {
+			return nil, errors.New("literal of syntax-rules must be a symbol")
+		}
+		m.literals = append(m.literals, sym)
+	}
+	for _, arg := range args[1:] {
+		rule, err := takeArgs(2, arg)
+		if err != nil {
+			return nil, errors.New("syntax rule must be a list of a pattern and a template")
+		}
+		pattern, ok := rule[0].(*Cons)
+		if !ok {
+			return nil, errors.New("pattern of syntax rule must be a list")
+		}
+		if err := checkEllipses(pattern.cdr); err != nil {
+			return nil, err
+		}
+		// the keyword at the head of the pattern is ignored
+		m.rules = append(m.rules, syntaxRule{pattern.cdr, rule[1]})
+	}
+	return m, nil
+}
+
+// checkEllipses checks that every ellipsis in pattern follows a
+// subpattern, and that no list has more than one.
+func checkEllipses(pattern Object) error {
+	if pattern == ellipsis {
+		return errors.New("misplaced ellipsis in syntax rule pattern")
+	}
+	seen := false
+	for {
+		c, ok := pattern.(*Cons)
+		if !ok {
+			if pattern == ellipsis {
+				return errors.New("misplaced ellipsis in syntax rule pattern")
+			}
+			return nil
+		}
+		if err := checkEllipses(c.car); err != nil {
+			return err
+		}
+		if next, ok := c.cdr.(*Cons); ok && next.car == ellipsis {
+			if seen {
+				return errors.New("more than one ellipsis in a list of syntax rule pattern")
+			}
+			seen = true
+			c = next
+		}
+		pattern = c.cdr
+	}
+}
+
+// match is what a pattern variable matched: a form, or for a variable
+// under an ellipsis, the matches from each repetition.
+type match struct {
+	form     Object
+	repeated bool
+	reps     []*match
+}
+
+type bindings map[*Symbol]*match
+
+func (m *Macro) isLiteral(sym *Symbol) bool {
+	for _, lit := range m.literals {
+		if lit == sym {
+			return true
+		}
+	}
+	return false
+}
+
+// patternVars returns the pattern variables in pattern.
+func (m *Macro) patternVars(pattern Object) []*Symbol {
+	switch p := pattern.(type) {
+	case *Symbol:
+		if p == ellipsis || p == underscore || m.isLiteral(p) {
+			return nil
+		}
+		return []*Symbol{p}
+	case *Cons:
+		return append(m.patternVars(p.car), m.patternVars(p.cdr)...)
+	default:
+		return nil
+	}
+}
+
+func (m *Macro) match(pattern, form Object, b bindings) bool {
+	switch p := pattern.(type) {
+	case *Symbol:
+		if p == underscore {
+			return true
+		}
+		if m.isLiteral(p) {
+			sym, ok := form.(*Symbol)
+			return ok && sym.original() == p.original()
+		}
+		b[p] = &match{form: form}
+		return true
+	case *Cons:
+		return m.matchList(p, form, b)
+	default:
+		return pattern == form
+	}
+}
+
+func (m *Macro) matchList(pattern *Cons, form Object, b bindings) bool {
+	var p Object = pattern
+	for {
+		pc, ok := p.(*Cons)
+		if !ok {
+			return m.match(p, form, b)
+		}
+		if next, ok := pc.cdr.(*Cons); ok && next.car == ellipsis {
+			// the subpattern repeats for the forms other than the ones
+			// matching the patterns after the ellipsis
+			var items []Object
+			for rest := form; ; {
+				c, ok := rest.(*Cons)
+				if !ok {
+					break
+				}
+				items = append(items, c.car)
+				rest = c.cdr
+			}
+			n := len(items) - listLength(next.cdr)
+			if n < 0 {
+				return false
+			}
+			var reps []bindings
+			for _, item := range items[:n] {
+				rb := bindings{}
+				if !m.match(pc.car, item, rb) {
+					return false
+				}
+				reps = append(reps, rb)
+			}
+			for _, v := range m.patternVars(pc.car) {
+				mt := &match{repeated: true}
+				for _, rb := range reps {
+					mt.reps = append(mt.reps, rb[v])
+				}
+				b[v] = mt
+			}
+			for i := 0; i < n; i++ {
+				form = form.(*Cons).cdr
+			}
+			p = next.cdr
+			continue
+		}
+		fc, ok := form.(*Cons)
+		if !ok || !m.match(pc.car, fc.car, b) {
+			return false
+		}
+		p, form = pc.cdr, fc.cdr
+	}
+}
+
+// listLength counts the conses of a possibly improper list.
+func listLength(obj Object) int {
+	n := 0
+	for c, ok := obj.(*Cons); ok; c, ok = c.cdr.(*Cons) {
+		n++
+	}
+	return n
+}
+
+// Expand rewrites form, a use of the macro, with the first matching rule.
+func (m *Macro) Expand(form *Cons) (Object, error) {
+	for _, rule := range m.rules {
+		b := bindings{}
+		if m.match(rule.pattern, form.cdr, b) {
+			e := &expansion{renames: map[*Symbol]*Symbol{}}
+			return e.expand(rule.template, b)
+		}
+	}
+	return nil, fmt.Errorf("no syntax rule of %s matches %s", m.name.name, ToString(form))
+}
+
+type expansion struct {
+	// renames maps the symbols in the template to the ones renamed into
+	renames map[*Symbol]*Symbol
+}
+
+func (e *expansion) rename(sym *Symbol) *Symbol {
+	r, ok := e.renames[sym]
+	if !ok {
+		r = &Symbol{name: sym.name, alias: sym}
+		e.renames[sym] = r
+	}
+	return r
+}
+
+func (e *expansion) expand(tmpl Object, b bindings) (Object, error) {
+	switch t := tmpl.(type) {
+	case *Symbol:
+		if mt, ok := b[t]; ok {
+			if mt.repeated {
+				return nil, fmt.Errorf("pattern variable %s is used without ellipsis", t.name)
+			}
+			return mt.form, nil
+		}
+		return e.rename(t), nil
+	case *Cons:
+		var items []Object
+		for {
+			c, ok := tmpl.(*Cons)
+			if !ok {
+				break
+			}
+			if next, ok := c.cdr.(*Cons); ok && next.car == ellipsis {
+				forms, err := e.expandRepeated(c.car, b)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, forms...)
+				tmpl = next.cdr
+				continue
+			}
+			v, err := e.expand(c.car, b)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			tmpl = c.cdr
+		}
+		tail, err := e.expand(tmpl, b)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(items) - 1; i >= 0; i-- {
+			tail = &Cons{items[i], tail}
+		}
+		return tail, nil
+	default:
+		return tmpl, nil
+	}
+}
+
+// expandRepeated expands tmpl followed by an ellipsis once for each
+// repetition the pattern variables in it matched.
+func (e *expansion) expandRepeated(tmpl Object, b bindings) ([]Object, error) {
+	var vars []*Symbol
+	n := -1
+	for _, v := range templateVars(tmpl, b) {
+		mt := b[v]
+		if !mt.repeated {
+			continue
+		}
+		if n >= 0 && len(mt.reps) != n {
+			return nil, errors.New("pattern variables under the same ellipsis matched different numbers of forms")
+		}
+		vars = append(vars, v)
+		n = len(mt.reps)
+	}
+	if len(vars) == 0 {
+		return nil, fmt.Errorf("no pattern variable to repeat in %s", ToString(tmpl))
+	}
+	forms := make([]Object, n)
+	for i := range forms {
+		rb := bindings{}
+		for v, mt := range b {
+			rb[v] = mt
+		}
+		for _, v := range vars {
+			rb[v] = b[v].reps[i]
+		}
+		form, err := e.expand(tmpl, rb)
+		if err != nil {
+			return nil, err
+		}
+		forms[i] = form
+	}
+	return forms, nil
+}
+
+// templateVars returns the pattern variables bound in b that tmpl uses.
+func templateVars(tmpl Object, b bindings) []*Symbol {
+	switch t := tmpl.(type) {
+	case *Symbol:
+		if _, ok := b[t]; ok {
+			return []*Symbol{t}
+		}
+		return nil
+	case *Cons:
+		return append(templateVars(t.car, b), templateVars(t.cdr, b)...)
+	default:
+		return nil
+	}
+}
+
+// stripRenames returns obj with the symbols renamed by macro expansions
+// replaced by the original ones, as quoted data must be. Conses already
+// visited are left as they are, which keeps circular data intact.
+func stripRenames(obj Object, visited map[*Cons]bool) Object {
+	switch o := obj.(type) {
+	case *Symbol:
+		return o.original()
+	case *Cons:
+		if visited[o] {
+			return o
+		}
+		visited[o] = true
+		car, cdr := stripRenames(o.car, visited), stripRenames(o.cdr, visited)
+		if car == o.car && cdr == o.cdr {
+			return o
+		}
+		return &Cons{car, cdr}
+	default:
+		return obj
+	}
+}
@@ -0,0 +1,130 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMacros = `
+(begin
+  (define-syntax mac-swap!
+    (syntax-rules ()
+      ((_ a b) ((lambda (tmp) (begin (set! a b) (set! b tmp))) a))))
+  (define-syntax mac-or
+    (syntax-rules ()
+      ((_) nil)
+      ((_ e) e)
+      ((_ e r ...) ((lambda (v) (if v v (mac-or r ...))) e))))
+  (define-syntax mac-cond
+    (syntax-rules (else)
+      ((_ (else e)) e)
+      ((_ (c e) clause ...) (if c e (mac-cond clause ...)))))
+  (define-syntax mac-let
+    (syntax-rules ()
+      ((_ ((name value) ...) body ...) ((lambda (name ...) (begin body ...)) value ...))))
+  (define mac-id (lambda (x) x))
+  (define-syntax mac-call-id
+    (syntax-rules ()
+      ((_ x) (mac-id x))))
+  (define-syntax mac-quote-tmp
+    (syntax-rules ()
+      ((_) '(tmp . tmp))))
+  (define-syntax mac-rest
+    (syntax-rules ()
+      ((_ a . r) 'r)))
+  (define-syntax mac-loop
+    (syntax-rules ()
+      ((_) (mac-loop))))
+  (define-syntax mac-bad-repeat
+    (syntax-rules ()
+      ((_ a) (a ...))))
+  (define-syntax mac-bad-flat
+    (syntax-rules ()
+      ((_ a ...) a))))`
+
+func TestMacros(t *testing.T) {
+	in := NewInterpreter()
+	out, _ := evalIn(in, testMacros)
+	assert.Equal(t, "mac-bad-flat", out)
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"((lambda (x y) (begin (mac-swap! x y) (cons x y))) 1 2)", "(2 . 1)"},
+		{"((lambda (tmp other) (begin (mac-swap! tmp other) (cons tmp other))) 1 2)", "(2 . 1)"},
+		{"(mac-or)", "nil"},
+		{"(mac-or nil 2 3)", "2"},
+		{"((lambda (v) (mac-or nil v)) 5)", "5"},
+		{"(mac-cond ((= 1 2) 'a) ((= 1 1) 'b) (else 'c))", "b"},
+		{"(mac-cond ((= 1 2) 'a) (else 'c))", "c"},
+		{"(mac-let ((x 1) (y 2)) (set! x 10) (+ x y))", "12"},
+		{"((lambda (mac-id) (mac-call-id 3)) vector)", "3"},
+		{"((lambda (mac-swap!) (mac-swap! 1)) mac-id)", "1"},
+		{"(mac-quote-tmp)", "(tmp . tmp)"},
+		{"(eq? (car (mac-quote-tmp)) 'tmp)", "t"},
+		{"(mac-rest 1 2 3)", "(2 3)"},
+		{"(mac-cond)", "error: no syntax rule of mac-cond matches (mac-cond)"},
+		{"(mac-loop)", "error: macro expansion of mac-loop is nested too deeply"},
+		{"(mac-bad-repeat 1)", "error: no pattern variable to repeat in a"},
+		{"(mac-bad-flat 1 2)", "error: pattern variable a is used without ellipsis"},
+		{"(define-syntax mac-x 1)", "error: define-syntax needs syntax-rules"},
+		{"(define-syntax mac-x (syntax-rules () ((_ ...) 1)))", "error: misplaced ellipsis in syntax rule pattern"},
+		{"(define-syntax mac-x (syntax-rules () ((_ a ... b ...) 1)))", "error: more than one ellipsis in a list of syntax rule pattern"},
+		{"(lambda () (define-syntax mac-x (syntax-rules ())))", "error: define-syntax must be at the top level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+}
+
+// macroPrograms are run after testMacros to test Eval and the engines
+// against each other on macros.
+var macroPrograms = []string{
+	"((lambda (x y) (begin (mac-swap! x y) (cons x y))) 1 2)",
+	"((lambda (tmp other) (begin (mac-swap! tmp other) (cons tmp other))) 1 2)",
+	"((lambda (v) (mac-or nil v)) 5)",
+	"(mac-cond ((= 1 2) 'a) (else 'c))",
+	"(mac-let ((x 1) (y 2)) (set! x 10) (+ x y))",
+	"(mac-let ((if 1)) if)",
+	"((lambda (mac-id) (mac-call-id 3)) vector)",
+	"((lambda (mac-swap!) (mac-swap! 1)) mac-id)",
+	"(eq? (car (mac-quote-tmp)) 'tmp)",
+	"(mac-rest 1 2 3)",
+	"(mac-or nil (car 1))",
+	"(mac-cond)",
+	"(mac-loop)",
+	"(mac-bad-flat 1 2)",
+	"(lambda () (define-syntax mac-x (syntax-rules ())))",
+	"(try 1 (finally (define-syntax mac-x (syntax-rules ()))))",
+	"(begin (define-syntax mac-def (syntax-rules () ((_ n v) (define n v)))) (mac-def mac-f (lambda (x) x)) mac-f)",
+	"(begin (define-syntax mac-defn (syntax-rules () ((_ n) (define n (lambda () n))))) (mac-defn mac-g) (mac-g))",
+	"(begin (define-syntax mac-fn (syntax-rules () ((_) (lambda (x) x)))) (define mac-h (mac-fn)) (mac-h 1 2))",
+	"(begin (define-syntax mac-try (syntax-rules () ((_ e) (try e (catch err 'caught))))) ((lambda (err) (mac-try (car err))) 1))",
+	"(begin (define-syntax mac-set (syntax-rules () ((_ v) (set! mac-unbound v)))) (mac-set 1))",
+	"(begin (define mac-p (make-parameter 1)) (define-syntax mac-with (syntax-rules () ((_ v e) (parameterize ((mac-p v)) e)))) (mac-with 2 (mac-p)))",
+}
+
+func TestUninternedSymbols(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(eq? (gensym) (gensym))", "nil"},
+		{"(eq? (make-symbol \"a\") 'a)", "nil"},
+		{"(symbol-name (make-symbol \"a\"))", `"a"`},
+		{"((lambda (s) (eq? s s)) (gensym \"tmp\"))", "t"},
+		{"(symbol-name 1)", "error: symbol expected, but got 1"},
+	}
+	for _, tt := range tests {
+		out, _ := evalWith(SECDEngine, tt.in)
+		assert.Equal(t, tt.out, out, tt.in)
+	}
+	sym := Gensym("x")
+	assert.False(t, sym.IsInterned())
+	assert.False(t, Intern(sym.name) == sym)
+	assert.True(t, Intern("x").IsInterned())
+}
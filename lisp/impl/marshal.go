@@ -0,0 +1,545 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Marshal converts a Go value into a Lisp object. Booleans, integers and
+// strings become their Lisp equivalents, slices and arrays become lists,
+// and maps and structs become association lists, whose keys are symbols
+// for string keys and struct fields. A field is keyed by its name unless
+// its "lisp" tag gives another, as in `lisp:"first-name"`; the tag "-"
+// skips the field, and the option omitempty skips it if it is the zero
+// value. Nil pointers, interfaces, slices and maps become nil, and Lisp
+// objects are left as they are. Cyclic values cannot be marshaled.
+func Marshal(v interface{}) (Object, error) {
+	if isLispObject(v) {
+		return v, nil
+	}
+	return marshalValue(reflect.ValueOf(v))
+}
+
+func isLispObject(v interface{}) bool {
+	switch v.(type) {
+	case *Cons, *Symbol, *Vector, *MutableString, *Func, *Primitive, *Parameter,
+		*Condition, *InputPort, *OutputPort, *eofObject:
+		return true
+	default:
+		return false
+	}
+}
+
+// visit is a pointer being followed by a marshaler.
+type visit struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+// marshaler converts Go values into Lisp objects. It keeps track of the
+// pointers, maps and slices it is in the middle of converting, so as to
+// reject cyclic values instead of converting them forever.
+type marshaler struct {
+	visiting map[visit]bool
+}
+
+func marshalValue(v reflect.Value) (Object, error) {
+	m := &marshaler{visiting: map[visit]bool{}}
+	return m.marshal(v)
+}
+
+func (m *marshaler) marshal(v reflect.Value) (Object, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.CanInterface() && isLispObject(v.Interface()) {
+		return v.Interface(), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		key := visit{v.Pointer(), 0, v.Type()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if m.visiting[key] {
+			return nil, fmt.Errorf("cannot marshal cyclic value of type %s", v.Type())
+		}
+		m.visiting[key] = true
+		defer delete(m.visiting, key)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return FromBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Uint()
+		if n > uint64(maxInt) {
+			return nil, fmt.Errorf("cannot marshal %d: out of range of integers", n)
+		}
+		return int(n), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return m.marshal(v.Elem())
+	case reflect.Slice, reflect.Array:
+		elems := make([]Object, v.Len())
+		for i := range elems {
+			elem, err := m.marshal(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return SliceToList(elems), nil
+	case reflect.Map:
+		return m.marshalMap(v)
+	case reflect.Struct:
+		return m.marshalStruct(v)
+	default:
+		return nil, fmt.Errorf("cannot marshal Go value of type %s", v.Type())
+	}
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// marshalMap converts a map into an association list sorted by the keys.
+func (m *marshaler) marshalMap(v reflect.Value) (Object, error) {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	pairs := make([]Object, len(keys))
+	for i, key := range keys {
+		var k Object
+		if key.Kind() == reflect.String {
+			k = Intern(key.String())
+		} else {
+			var err error
+			if k, err = m.marshal(key); err != nil {
+				return nil, err
+			}
+		}
+		val, err := m.marshal(v.MapIndex(key))
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = &Cons{k, val}
+	}
+	return SliceToList(pairs), nil
+}
+
+// field is a struct field marshaled as an entry of association lists.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// fieldsOf returns the fields of the struct type t to be marshaled.
+func fieldsOf(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag := f.Tag.Get("lisp")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, field{name, i, opts == "omitempty"})
+	}
+	return fields
+}
+
+func (m *marshaler) marshalStruct(v reflect.Value) (Object, error) {
+	var pairs []Object
+	for _, f := range fieldsOf(v.Type()) {
+		fv := v.Field(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		val, err := m.marshal(fv)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, &Cons{Intern(f.name), val})
+	}
+	return SliceToList(pairs), nil
+}
+
+// Unmarshal stores the Go value converted from the Lisp object obj in the
+// value that v points to, reversing what Marshal does. In addition, vectors
+// can be unmarshaled into slices and arrays, mutable strings and symbols
+// into strings, and characters into integers. Objects are unmarshaled into
+// empty interfaces as bools, ints, strings, runes, map[string]interface{}
+// for association lists keyed by symbols or strings, []interface{} for the
+// other lists and vectors, [2]interface{} for the pairs that do not make
+// proper lists, and as they are otherwise. The entries of association
+// lists that a struct has no fields for are ignored. Cyclic objects cannot
+// be unmarshaled.
+func Unmarshal(obj Object, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Unmarshal needs a non-nil pointer")
+	}
+	return unmarshalValue(obj, rv.Elem())
+}
+
+func cannotUnmarshal(obj Object, t reflect.Type) error {
+	return fmt.Errorf("cannot unmarshal %s into Go value of type %s", ToString(obj), t)
+}
+
+// unmarshaler converts Lisp objects into Go values. It keeps track of the
+// conses and vectors it is in the middle of converting, so as to reject
+// cyclic objects instead of converting them forever.
+type unmarshaler struct {
+	visiting map[Object]bool
+}
+
+func unmarshalValue(obj Object, v reflect.Value) error {
+	u := &unmarshaler{visiting: map[Object]bool{}}
+	return u.unmarshal(obj, v)
+}
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// enter marks obj as being converted into a value of type t until leave is
+// called, unless it is a cons or a vector already being converted, or a
+// circular list.
+func (u *unmarshaler) enter(obj Object, t reflect.Type) (leave func(), err error) {
+	switch obj.(type) {
+	case *Cons, *Vector:
+	default:
+		return func() {}, nil
+	}
+	if u.visiting[obj] || isCircular(obj) {
+		return nil, fmt.Errorf("cannot unmarshal cyclic value into Go value of type %s", t)
+	}
+	u.visiting[obj] = true
+	return func() { delete(u.visiting, obj) }, nil
+}
+
+// isCircular reports whether following the cdrs of obj leads back to one
+// of them.
+func isCircular(obj Object) bool {
+	slow, ok := obj.(*Cons)
+	if !ok {
+		return false
+	}
+	fast := slow
+	for {
+		for i := 0; i < 2; i++ {
+			if fast, ok = fast.cdr.(*Cons); !ok {
+				return false
+			}
+		}
+		slow = slow.cdr.(*Cons)
+		if fast == slow {
+			return true
+		}
+	}
+}
+
+func (u *unmarshaler) unmarshal(obj Object, v reflect.Value) error {
+	t := v.Type()
+	if obj != nil && reflect.TypeOf(obj).AssignableTo(t) && t.Kind() != reflect.Interface {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		v.SetBool(ToBool(obj))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toInteger(obj)
+		if !ok || v.OverflowInt(int64(n)) {
+			return cannotUnmarshal(obj, t)
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := toInteger(obj)
+		if !ok || n < 0 || v.OverflowUint(uint64(n)) {
+			return cannotUnmarshal(obj, t)
+		}
+		v.SetUint(uint64(n))
+	case reflect.String:
+		switch o := obj.(type) {
+		case string:
+			v.SetString(o)
+		case *MutableString:
+			v.SetString(o.String())
+		case *Symbol:
+			v.SetString(o.name)
+		default:
+			return cannotUnmarshal(obj, t)
+		}
+	case reflect.Ptr:
+		if obj == nil {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		p := reflect.New(t.Elem())
+		if err := u.unmarshal(obj, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return cannotUnmarshal(obj, t)
+		}
+		val, err := u.naturalValue(obj)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(val))
+		}
+	case reflect.Slice:
+		leave, err := u.enter(obj, t)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		elems, ok := sequenceOf(obj)
+		if !ok {
+			return cannotUnmarshal(obj, t)
+		}
+		if obj == nil {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		s := reflect.MakeSlice(t, len(elems), len(elems))
+		for i, elem := range elems {
+			if err := u.unmarshal(elem, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		leave, err := u.enter(obj, t)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		elems, ok := sequenceOf(obj)
+		if !ok || len(elems) != v.Len() {
+			return cannotUnmarshal(obj, t)
+		}
+		for i, elem := range elems {
+			if err := u.unmarshal(elem, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return u.unmarshalMap(obj, v)
+	case reflect.Struct:
+		return u.unmarshalStruct(obj, v)
+	default:
+		return cannotUnmarshal(obj, t)
+	}
+	return nil
+}
+
+func toInteger(obj Object) (int, bool) {
+	switch o := obj.(type) {
+	case int:
+		return o, true
+	case rune:
+		return int(o), true
+	default:
+		return 0, false
+	}
+}
+
+// sequenceOf returns the elements of obj if it is a proper list or a
+// vector.
+func sequenceOf(obj Object) ([]Object, bool) {
+	if vec, ok := obj.(*Vector); ok {
+		return vec.elems, true
+	}
+	elems, tail, err := ListToSlice(obj)
+	return elems, err == nil && tail == nil
+}
+
+func (u *unmarshaler) naturalValue(obj Object) (interface{}, error) {
+	switch o := obj.(type) {
+	case bool:
+		return o, nil
+	case *MutableString:
+		return o.String(), nil
+	case *Symbol:
+		return o.name, nil
+	case *Cons, *Vector:
+		leave, err := u.enter(obj, interfaceType)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		elems, ok := sequenceOf(obj)
+		if !ok {
+			c := obj.(*Cons)
+			car, err := u.naturalValue(c.car)
+			if err != nil {
+				return nil, err
+			}
+			cdr, err := u.naturalValue(c.cdr)
+			if err != nil {
+				return nil, err
+			}
+			return [2]interface{}{car, cdr}, nil
+		}
+		if _, ok := obj.(*Cons); ok && isAssociationList(elems) {
+			return u.naturalMap(elems)
+		}
+		vals := make([]interface{}, len(elems))
+		for i, elem := range elems {
+			val, err := u.naturalValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		return vals, nil
+	default:
+		return obj, nil
+	}
+}
+
+// isAssociationList reports whether elems are the entries of an
+// association list keyed by symbols or strings.
+func isAssociationList(elems []Object) bool {
+	for _, elem := range elems {
+		entry, ok := elem.(*Cons)
+		if !ok {
+			return false
+		}
+		switch entry.car.(type) {
+		case *Symbol, string, *MutableString:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (u *unmarshaler) naturalMap(entries []Object) (interface{}, error) {
+	m := make(map[string]interface{}, len(entries))
+	for _, elem := range entries {
+		entry := elem.(*Cons)
+		key, err := u.naturalValue(entry.car)
+		if err != nil {
+			return nil, err
+		}
+		val, err := u.naturalValue(entry.cdr)
+		if err != nil {
+			return nil, err
+		}
+		m[key.(string)] = val
+	}
+	return m, nil
+}
+
+// entriesOf returns the entries of the association list obj.
+func entriesOf(obj Object, t reflect.Type) ([]*Cons, error) {
+	elems, ok := sequenceOf(obj)
+	if !ok {
+		return nil, cannotUnmarshal(obj, t)
+	}
+	entries := make([]*Cons, len(elems))
+	for i, elem := range elems {
+		entry, ok := elem.(*Cons)
+		if !ok {
+			return nil, cannotUnmarshal(obj, t)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+func (u *unmarshaler) unmarshalMap(obj Object, v reflect.Value) error {
+	t := v.Type()
+	if obj == nil {
+		v.Set(reflect.Zero(t))
+		return nil
+	}
+	leave, err := u.enter(obj, t)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	entries, err := entriesOf(obj, t)
+	if err != nil {
+		return err
+	}
+	m := reflect.MakeMapWithSize(t, len(entries))
+	for _, entry := range entries {
+		key := reflect.New(t.Key()).Elem()
+		if err := u.unmarshal(entry.car, key); err != nil {
+			return err
+		}
+		val := reflect.New(t.Elem()).Elem()
+		if err := u.unmarshal(entry.cdr, val); err != nil {
+			return err
+		}
+		m.SetMapIndex(key, val)
+	}
+	v.Set(m)
+	return nil
+}
+
+func (u *unmarshaler) unmarshalStruct(obj Object, v reflect.Value) error {
+	t := v.Type()
+	leave, err := u.enter(obj, t)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	entries, err := entriesOf(obj, t)
+	if err != nil {
+		return err
+	}
+	fields := map[string]int{}
+	for _, f := range fieldsOf(t) {
+		fields[f.name] = f.index
+	}
+	for _, entry := range entries {
+		var name string
+		switch key := entry.car.(type) {
+		case *Symbol:
+			name = key.name
+		case string:
+			name = key
+		default:
+			return cannotUnmarshal(obj, t)
+		}
+		i, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := u.unmarshal(entry.cdr, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type marshalPoint struct {
+	X, Y int
+}
+
+type marshalPerson struct {
+	Name     string         `lisp:"name"`
+	Age      int            `lisp:"age"`
+	Admin    bool           `lisp:"admin?"`
+	Nickname string         `lisp:"nickname,omitempty"`
+	Tags     []string       `lisp:"tags"`
+	Location *marshalPoint  `lisp:"location"`
+	Extra    map[string]int `lisp:"extra,omitempty"`
+	Secret   string         `lisp:"-"`
+	internal int
+	Notes    map[string]string `lisp:"notes,omitempty"`
+}
+
+func TestMarshal(t *testing.T) {
+	sym := Intern("marshal-sym")
+	tests := []struct {
+		in  interface{}
+		out string
+	}{
+		{nil, "nil"},
+		{true, "t"},
+		{false, "nil"},
+		{42, "42"},
+		{int8(-3), "-3"},
+		{uint16(7), "7"},
+		{"hello", `"hello"`},
+		{[]int{1, 2, 3}, "(1 2 3)"},
+		{[2]string{"a", "b"}, `("a" "b")`},
+		{[]int(nil), "nil"},
+		{[][]int{{1}, {}}, "((1) nil)"},
+		{map[string]int{"b": 2, "a": 1}, "((a . 1) (b . 2))"},
+		{map[int]bool{2: false, 1: true}, "((1 . t) (2))"},
+		{marshalPoint{1, 2}, "((X . 1) (Y . 2))"},
+		{&marshalPoint{3, 4}, "((X . 3) (Y . 4))"},
+		{(*marshalPoint)(nil), "nil"},
+		{
+			marshalPerson{Name: "Alice", Age: 30, Admin: true, Tags: []string{"x"}, Location: &marshalPoint{1, 2}, Secret: "s", internal: 1},
+			`((name . "Alice") (age . 30) (admin? . t) (tags "x") (location (X . 1) (Y . 2)))`,
+		},
+		{marshalPerson{Name: "Bob", Nickname: "bobby", Extra: map[string]int{"k": 1}}, `((name . "Bob") (age . 0) (admin?) (nickname . "bobby") (tags) (location) (extra (k . 1)))`},
+		{[]interface{}{1, "a", sym}, `(1 "a" marshal-sym)`},
+		{sym, "marshal-sym"},
+		{NewVector([]Object{1}), "#(1)"},
+	}
+	for _, tt := range tests {
+		obj, err := Marshal(tt.in)
+		assert.NoError(t, err, tt.out)
+		assert.Equal(t, tt.out, ToString(obj))
+	}
+
+	_, err := Marshal(1.5)
+	assert.EqualError(t, err, "cannot marshal Go value of type float64")
+	_, err = Marshal([]func(){nil})
+	assert.EqualError(t, err, "cannot marshal Go value of type func()")
+	_, err = Marshal(^uint64(0))
+	assert.EqualError(t, err, "cannot marshal 18446744073709551615: out of range of integers")
+
+	type node struct{ Next *node }
+	n := &node{}
+	n.Next = n
+	_, err = Marshal(n)
+	assert.EqualError(t, err, "cannot marshal cyclic value of type *lisp.node")
+	s := []interface{}{1}
+	s[0] = s
+	_, err = Marshal(s)
+	assert.EqualError(t, err, "cannot marshal cyclic value of type []interface {}")
+	m := map[string]interface{}{}
+	m["self"] = m
+	_, err = Marshal(m)
+	assert.EqualError(t, err, "cannot marshal cyclic value of type map[string]interface {}")
+	c := &Cons{1, nil}
+	c.cdr = c
+	var ns []int
+	assert.EqualError(t, Unmarshal(c, &ns), "cannot unmarshal cyclic value into Go value of type []int")
+	var x interface{}
+	assert.EqualError(t, Unmarshal(c, &x), "cannot unmarshal cyclic value into Go value of type interface {}")
+	c = &Cons{nil, nil}
+	c.car = c
+	var nested [][]int
+	assert.EqualError(t, Unmarshal(c, &nested), "cannot unmarshal cyclic value into Go value of type []int")
+	assert.EqualError(t, Unmarshal(c, &x), "cannot unmarshal cyclic value into Go value of type interface {}")
+	vec := NewVector([]Object{nil})
+	vec.elems[0] = vec
+	assert.EqualError(t, Unmarshal(vec, &x), "cannot unmarshal cyclic value into Go value of type interface {}")
+
+	// values shared without cycles are marshaled as many times
+	p := &marshalPoint{1, 2}
+	obj, err := Marshal([]*marshalPoint{p, p})
+	assert.NoError(t, err)
+	assert.Equal(t, "(((X . 1) (Y . 2)) ((X . 1) (Y . 2)))", ToString(obj))
+	shared := &Cons{1, nil}
+	assert.NoError(t, Unmarshal(&Cons{shared, &Cons{shared, nil}}, &nested))
+	assert.Equal(t, [][]int{{1}, {1}}, nested)
+}
+
+func TestUnmarshal(t *testing.T) {
+	read := func(s string) Object {
+		obj, err := ReadFromString(s)
+		assert.NoError(t, err)
+		return obj
+	}
+
+	var n int
+	assert.NoError(t, Unmarshal(read("42"), &n))
+	assert.Equal(t, 42, n)
+	assert.NoError(t, Unmarshal('a', &n))
+	assert.Equal(t, 97, n)
+
+	var b bool
+	assert.NoError(t, Unmarshal(read("t"), &b))
+	assert.True(t, b)
+	assert.NoError(t, Unmarshal(nil, &b))
+	assert.False(t, b)
+
+	var s string
+	assert.NoError(t, Unmarshal(read(`"hi"`), &s))
+	assert.Equal(t, "hi", s)
+	assert.NoError(t, Unmarshal(read("sym"), &s))
+	assert.Equal(t, "sym", s)
+	assert.NoError(t, Unmarshal(NewMutableString("mut"), &s))
+	assert.Equal(t, "mut", s)
+
+	var ns []int
+	assert.NoError(t, Unmarshal(read("(1 2 3)"), &ns))
+	assert.Equal(t, []int{1, 2, 3}, ns)
+	assert.NoError(t, Unmarshal(read("#(4 5)"), &ns))
+	assert.Equal(t, []int{4, 5}, ns)
+	assert.NoError(t, Unmarshal(nil, &ns))
+	assert.Nil(t, ns)
+
+	var arr [2]int
+	assert.NoError(t, Unmarshal(read("(1 2)"), &arr))
+	assert.Equal(t, [2]int{1, 2}, arr)
+
+	var m map[string]int
+	assert.NoError(t, Unmarshal(read(`((a . 1) ("b" . 2))`), &m))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, m)
+
+	var p marshalPerson
+	assert.NoError(t, Unmarshal(read(`((name . "Alice") (age . 30) (admin? . t) (tags "x" "y") (location (X . 1) (Y . 2)) (unknown . 1) (Secret . "s"))`), &p))
+	assert.Equal(t, marshalPerson{Name: "Alice", Age: 30, Admin: true, Tags: []string{"x", "y"}, Location: &marshalPoint{1, 2}}, p)
+
+	var v interface{}
+	assert.NoError(t, Unmarshal(read(`(1 "a" b (t) #\c)`), &v))
+	assert.Equal(t, []interface{}{1, "a", "b", []interface{}{true}, 'c'}, v)
+	assert.NoError(t, Unmarshal(read(`((a . 1) ("b" 2 3) (c (d . #(4))))`), &v))
+	assert.Equal(t, map[string]interface{}{"a": 1, "b": []interface{}{2, 3}, "c": map[string]interface{}{"d": []interface{}{4}}}, v)
+	assert.NoError(t, Unmarshal(read(`((1 . 2) (a . b) . c)`), &v))
+	assert.Equal(t, [2]interface{}{[2]interface{}{1, 2}, [2]interface{}{[2]interface{}{"a", "b"}, "c"}}, v)
+
+	var c *Cons
+	obj := read("(1 2)")
+	assert.NoError(t, Unmarshal(obj, &c))
+	assert.True(t, c == obj)
+
+	for _, tt := range []struct {
+		obj Object
+		ptr interface{}
+		err string
+	}{
+		{"x", &n, `cannot unmarshal "x" into Go value of type int`},
+		{300, new(int8), "cannot unmarshal 300 into Go value of type int8"},
+		{-1, new(uint), "cannot unmarshal -1 into Go value of type uint"},
+		{1, &s, "cannot unmarshal 1 into Go value of type string"},
+		{read("(1 . 2)"), &ns, "cannot unmarshal (1 . 2) into Go value of type []int"},
+		{read("(1 x)"), &ns, "cannot unmarshal x into Go value of type int"},
+		{read("(1 2 3)"), &arr, "cannot unmarshal (1 2 3) into Go value of type [2]int"},
+		{read("(1 2)"), &m, "cannot unmarshal (1 2) into Go value of type map[string]int"},
+		{read("((1 . 2))"), &p, "cannot unmarshal ((1 . 2)) into Go value of type lisp.marshalPerson"},
+		{1, new(float64), "cannot unmarshal 1 into Go value of type float64"},
+		{1, n, "Unmarshal needs a non-nil pointer"},
+	} {
+		assert.EqualError(t, Unmarshal(tt.obj, tt.ptr), tt.err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := marshalPerson{Name: "Carol", Age: 41, Tags: []string{"a"}, Location: &marshalPoint{5, 6}, Notes: map[string]string{"k": "v"}}
+	obj, err := Marshal(in)
+	assert.NoError(t, err)
+	var out marshalPerson
+	assert.NoError(t, Unmarshal(obj, &out))
+	assert.Equal(t, in, out)
+
+	for _, tt := range []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{map[string]int{"a": 1}, map[string]interface{}{"a": 1}},
+		{in, map[string]interface{}{
+			"name": "Carol", "age": 41, "admin?": nil, "tags": []interface{}{"a"},
+			"location": map[string]interface{}{"X": 5, "Y": 6}, "notes": map[string]interface{}{"k": "v"},
+		}},
+		{[]interface{}{1, []string{"x"}}, []interface{}{1, []interface{}{"x"}}},
+	} {
+		obj, err := Marshal(tt.in)
+		assert.NoError(t, err)
+		var v interface{}
+		assert.NoError(t, Unmarshal(obj, &v))
+		assert.Equal(t, tt.out, v)
+	}
+}
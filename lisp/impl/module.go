@@ -0,0 +1,474 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// binding is the global variable a name refers to in a namespace.
+type binding struct {
+	global *Symbol
+	// imported is set for the bindings imported from other modules, which
+	// cannot be assigned
+	imported bool
+}
+
+// namespace maps names to the global variables they refer to. The names
+// not in a namespace refer to the global variables of the same names.
+type namespace map[*Symbol]*binding
+
+// module is a library of global variables, of which only the exported ones
+// can be imported into other modules. The variables are uninterned symbols,
+// so that modules never clobber each other's variables or the global ones.
+type module struct {
+	// name is the library name as written, such as (mylib utils)
+	name    Object
+	key     string
+	names   namespace
+	exports map[*Symbol]*Symbol
+}
+
+func (m *module) String() string {
+	return ToString(m.name)
+}
+
+// define makes a new variable of the module for the name sym, unless it
+// has one already, and returns it.
+func (m *module) define(sym *Symbol) *Symbol {
+	if b, ok := m.names[sym]; ok {
+		return b.global
+	}
+	global := NewSymbol(m.key + "/" + sym.name)
+	m.names[sym] = &binding{global: global}
+	return global
+}
+
+// libraryKey returns the key of the library name, a list of symbols such as
+// (mylib utils), by which the module is looked up and its variables can be
+// qualified, as in mylib/utils/helper. It also returns the path of the file
+// defining the library relative to the library path.
+func libraryKey(name Object) (string, string, error) {
+	parts, err := properList(name)
+	if err != nil || len(parts) == 0 {
+		return "", "", fmt.Errorf("invalid library name: %s", ToString(name))
+	}
+	names := make([]string, len(parts))
+	for i, part := range parts {
+		sym, ok := part.(*Symbol)
+		if !ok || strings.ContainsAny(sym.name, "./") {
+			return "", "", fmt.Errorf("invalid library name: %s", ToString(name))
+		}
+		names[i] = sym.name
+	}
+	key := strings.Join(names, "/")
+	return key, key + ".lisp", nil
+}
+
+// moduleEnv is the namespaces in which the compiler and Eval resolve the
+// global variables that the names refer to.
+type moduleEnv struct {
+	// names is the namespace of the module being expanded, or of the top
+	// level if current is nil
+	names   namespace
+	current *module
+	// modules are the modules defined so far by their keys
+	modules map[string]*module
+	// goFuncs are the variables of the Go functions defined for the
+	// interpreter, which are in scope in all the namespaces
+	goFuncs namespace
+}
+
+func newModuleEnv() moduleEnv {
+	return moduleEnv{names: namespace{}, modules: map[string]*module{}, goFuncs: namespace{}}
+}
+
+// definedNames returns the names that the top-level forms in body define.
+func definedNames(body []Object) []*Symbol {
+	var names []*Symbol
+	for _, form := range body {
+		if clause, ok := clauseOf(form, "define"); ok {
+			if args, ok := clause.cdr.(*Cons); ok {
+				if sym, ok := args.car.(*Symbol); ok {
+					names = append(names, sym.original())
+				}
+			}
+		} else if clause, ok := clauseOf(form, "begin"); ok {
+			if forms, err := properList(clause.cdr); err == nil {
+				names = append(names, definedNames(forms)...)
+			}
+		}
+	}
+	return names
+}
+
+// global returns the global variable that sym refers to where it is not
+// bound locally.
+func (c *moduleEnv) global(sym *Symbol) (*Symbol, error) {
+	orig := sym.original()
+	if b, ok := c.names[orig]; ok {
+		return b.global, nil
+	}
+	if b, ok := c.goFuncs[orig]; ok {
+		return b.global, nil
+	}
+	return c.qualifiedGlobal(orig)
+}
+
+// qualifiedGlobal returns the variable exported from a module that sym
+// names qualified with the key of the module, as in mylib/utils/helper, or
+// sym itself if it is not a qualified name of a module loaded.
+func (c *moduleEnv) qualifiedGlobal(sym *Symbol) (*Symbol, error) {
+	i := strings.LastIndex(sym.name, "/")
+	if i <= 0 || i == len(sym.name)-1 || !sym.IsInterned() {
+		return sym, nil
+	}
+	m := c.modules[sym.name[:i]]
+	if m == nil {
+		return sym, nil
+	}
+	global, ok := m.exports[Intern(sym.name[i+1:])]
+	if !ok {
+		return nil, fmt.Errorf("%s is not exported from %s", sym.name[i+1:], m)
+	}
+	return global, nil
+}
+
+// assignee returns the global variable that defining or assigning sym
+// assigns where it is not bound locally.
+func (c *moduleEnv) assignee(sym *Symbol, define bool) (*Symbol, error) {
+	orig := sym.original()
+	if b, ok := c.names[orig]; ok {
+		if !b.imported {
+			return b.global, nil
+		}
+		if !define || c.current != nil {
+			return nil, fmt.Errorf("imported variable %s cannot be assigned", orig.name)
+		}
+		// definitions at the top level shadow the variables imported
+		delete(c.names, orig)
+		return orig, nil
+	}
+	if define && c.current != nil {
+		return c.current.define(orig), nil
+	}
+	if _, ok := c.goFuncs[orig]; ok {
+		if !define {
+			return nil, fmt.Errorf("cannot assign Go function %s", orig.name)
+		}
+		// definitions at the top level shadow the Go functions
+		c.names[orig] = &binding{global: orig}
+		return orig, nil
+	}
+	global, err := c.qualifiedGlobal(orig)
+	if err != nil {
+		return nil, err
+	}
+	if global != orig {
+		return nil, fmt.Errorf("imported variable %s cannot be assigned", orig.name)
+	}
+	return orig, nil
+}
+
+// expandModule expands (module name (export name...) body...), which
+// defines the module name with the variables the body defines. The
+// variables are in scope in the body ahead of their definitions, and the
+// ones exported can be imported once the form is compiled.
+func (c *Compiler) expandModule(argList Object) (Node, error) {
+	args, err := properList(argList)
+	if err != nil {
+		return nil, err
+	}
+	if c.level > 0 || c.current != nil {
+		return nil, errors.New("module must be at the top level")
+	}
+	m, exports, body, err := c.newModule(args)
+	if err != nil {
+		return nil, err
+	}
+	defer func(current *module, names namespace) {
+		c.current, c.names = current, names
+	}(c.current, c.names)
+	c.current, c.names = m, m.names
+	node, err := c.expandExprs(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.export(m, exports); err != nil {
+		return nil, err
+	}
+	return &Seq{[]Node{node, &Const{m.name}}}, nil
+}
+
+// newModule makes the module that the arguments of module define, with
+// the variables for the names the body defines, and returns it with the
+// names to export and the body.
+func (c *moduleEnv) newModule(args []Object) (m *module, exports, body []Object, err error) {
+	if len(args) < 2 {
+		return nil, nil, nil, errors.New("module needs a name and an export list")
+	}
+	key, _, err := libraryKey(args[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	export, ok := clauseOf(args[1], "export")
+	if !ok {
+		return nil, nil, nil, errors.New("module needs an export list")
+	}
+	if exports, err = properList(export.cdr); err != nil {
+		return nil, nil, nil, err
+	}
+	m = &module{name: stripRenames(args[0], map[*Cons]bool{}), key: key, names: namespace{}, exports: map[*Symbol]*Symbol{}}
+	if old := c.modules[key]; old != nil {
+		// redefining a module keeps its variables, which the modules
+		// importing it refer to
+		for sym, b := range old.names {
+			if !b.imported {
+				m.names[sym] = b
+			}
+		}
+	}
+	body = args[2:]
+	for _, sym := range definedNames(body) {
+		m.define(sym)
+	}
+	if len(body) == 0 {
+		body = []Object{nil}
+	}
+	return m, exports, body, nil
+}
+
+// export exports the variables of the names from the module once its body
+// is expanded, which makes the module available for import.
+func (c *moduleEnv) export(m *module, exports []Object) error {
+	for _, obj := range exports {
+		sym, ok := obj.(*Symbol)
+		if !ok {
+			return fmt.Errorf("exported name must be a symbol, but got %s", ToString(obj))
+		}
+		b, ok := m.names[sym.original()]
+		if !ok {
+			return fmt.Errorf("%s is exported but not defined in %s", sym.name, m)
+		}
+		m.exports[sym.original()] = b.global
+	}
+	c.modules[m.key] = m
+	return nil
+}
+
+// expandImport expands (import import-set...), which binds the names of
+// the variables exported from the modules in the current namespace, loading
+// the modules first if they are not loaded yet. An import set is a library
+// name, or one of the following modifying another import set:
+//
+//	(only import-set name...)
+//	(except import-set name...)
+//	(prefix import-set prefix)
+//	(rename import-set (name new-name)...)
+func (c *Compiler) expandImport(argList Object) (Node, error) {
+	sets, err := properList(argList)
+	if err != nil {
+		return nil, err
+	}
+	if c.level > 0 {
+		return nil, errors.New("import must be at the top level")
+	}
+	if err := c.importSets(sets, c.loadModule); err != nil {
+		return nil, err
+	}
+	return &Const{nil}, nil
+}
+
+// importSets binds the names of the variables that the import sets import
+// in the current namespace, loading the modules with load.
+func (c *moduleEnv) importSets(sets []Object, load func(name Object) (*module, error)) error {
+	for _, set := range sets {
+		imports, err := importSet(set, load)
+		if err != nil {
+			return err
+		}
+		for sym, global := range imports {
+			if b, ok := c.names[sym]; ok && !b.imported {
+				return fmt.Errorf("imported variable %s is already defined in %s", sym.name, c.current)
+			}
+			c.names[sym] = &binding{global: global, imported: true}
+		}
+	}
+	return nil
+}
+
+// importSet returns the variables that the import set imports by the names
+// to bind them to.
+func importSet(set Object, load func(name Object) (*module, error)) (map[*Symbol]*Symbol, error) {
+	if clause, ok := set.(*Cons); ok {
+		if args, ok := clause.cdr.(*Cons); ok {
+			if _, ok := args.car.(*Cons); ok {
+				if sym, ok := clause.car.(*Symbol); ok {
+					return modifiedImportSet(sym.original().name, args, load)
+				}
+			}
+		}
+	}
+	m, err := load(set)
+	if err != nil {
+		return nil, err
+	}
+	imports := map[*Symbol]*Symbol{}
+	for sym, global := range m.exports {
+		imports[sym] = global
+	}
+	return imports, nil
+}
+
+func modifiedImportSet(modifier string, args *Cons, load func(name Object) (*module, error)) (map[*Symbol]*Symbol, error) {
+	switch modifier {
+	case "only", "except", "prefix", "rename":
+	default:
+		return nil, fmt.Errorf("unknown import set modifier: %s", modifier)
+	}
+	imports, err := importSet(args.car, load)
+	if err != nil {
+		return nil, err
+	}
+	params, err := properList(args.cdr)
+	if err != nil {
+		return nil, err
+	}
+	if modifier == "prefix" {
+		if len(params) != 1 {
+			return nil, errors.New("prefix import set needs a prefix")
+		}
+		prefix, ok := params[0].(*Symbol)
+		if !ok {
+			return nil, errors.New("prefix of import set must be a symbol")
+		}
+		prefixed := map[*Symbol]*Symbol{}
+		for sym, global := range imports {
+			prefixed[Intern(prefix.name+sym.name)] = global
+		}
+		return prefixed, nil
+	}
+	if modifier == "rename" {
+		renamed := map[*Symbol]*Symbol{}
+		for sym, global := range imports {
+			renamed[sym] = global
+		}
+		for _, param := range params {
+			pair, err := takeArgs(2, param)
+			if err != nil {
+				return nil, errors.New("rename import set needs pairs of names")
+			}
+			from, ok1 := pair[0].(*Symbol)
+			to, ok2 := pair[1].(*Symbol)
+			if !ok1 || !ok2 {
+				return nil, errors.New("rename import set needs pairs of names")
+			}
+			global, ok := imports[from.original()]
+			if !ok {
+				return nil, fmt.Errorf("%s is not imported", from.name)
+			}
+			delete(renamed, from.original())
+			renamed[to.original()] = global
+		}
+		return renamed, nil
+	}
+	names := map[*Symbol]bool{}
+	for _, param := range params {
+		sym, ok := param.(*Symbol)
+		if !ok {
+			return nil, fmt.Errorf("%s import set needs names", modifier)
+		}
+		if _, ok := imports[sym.original()]; !ok {
+			return nil, fmt.Errorf("%s is not imported", sym.name)
+		}
+		names[sym.original()] = true
+	}
+	filtered := map[*Symbol]*Symbol{}
+	for sym, global := range imports {
+		if names[sym] == (modifier == "only") {
+			filtered[sym] = global
+		}
+	}
+	return filtered, nil
+}
+
+// loadModule returns the module name, loading the file defining it if it
+// is not loaded yet.
+func (c *Compiler) loadModule(name Object) (*module, error) {
+	key, path, err := libraryKey(name)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := c.modules[key]
+	if m != nil {
+		return m, nil
+	}
+	if ok {
+		return nil, fmt.Errorf("library %s is imported circularly", ToString(name))
+	}
+	// the key maps to nil while the library is being loaded
+	c.modules[key] = nil
+	defer func(saved Compiler) {
+		c.current, c.names, c.srcmap, c.pos = saved.current, saved.names, saved.srcmap, saved.pos
+		c.inlineDefs, c.inlined = saved.inlineDefs, saved.inlined
+	}(*c)
+	// the top-level forms of the library file have a namespace of their
+	// own, and never inline the functions of the file importing it
+	c.current, c.names = nil, namespace{}
+	c.inlineDefs, c.inlined = nil, nil
+	if err := c.loadLibrary(path); err != nil {
+		delete(c.modules, key)
+		return nil, err
+	}
+	if m = c.modules[key]; m == nil {
+		delete(c.modules, key)
+		return nil, fmt.Errorf("library file %s does not define module %s", path, ToString(name))
+	}
+	return m, nil
+}
+
+// SetLibraryPath sets the file systems searched in order for the files of
+// the libraries imported. The library (mylib utils) is defined by the file
+// mylib/utils.lisp, which is loaded once when it is first imported. The
+// forms in the file are only compiled, as for checking them, unless the
+// compiler belongs to an Interpreter, which evaluates them as well.
+func (c *Compiler) SetLibraryPath(path ...fs.FS) {
+	c.libraryPath = path
+}
+
+// loadLibrary loads the library file at path found in the library path.
+func (c *Compiler) loadLibrary(path string) error {
+	for _, fsys := range c.libraryPath {
+		f, err := fsys.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r := NewReader(f)
+		r.SetFilename(path)
+		c.SetSourceMap(r.SourceMap())
+		for {
+			obj, err := r.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if c.evalLibrary != nil {
+				err = c.evalLibrary(obj)
+			} else {
+				_, err = c.Compile(obj)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("library file %s is not found", path)
+}
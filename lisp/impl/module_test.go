@@ -0,0 +1,152 @@
+package lisp
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testLibraries = fstest.MapFS{
+	"mylib/utils.lisp": {Data: []byte(`
+(set! mod-load-count (+ mod-load-count 1))
+(module (mylib utils) (export helper twice)
+  (define twice (lambda (x) (helper (helper x))))
+  (define helper (lambda (x) (+ x 1))))
+`)},
+	"other/lib.lisp": {Data: []byte(`
+(module (other lib) (export helper call-utils)
+  (import (prefix (mylib utils) u:))
+  (define helper (lambda (x) (* x 10)))
+  (define call-utils (lambda (x) (u:twice x))))
+`)},
+	"cyc/a.lisp":      {Data: []byte("(module (cyc a) (export a) (import (cyc b)) (define a 1))")},
+	"cyc/b.lisp":      {Data: []byte("(module (cyc b) (export b) (import (cyc a)) (define b 1))")},
+	"bad/empty.lisp":  {Data: []byte("(define not-a-module 1)")},
+	"bad/broken.lisp": {Data: []byte("(module (bad broken) (export x))")},
+}
+
+func TestModules(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(define helper 'global)", "global"},
+		{"(module (test m) (export pub) (define pub (lambda (x) (priv x))) (define priv (lambda (x) (* x 2))))", "(test m)"},
+		{"(test/m/pub 3)", "6"},
+		{"(test/m/priv 3)", "error: priv is not exported from (test m)"},
+		{"(priv 3)", "error: unbound variable: priv"},
+		{"(import (mylib utils))", "nil"},
+		{"mod-load-count", "1"},
+		{"(cons (helper 1) (twice 1))", "(2 . 3)"},
+		{"(import (mylib utils))", "nil"},
+		{"mod-load-count", "1"},
+		{"(mylib/utils/helper 5)", "6"},
+		{"(import (rename (other lib) (helper other-helper)))", "nil"},
+		{"(cons (other-helper 1) (helper 1))", "(10 . 2)"},
+		{"(call-utils 1)", "3"},
+		{"(u:twice 1)", "error: unbound variable: u:twice"},
+		{"(import (prefix (only (other lib) helper) o:))", "nil"},
+		{"(o:helper 2)", "20"},
+		{"(import (except (test m) pub))", "nil"},
+		{"(set! helper 1)", "error: imported variable helper cannot be assigned"},
+		{"(set! mylib/utils/helper 1)", "error: imported variable mylib/utils/helper cannot be assigned"},
+		{"(define helper (lambda (x) 'shadowed))", "#<func helper/1>"},
+		{"(cons (helper 1) (twice 1))", "(shadowed . 3)"},
+		{"(import (cyc a))", "error: library (cyc a) is imported circularly"},
+		{"(import (no such))", "error: library file no/such.lisp is not found"},
+		{"(import (bad empty))", "error: library file bad/empty.lisp does not define module (bad empty)"},
+		{"(import (bad broken))", "error: x is exported but not defined in (bad broken)"},
+		{"(import (only (mylib utils) nothing))", "error: nothing is not imported"},
+		{"(import (../etc passwd))", "error: invalid library name: (../etc passwd)"},
+		{"(lambda () (import (mylib utils)))", "error: import must be at the top level"},
+		{"(module (test n) (export) (module (test o) (export)))", "error: module must be at the top level"},
+		{"(module (test n) (export x) (import (mylib utils)) (define x (twice 0)))", "(test n)"},
+		{"test/n/x", "2"},
+		{"(module (test n) (export) (import (mylib utils)) (define helper 1))", "error: imported variable helper is already defined in (test n)"},
+		{"(module (test n) (export) (define twice 1) (import (mylib utils)))", "error: imported variable twice is already defined in (test n)"},
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		Intern("mod-load-count").SetValue(0)
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		in.SetLibraryPath(fstest.MapFS{}, testLibraries)
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+	Intern("helper").Unbind()
+}
+
+// modulePrograms test Eval and the engines against each other on modules.
+// Eval has no library path, so the programs define what they import.
+var modulePrograms = []string{
+	"(begin (module (emod a) (export pub) (define pub (lambda (x) (priv x))) (define priv (lambda (x) (* x 2)))) (cons (emod/a/pub 3) emod/a/pub))",
+	"(begin (module (emod a) (export pub) (define pub 1) (define priv 2)) emod/a/priv)",
+	"(begin (module (emod a) (export x y) (define x 1) (define y 2)) (import (prefix (only (emod a) x) a:) (rename (except (emod a) x) (y b:y))) (cons a:x b:y))",
+	"(begin (module (emod a) (export x) (define x 1)) (import (emod a)) (set! x 2))",
+	"(begin (module (emod a) (export emod-v) (define emod-v 1)) (import (emod a)) (define emod-v 2) (cons emod-v emod/a/emod-v))",
+	"(begin (module (emod a) (export x) (define x 1)) (import (emod a) (emod b)) x)",
+	"(begin (module (emod a) (export x) (define x 1)) (import (only (emod a) y)))",
+	"(lambda () (import (emod a)))",
+	"(module (emod a) (export) (module (emod b) (export)))",
+	"(module (emod a) (export x))",
+	"(module (emod a) (export) (car 1))",
+	"(begin (module (emod a) (export f) (define f (lambda () later)) (f) (define later 1)) 1)",
+	"(begin (module (emod a) (export get) (define get (lambda () c)) (define c 1) (set! c 2)) (emod/a/get))",
+	"(begin (module (emod a) (export v) (define v 1)) (import (emod a)) (module (emod a) (export v) (define v 2)) v)",
+	"(begin (module (emod a) (export v) (define v 1)) (module (emod b) (export) (define v 2) (import (emod a))))",
+	"(begin (define-syntax emod-def (syntax-rules () ((_ x) (define x 5)))) (module (emod a) (export y) (emod-def y)) (import (emod a)) y)",
+}
+
+func TestImportWithoutInterpreter(t *testing.T) {
+	expr, err := ReadFromString("(import (mylib utils))")
+	assert.NoError(t, err)
+	_, err = NewCompiler().Compile(expr)
+	assert.EqualError(t, err, "library file mylib/utils.lisp is not found")
+
+	// the library files are only compiled
+	c := NewCompiler()
+	c.SetLibraryPath(testLibraries)
+	_, err = c.Compile(expr)
+	assert.NoError(t, err)
+	expr, err = ReadFromString("(twice 1)")
+	assert.NoError(t, err)
+	code, err := c.Compile(expr)
+	assert.NoError(t, err)
+	assert.Equal(t, "mylib/utils/twice", ToString(code[1].operands[0]))
+}
+
+func TestImportWhileInlining(t *testing.T) {
+	libraries := fstest.MapFS{
+		"inl/lib.lisp": {Data: []byte(`
+(define inl-lib-f (lambda () 'library))
+(define inl-lib-result (inl-lib-f))
+(module (inl lib) (export))
+`)},
+	}
+	inputs := []string{
+		"(define inl-lib-f (lambda () 'file))",
+		"(import (inl lib))",
+		"inl-lib-result",
+	}
+	forms := make([]Object, len(inputs))
+	for i, input := range inputs {
+		expr, err := ReadFromString(input)
+		assert.NoError(t, err)
+		forms[i] = expr
+	}
+	in := NewInterpreter()
+	in.SetLibraryPath(libraries)
+	in.Compiler().InlineGlobals(forms)
+	var v Object
+	for _, form := range forms {
+		var err error
+		v, err = in.Eval(form)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "library", ToString(v))
+	Intern("inl-lib-f").Unbind()
+	Intern("inl-lib-result").Unbind()
+}
@@ -3,8 +3,6 @@ package lisp
 import (
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 )
 
 type Object interface{}
@@ -15,6 +13,27 @@ type Cons struct {
 type Func struct {
 	code Code
 	env  *Env
+	info *LambdaInfo
+	// body is the code compiled by the closure engine, if any
+	body closure
+	// eval is what Eval created the function from, if it did
+	eval *evalClosure
+}
+
+// LambdaInfo describes the functions created from a lambda expression.
+type LambdaInfo struct {
+	name  string
+	arity int
+	pos   Pos
+}
+type Vector struct {
+	elems []Object
+}
+
+// MutableString is a string whose characters can be replaced in place.
+// String literals are plain Go strings and hence immutable.
+type MutableString struct {
+	runes []rune
 }
 
 func IsAtom(obj Object) bool {
@@ -66,8 +85,158 @@ func NewCons(car Object, cdr Object) Object {
 	return &Cons{car, cdr}
 }
 
-func NewFunc(code Code, env *Env) *Func {
-	return &Func{code, env}
+func NewFunc(code Code, env *Env, info *LambdaInfo) *Func {
+	return &Func{code: code, env: env, info: info}
+}
+
+// Name returns the name the function was defined with, or "lambda" if it
+// is anonymous.
+func (fn *Func) Name() string {
+	if fn.info.name == "" {
+		return "lambda"
+	}
+	return fn.info.name
+}
+
+func (fn *Func) Arity() int {
+	return fn.info.arity
+}
+
+func (fn *Func) Pos() Pos {
+	return fn.info.pos
+}
+
+func NewVector(elems []Object) *Vector {
+	return &Vector{elems}
+}
+
+func NewMutableString(s string) *MutableString {
+	return &MutableString{[]rune(s)}
+}
+
+func (s *MutableString) String() string {
+	return string(s.runes)
+}
+
+func SliceToList(elems []Object) Object {
+	var ret Object
+	for i := len(elems) - 1; i >= 0; i-- {
+		ret = NewCons(elems[i], ret)
+	}
+	return ret
+}
+
+// copyLiteral returns a fresh copy of the mutable parts of obj so that
+// mutating the result never affects obj itself. Shared and cyclic
+// structure is preserved in the copy.
+func copyLiteral(obj Object) Object {
+	switch obj.(type) {
+	case *Cons, *Vector, *MutableString:
+		// most literals are small trees, which need not remember what
+		// has been copied
+		var s treeScan
+		if s.scan(obj) {
+			return copyTree(obj)
+		}
+		return copyObject(obj, map[Object]Object{})
+	default:
+		return obj
+	}
+}
+
+// treeScan checks if a literal is a tree of at most len(seen) mutable
+// objects, without allocating.
+type treeScan struct {
+	seen [16]Object
+	n    int
+}
+
+// scan reports whether obj is a small tree, sharing no structure.
+func (s *treeScan) scan(obj Object) bool {
+	for {
+		switch o := obj.(type) {
+		case *Cons:
+			if !s.visit(o) || !s.scan(o.car) {
+				return false
+			}
+			obj = o.cdr
+		case *Vector:
+			if !s.visit(o) {
+				return false
+			}
+			for _, elem := range o.elems {
+				if !s.scan(elem) {
+					return false
+				}
+			}
+			return true
+		case *MutableString:
+			return s.visit(o)
+		default:
+			return true
+		}
+	}
+}
+
+// visit remembers obj, failing if it has been seen or there is no room
+// left.
+func (s *treeScan) visit(obj Object) bool {
+	if s.n == len(s.seen) {
+		return false
+	}
+	for _, seen := range s.seen[:s.n] {
+		if seen == obj {
+			return false
+		}
+	}
+	s.seen[s.n] = obj
+	s.n++
+	return true
+}
+
+// copyTree copies obj, which shares no structure.
+func copyTree(obj Object) Object {
+	switch o := obj.(type) {
+	case *Cons:
+		return &Cons{copyTree(o.car), copyTree(o.cdr)}
+	case *Vector:
+		ret := &Vector{make([]Object, len(o.elems))}
+		for i, elem := range o.elems {
+			ret.elems[i] = copyTree(elem)
+		}
+		return ret
+	case *MutableString:
+		return NewMutableString(o.String())
+	default:
+		return obj
+	}
+}
+
+func copyObject(obj Object, copied map[Object]Object) Object {
+	if ret, ok := copied[obj]; ok {
+		return ret
+	}
+	switch o := obj.(type) {
+	case *Cons:
+		ret := &Cons{}
+		copied[o] = ret
+		ret.car = copyObject(o.car, copied)
+		ret.cdr = copyObject(o.cdr, copied)
+		return ret
+	case *Vector:
+		ret := &Vector{make([]Object, len(o.elems))}
+		copied[o] = ret
+		for i, elem := range o.elems {
+			ret.elems[i] = copyObject(elem, copied)
+		}
+		return ret
+	case *MutableString:
+		ret := NewMutableString(o.String())
+		copied[o] = ret
+		return ret
+	default:
+		return obj
+	}
 }
 
 func ListToSlice(obj Object) ([]Object, Object, error) {
@@ -93,45 +262,6 @@ func ListToSlice(obj Object) ([]Object, Object, error) {
 	}
 }
 
-func listToString(obj Object) string {
-	elems, improper, _ := ListToSlice(obj)
-	var sb strings.Builder
-	sb.WriteRune('(')
-	for i, elem := range elems {
-		s := ToString(elem)
-		sb.WriteString(s)
-		if i < len(elems)-1 {
-			sb.WriteRune(' ')
-		}
-	}
-	if improper != nil {
-		sb.WriteString(" . ")
-		sb.WriteString(ToString(improper))
-	}
-	sb.WriteRune(')')
-	return sb.String()
-}
-
 func ToString(obj Object) string {
-	switch obj := obj.(type) {
-	case nil:
-		return "nil"
-	case bool:
-		if !obj {
-			panic(fmt.Sprintf("unknown type of object found: %v", obj))
-		}
-		return "t"
-	case int:
-		return strconv.Itoa(obj)
-	case string:
-		return fmt.Sprintf("\"%s\"", obj)
-	case *Symbol:
-		return obj.name
-	case *Cons:
-		return listToString(obj)
-	case *Func:
-		return "#<func>"
-	default:
-		panic(fmt.Sprintf("unknown type of object found: %v", obj))
-	}
+	return printerFromGlobals().ToString(obj)
 }
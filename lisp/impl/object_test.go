@@ -48,6 +48,7 @@ func TestToString(t *testing.T) {
 		{true, "t"},
 		{42, "42"},
 		{Intern("foo"), "foo"},
+		{"say \"hi\"\n", `"say \"hi\"\n"`},
 		{&Cons{Intern("+"), &Cons{1, &Cons{2, nil}}}, "(+ 1 2)"},
 		{
 			&Cons{
@@ -59,6 +60,8 @@ func TestToString(t *testing.T) {
 			},
 			"(+ (* 3 3) (* 4 4))",
 		},
+		{NewFunc(nil, nil, &LambdaInfo{name: "fact", arity: 1}), "#<func fact/1>"},
+		{NewFunc(nil, nil, &LambdaInfo{}), "#<func lambda/0>"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.out, func(t *testing.T) {
@@ -66,3 +69,28 @@ func TestToString(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyLiteral(t *testing.T) {
+	tree := &Cons{1, &Cons{NewVector([]Object{&Cons{2, nil}, 3}), nil}}
+	copied := copyLiteral(tree)
+	assert.Equal(t, tree, copied)
+	assert.NotSame(t, tree, copied)
+	// the conses and the vector with its elements, but no map
+	allocs := testing.AllocsPerRun(10, func() { copyLiteral(tree) })
+	assert.Equal(t, 5.0, allocs)
+
+	long := SliceToList(make([]Object, 100))
+	assert.Equal(t, long, copyLiteral(long))
+
+	shared := &Cons{1, nil}
+	sharing := copyLiteral(&Cons{shared, &Cons{shared, nil}}).(*Cons)
+	assert.Equal(t, shared, sharing.car)
+	assert.NotSame(t, shared, sharing.car)
+	assert.Same(t, sharing.car, sharing.cdr.(*Cons).car)
+
+	cyclic := &Cons{1, nil}
+	cyclic.cdr = cyclic
+	copiedCycle := copyLiteral(cyclic).(*Cons)
+	assert.NotSame(t, cyclic, copiedCycle)
+	assert.Same(t, copiedCycle, copiedCycle.cdr)
+}
@@ -0,0 +1,230 @@
+package lisp
+
+// Optimize returns code simplified by peephole rewriting, which applies to
+// the bodies of nested functions as well:
+//
+//   - arithmetic, comparisons, NULL and ATOM on constants are folded
+//   - conditional jumps on constants are resolved, and then code that can
+//     never be reached and jumps to the next instruction are removed
+//   - instructions that only push a value followed by POP are removed
+//
+// Instructions are never combined across a jump target, and jump offsets
+// are adjusted to the rewritten code. The result behaves exactly the same
+// as the original code.
+func Optimize(code Code) Code {
+	code = optimizeFuncs(code)
+	for {
+		opt := optimizePass(code)
+		// every rewrite shortens the code
+		if len(opt) == len(code) {
+			return opt
+		}
+		code = opt
+	}
+}
+
+// optimizer rewrites the instructions in a single pass over the code,
+// where jumps temporarily refer to their targets by index in the original
+// code.
+type optimizer struct {
+	insns Code
+	// index of the original instruction being emitted
+	index int
+	// rewriting must leave insns before barrier as they are
+	barrier int
+	// false while following an unconditional jump or RTN
+	reachable bool
+}
+
+func optimizeFuncs(code Code) Code {
+	ret := make(Code, len(code))
+	for i, insn := range code {
+		switch insn.operator {
+		case LDF, CLOS:
+			operands := append([]Operand{Optimize(insn.operands[0].(Code))}, insn.operands[1:]...)
+			insn = Insn{insn.operator, operands}
+		}
+		ret[i] = insn
+	}
+	return ret
+}
+
+// hasOffset reports whether the first operand of op is an offset to
+// another instruction.
+func hasOffset(op Op) bool {
+	switch op {
+	case JMP, JMPF, TRY:
+		return true
+	default:
+		return false
+	}
+}
+
+func jumpTargets(code Code) map[int]bool {
+	targets := map[int]bool{}
+	for i, insn := range code {
+		if hasOffset(insn.operator) {
+			targets[i+insn.operands[0].(int)] = true
+		}
+	}
+	return targets
+}
+
+func optimizePass(code Code) Code {
+	targets := jumpTargets(code)
+	o := &optimizer{reachable: true}
+	newIndex := make([]int, len(code)+1)
+	for i, insn := range code {
+		if targets[i] {
+			o.barrier = len(o.insns)
+			o.reachable = true
+		}
+		newIndex[i] = len(o.insns)
+		if !o.reachable {
+			continue
+		}
+		if hasOffset(insn.operator) {
+			insn = Insn{insn.operator, []Operand{i + insn.operands[0].(int)}}
+		}
+		o.index = i
+		o.emit(insn)
+	}
+	newIndex[len(code)] = len(o.insns)
+	for i, insn := range o.insns {
+		if hasOffset(insn.operator) {
+			insn.operands[0] = newIndex[insn.operands[0].(int)] - i
+		}
+	}
+	return o.insns
+}
+
+// constant returns the value insn pushes if it is an atom known at compile
+// time.
+func constant(insn Insn) (Object, bool) {
+	switch insn.operator {
+	case NIL:
+		return nil, true
+	case LDC:
+		switch v := insn.operands[0].(type) {
+		case bool, int, string, rune:
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func constantInsn(v Object) Insn {
+	if v == nil {
+		return Insn{NIL, nil}
+	}
+	return Insn{LDC, []Operand{v}}
+}
+
+// isPurePush reports whether insn does nothing but push a value.
+func isPurePush(insn Insn) bool {
+	switch insn.operator {
+	case NIL, LDC, LD, LDF:
+		return true
+	default:
+		return false
+	}
+}
+
+func foldBinary(op Op, x, y int) (Object, bool) {
+	switch op {
+	case ADD:
+		return x + y, true
+	case SUB:
+		return x - y, true
+	case MUL:
+		return x * y, true
+	case DIV:
+		if y == 0 {
+			// leaves the error to the run time
+			return nil, false
+		}
+		return x / y, true
+	case EQ:
+		return FromBool(x == y), true
+	case GT:
+		return FromBool(x > y), true
+	case LT:
+		return FromBool(x < y), true
+	case GTE:
+		return FromBool(x >= y), true
+	case LTE:
+		return FromBool(x <= y), true
+	default:
+		return nil, false
+	}
+}
+
+// tail returns the last n instructions emitted if they may be rewritten.
+func (o *optimizer) tail(n int) []Insn {
+	if len(o.insns)-n < o.barrier {
+		return nil
+	}
+	return o.insns[len(o.insns)-n:]
+}
+
+func (o *optimizer) drop(n int) {
+	o.insns = o.insns[:len(o.insns)-n]
+}
+
+func (o *optimizer) emit(insn Insn) {
+	switch insn.operator {
+	case ADD, SUB, MUL, DIV, EQ, GT, LT, GTE, LTE:
+		if args := o.tail(2); args != nil {
+			x, ok1 := constant(args[0])
+			y, ok2 := constant(args[1])
+			n, isNum1 := x.(int)
+			m, isNum2 := y.(int)
+			if ok1 && ok2 && isNum1 && isNum2 {
+				if v, ok := foldBinary(insn.operator, n, m); ok {
+					o.drop(2)
+					o.emit(constantInsn(v))
+					return
+				}
+			}
+		}
+	case NULL, ATOM:
+		if args := o.tail(1); args != nil {
+			if v, ok := constant(args[0]); ok {
+				o.drop(1)
+				if insn.operator == NULL {
+					o.emit(constantInsn(FromBool(IsNull(v))))
+				} else {
+					o.emit(constantInsn(FromBool(IsAtom(v))))
+				}
+				return
+			}
+		}
+	case JMPF:
+		if args := o.tail(1); args != nil {
+			if v, ok := constant(args[0]); ok {
+				o.drop(1)
+				if !ToBool(v) {
+					o.emit(Insn{JMP, insn.operands})
+				}
+				return
+			}
+		}
+		if insn.operands[0] == o.index+1 {
+			o.emit(Insn{POP, nil})
+			return
+		}
+	case JMP:
+		if insn.operands[0] == o.index+1 {
+			return
+		}
+	case POP:
+		if args := o.tail(1); args != nil && isPurePush(args[0]) {
+			o.drop(1)
+			return
+		}
+	}
+	o.insns = append(o.insns, insn)
+	if insn.operator == JMP || insn.operator == RTN {
+		o.reachable = false
+	}
+}
@@ -0,0 +1,222 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		title string
+		in    Code
+		out   Code
+	}{
+		{
+			"ldc(1); ldc(2); add -> ldc(3)",
+			Code{{LDC, []Operand{1}}, {LDC, []Operand{2}}, {ADD, nil}},
+			Code{{LDC, []Operand{3}}},
+		},
+		{
+			"ldc(1); ldc(2); add; ldc(4); mul -> ldc(12)",
+			Code{
+				{LDC, []Operand{1}},
+				{LDC, []Operand{2}},
+				{ADD, nil},
+				{LDC, []Operand{4}},
+				{MUL, nil},
+			},
+			Code{{LDC, []Operand{12}}},
+		},
+		{
+			"ldc(1); ldc(2); lt -> ldc(t)",
+			Code{{LDC, []Operand{1}}, {LDC, []Operand{2}}, {LT, nil}},
+			Code{{LDC, []Operand{true}}},
+		},
+		{
+			"ldc(1); ldc(2); gt -> nil",
+			Code{{LDC, []Operand{1}}, {LDC, []Operand{2}}, {GT, nil}},
+			Code{{NIL, nil}},
+		},
+		{
+			"ldc(1); ldc(0); div is left as is",
+			Code{{LDC, []Operand{1}}, {LDC, []Operand{0}}, {DIV, nil}},
+			Code{{LDC, []Operand{1}}, {LDC, []Operand{0}}, {DIV, nil}},
+		},
+		{
+			"ldc(t); ldc(1); add is left as is",
+			Code{{LDC, []Operand{true}}, {LDC, []Operand{1}}, {ADD, nil}},
+			Code{{LDC, []Operand{true}}, {LDC, []Operand{1}}, {ADD, nil}},
+		},
+		{
+			"nil; null -> ldc(t)",
+			Code{{NIL, nil}, {NULL, nil}},
+			Code{{LDC, []Operand{true}}},
+		},
+		{
+			"ldc(1); pop; ld(0,0) -> ld(0,0)",
+			Code{{LDC, []Operand{1}}, {POP, nil}, {LD, []Operand{&Location{0, 0}}}},
+			Code{{LD, []Operand{&Location{0, 0}}}},
+		},
+		{
+			"ldg(x); pop is left as is",
+			Code{{LDG, []Operand{Intern("x")}}, {POP, nil}},
+			Code{{LDG, []Operand{Intern("x")}}, {POP, nil}},
+		},
+		{
+			"ldc(1); ldc(1); eq; jmpf(+3); ldc(2); jmp(+2); ldc(3) -> ldc(2)",
+			Code{
+				{LDC, []Operand{1}},
+				{LDC, []Operand{1}},
+				{EQ, nil},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{2}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{3}},
+			},
+			Code{{LDC, []Operand{2}}},
+		},
+		{
+			"nil; jmpf(+3); ldc(2); jmp(+4); ldc(3); ldc(4); add -> ldc(7)",
+			Code{
+				{NIL, nil},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{2}},
+				{JMP, []Operand{4}},
+				{LDC, []Operand{3}},
+				{LDC, []Operand{4}},
+				{ADD, nil},
+			},
+			Code{{LDC, []Operand{7}}},
+		},
+		{
+			"ld(0,0); jmpf(+5); ldc(1); ldc(1); add; jmp(+2); nil -> ld(0,0); jmpf(+3); ldc(2); jmp(+2); nil",
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{JMPF, []Operand{5}},
+				{LDC, []Operand{1}},
+				{LDC, []Operand{1}},
+				{ADD, nil},
+				{JMP, []Operand{2}},
+				{NIL, nil},
+			},
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{2}},
+				{JMP, []Operand{2}},
+				{NIL, nil},
+			},
+		},
+		{
+			"ld(0,0); jmpf(+3); ldc(1); jmp(+2); ldc(2); ldc(3); add is left as is",
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{1}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{2}},
+				{LDC, []Operand{3}},
+				{ADD, nil},
+			},
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{1}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{2}},
+				{LDC, []Operand{3}},
+				{ADD, nil},
+			},
+		},
+		{
+			"ld(0,0); try(+4); ldc(1); ldc(2); add; leave -> ld(0,0); try(+2); ldc(3); leave",
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{TRY, []Operand{4}},
+				{LDC, []Operand{1}},
+				{LDC, []Operand{2}},
+				{ADD, nil},
+				{LEAVE, nil},
+			},
+			Code{
+				{LD, []Operand{&Location{0, 0}}},
+				{TRY, []Operand{2}},
+				{LDC, []Operand{3}},
+				{LEAVE, nil},
+			},
+		},
+		{
+			"ldf(ldc(2); ldc(3); mul; rtn) -> ldf(ldc(6); rtn)",
+			Code{
+				{LDF, []Operand{
+					Code{{LDC, []Operand{2}}, {LDC, []Operand{3}}, {MUL, nil}, {RTN, nil}},
+					&LambdaInfo{},
+				}},
+			},
+			Code{
+				{LDF, []Operand{
+					Code{{LDC, []Operand{6}}, {RTN, nil}},
+					&LambdaInfo{},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			assert.Equal(t, tt.out, Optimize(tt.in))
+		})
+	}
+}
+
+// differentialPrograms are run both with and without optimization to check
+// that the optimizer preserves their behavior.
+var differentialPrograms = []string{
+	"(+ 1 2)",
+	"(* (+ 1 2) (- 10 4))",
+	"(/ 7 2)",
+	"(/ 1 0)",
+	"(+ 1 'a)",
+	"(if (< 1 2) 'yes 'no)",
+	"(if (= 1 2) 'yes (+ 1 1))",
+	"(if nil 1 (if t 2 3))",
+	"(null (cons 1 2))",
+	"(atom 1)",
+	"(begin 1 2 3)",
+	"(begin (define opt-x 10) 1 2 opt-x)",
+	"((lambda (x) (begin 1 x)) 5)",
+	"((lambda (x) (if (> 2 1) (* x (+ 2 3)) x)) 4)",
+	"(begin (define opt-f (lambda (n) (if (= n 0) 1 (* n (opt-f (- n 1)))))) (opt-f 10))",
+	"(try (+ 1 (car 2)) (catch e (+ 40 2)))",
+	"(try (if (< 1 2) (raise (* 6 7)) 0) (catch e e))",
+	"(begin (define opt-log nil) (try (+ 1 2) (finally (set! opt-log (+ 3 4)))) opt-log)",
+	"(try (if (< 2 1) 0 (raise 'oops)) (catch e (if (= 1 1) e 0)))",
+	"(begin (define opt-n 0) (try (try (car 1) (finally (set! opt-n (+ opt-n 1)))) (catch e opt-n)))",
+	"((lambda (x) (if x (if (null x) 1 2) (if t 3 4))) nil)",
+	"'(1 2 3)",
+	"(car '((+ 1 2)))",
+	"(lenght 1)",
+}
+
+func TestOptimizeDifferential(t *testing.T) {
+	for _, in := range differentialPrograms {
+		t.Run(in, func(t *testing.T) {
+			obj, err := ReadFromString(in)
+			assert.Nil(t, err)
+			var results [2]string
+			for i, optimize := range []bool{false, true} {
+				c := NewCompiler()
+				c.SetOptimize(optimize)
+				code, err := c.Compile(obj)
+				assert.Nil(t, err)
+				v, err := NewVM(code).Run()
+				if err != nil {
+					results[i] = "error: " + err.Error()
+				} else {
+					results[i] = ToString(v)
+				}
+			}
+			assert.Equal(t, results[0], results[1])
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package lisp
+
+import "fmt"
+
+// Parameter is a parameter object. Calling it with no arguments returns its
+// value, which parameterize rebinds for the dynamic extent of its body: the
+// previous value is restored however the body exits, by returning or by an
+// error unwinding through it.
+type Parameter struct {
+	value Object
+	// converter, if not nil, is applied to the values the parameter is
+	// given
+	converter Object
+	// local is set for the parameters that each interpreter has a value
+	// of its own for, in which case value is the one for the interpreters
+	// that have not set theirs and for the code run outside them
+	local bool
+}
+
+func NewParameter(value Object) *Parameter {
+	return &Parameter{value: value}
+}
+
+func (p *Parameter) Value() Object {
+	return p.value
+}
+
+func (p *Parameter) SetValue(val Object) {
+	p.value = val
+}
+
+// valueIn returns the value of the parameter for the code that vm runs.
+func (p *Parameter) valueIn(vm *VM) Object {
+	if p.local && vm.interpreter != nil {
+		if v, ok := vm.interpreter.params[p]; ok {
+			return v
+		}
+	}
+	return p.value
+}
+
+// setValueIn sets the value of the parameter for the code that vm runs.
+func (p *Parameter) setValueIn(vm *VM, v Object) {
+	if p.local && vm.interpreter != nil {
+		vm.interpreter.setParameter(p, v)
+		return
+	}
+	p.value = v
+}
+
+func (p *Parameter) call(vm *VM, args []Object) (Object, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("wrong number of arguments to parameter: expected 0, got %d", len(args))
+	}
+	return p.valueIn(vm), nil
+}
+
+// parameterVariables are the global variables bound to the parameters the
+// system defines, such as *print-length*, which keep being bound to them.
+var parameterVariables = map[*Symbol]*Parameter{}
+
+// defineParameter binds a new parameter to the global variable name.
+// Defining or assigning the variable sets the value of the parameter
+// instead, so that what uses the parameter sees it.
+func defineParameter(name string, value Object) *Parameter {
+	p := NewParameter(value)
+	sym := Intern(name)
+	sym.SetValue(p)
+	parameterVariables[sym] = p
+	return p
+}
+
+func (p *Parameter) convert(vm *VM, v Object) (Object, error) {
+	if p.converter == nil {
+		return v, nil
+	}
+	return vm.apply(p.converter, []Object{v})
+}
+
+// parameterize calls the thunk in args[0] with the parameters in the rest
+// of args rebound to the values following each of them.
+func parameterize(vm *VM, args []Object) (Object, error) {
+	thunk, bindings := args[0], args[1:]
+	params := make([]*Parameter, 0, len(bindings)/2)
+	values := make([]Object, 0, len(bindings)/2)
+	for i := 0; i+1 < len(bindings); i += 2 {
+		p, ok := bindings[i].(*Parameter)
+		if !ok {
+			return nil, fmt.Errorf("parameter expected, but got %s", ToString(bindings[i]))
+		}
+		v, err := p.convert(vm, bindings[i+1])
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+		values = append(values, v)
+	}
+	for i, p := range params {
+		old := p.valueIn(vm)
+		p.setValueIn(vm, values[i])
+		values[i] = old
+	}
+	defer func() {
+		for i := len(params) - 1; i >= 0; i-- {
+			params[i].setValueIn(vm, values[i])
+		}
+	}()
+	return vm.apply(thunk, nil)
+}
+
+// parameterizePrimitive is what parameterize forms are compiled into calls
+// to. It is not bound to any global variable, so that redefining one cannot
+// break them.
+var parameterizePrimitive = NewPrimitive("parameterize", 1, -1, parameterize)
+
+// setParameterPrimitive is what definitions and assignments of the
+// variables in parameterVariables are compiled into calls to.
+var setParameterPrimitive = NewPrimitive("set-parameter!", 2, 2, func(vm *VM, args []Object) (Object, error) {
+	p := args[0].(*Parameter)
+	v, err := p.convert(vm, args[1])
+	if err != nil {
+		return nil, err
+	}
+	p.setValueIn(vm, v)
+	return v, nil
+})
+
+func init() {
+	definePrimitive("make-parameter", 1, 2, func(vm *VM, args []Object) (Object, error) {
+		p := NewParameter(args[0])
+		if len(args) == 2 {
+			p.converter = args[1]
+			v, err := p.convert(vm, args[0])
+			if err != nil {
+				return nil, err
+			}
+			p.value = v
+		}
+		return p, nil
+	})
+}
@@ -0,0 +1,72 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParameterize(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(define par-p (make-parameter 1))", "#<parameter>"},
+		{"(par-p)", "1"},
+		{"(parameterize ((par-p 2)) (par-p))", "2"},
+		{"(parameterize ((par-p 2)) (parameterize ((par-p 3)) (par-p)))", "3"},
+		{"(parameterize ((par-p 2)))", "nil"},
+		{"(par-p)", "1"},
+		{"(try (parameterize ((par-p 2)) (raise 'oops)) (catch e (cons e (par-p))))", "(oops . 1)"},
+		{"(parameterize ((par-p 2)) (try (raise 'oops) (catch e (par-p))))", "2"},
+		{"(try (parameterize ((par-p 2)) (try (raise 'oops) (finally (set! par-log (par-p))))) (catch e (cons par-log (par-p))))", "(2 . 1)"},
+		{"(define par-q (make-parameter 1 (lambda (x) (* x 10))))", "#<parameter>"},
+		{"(par-q)", "10"},
+		{"(parameterize ((par-q 2)) (par-q))", "20"},
+		{"(parameterize ((par-p 2) (par-q 3)) (cons (par-p) (par-q)))", "(2 . 30)"},
+		{"(try (parameterize ((par-p 2) (par-q 'x)) 1) (catch e (par-p)))", "1"},
+		{"(par-p 1)", "error: wrong number of arguments to parameter: expected 0, got 1"},
+		{"(parameterize ((*print-length* 2)) (*print-length*))", "2"},
+		{"(parameterize)", "error: parameterize needs bindings"},
+		{"(parameterize ((par-p)) 1)", "error: parameterize binding must be a list of a parameter and a value"},
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		Intern("par-log").SetValue(nil)
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+	assert.Nil(t, printLength.Value())
+}
+
+func TestSetParameterVariables(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(set! *print-length* 2)", "2"},
+		{"'(1 2 3)", "(1 2 ...)"},
+		{"*print-length*", "#<parameter>"},
+		{"(*print-length*)", "2"},
+		{"(parameterize ((*print-length* 1)) (cons (*print-length*) '(1 2)))", "(1 1 ...)"},
+		{"(parameterize ((*print-length* 1)) (set! *print-length* 3) (*print-length*))", "3"},
+		{"(*print-length*)", "2"},
+		{"(define *print-length* nil)", "nil"},
+		{"'(1 2 3)", "(1 2 3)"},
+		{"((lambda (*print-length*) (set! *print-length* 1) *print-length*) 5)", "1"},
+		{"(set! current-output-port 1)", "error: output port expected, but got 1"},
+		{"(output-port? (current-output-port))", "t"},
+	}
+	defer printLength.SetValue(nil)
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+}
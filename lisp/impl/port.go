@@ -0,0 +1,261 @@
+package lisp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// InputPort is a port that characters and data are read from.
+type InputPort struct {
+	reader *Reader
+	// closer is what close-port closes, if anything
+	closer io.Closer
+}
+
+func NewInputPort(r io.Reader) *InputPort {
+	reader := NewReader(r)
+	// nothing compiles the data read from ports with their positions
+	reader.srcmap = nil
+	return &InputPort{reader: reader}
+}
+
+// ReadChar reads the next character, or returns EOF at the end of input.
+func (p *InputPort) ReadChar() (Object, error) {
+	c, err := p.reader.ReadChar()
+	if err == io.EOF {
+		return EOF, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadLine reads characters up to the end of the line and returns them as a
+// string without the line terminator, or returns EOF at the end of input.
+func (p *InputPort) ReadLine() (Object, error) {
+	var sb strings.Builder
+	for n := 0; ; n++ {
+		c, err := p.reader.ReadChar()
+		if err == io.EOF {
+			if n == 0 {
+				return EOF, nil
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == '\n' {
+			break
+		}
+		sb.WriteRune(c)
+	}
+	return strings.TrimSuffix(sb.String(), "\r"), nil
+}
+
+// Read reads the next datum, or returns EOF at the end of input.
+func (p *InputPort) Read() (Object, error) {
+	obj, err := p.reader.Read()
+	if err == io.EOF {
+		return EOF, nil
+	}
+	return obj, err
+}
+
+// OutputPort is a port that characters are written to.
+type OutputPort struct {
+	writer io.Writer
+	// closer is what close-port closes, if anything
+	closer io.Closer
+}
+
+func NewOutputPort(w io.Writer) *OutputPort {
+	return &OutputPort{writer: w}
+}
+
+func (p *OutputPort) WriteString(s string) error {
+	_, err := io.WriteString(p.writer, s)
+	return err
+}
+
+type eofObject struct{}
+
+// EOF is the object that reading from a port returns at the end of input.
+var EOF Object = &eofObject{}
+
+// The current ports, which the I/O primitives use when they are not given
+// a port. They can be rebound with parameterize. Each interpreter has its
+// own, which are the standard input and output unless the embedder sets
+// them.
+var (
+	currentInputPort  = defineParameter("current-input-port", NewInputPort(os.Stdin))
+	currentOutputPort = defineParameter("current-output-port", NewOutputPort(os.Stdout))
+)
+
+// SetCurrentInputPort makes r the current input port of the interpreter.
+func (in *Interpreter) SetCurrentInputPort(r io.Reader) {
+	in.setParameter(currentInputPort, NewInputPort(r))
+}
+
+// SetCurrentOutputPort makes w the current output port of the
+// interpreter.
+func (in *Interpreter) SetCurrentOutputPort(w io.Writer) {
+	in.setParameter(currentOutputPort, NewOutputPort(w))
+}
+
+func toInputPort(obj Object) (*InputPort, error) {
+	p, ok := obj.(*InputPort)
+	if !ok {
+		return nil, fmt.Errorf("input port expected, but got %s", ToString(obj))
+	}
+	return p, nil
+}
+
+func toOutputPort(obj Object) (*OutputPort, error) {
+	p, ok := obj.(*OutputPort)
+	if !ok {
+		return nil, fmt.Errorf("output port expected, but got %s", ToString(obj))
+	}
+	return p, nil
+}
+
+// inputPortArg returns the port in args[i], or the current input port if
+// the argument is omitted.
+func inputPortArg(vm *VM, args []Object, i int) (*InputPort, error) {
+	if i < len(args) {
+		return toInputPort(args[i])
+	}
+	return toInputPort(currentInputPort.valueIn(vm))
+}
+
+// outputPortArg returns the port in args[i], or the current output port if
+// the argument is omitted.
+func outputPortArg(vm *VM, args []Object, i int) (*OutputPort, error) {
+	if i < len(args) {
+		return toOutputPort(args[i])
+	}
+	return toOutputPort(currentOutputPort.valueIn(vm))
+}
+
+func init() {
+	currentInputPort.local = true
+	currentOutputPort.local = true
+	currentInputPort.converter = NewPrimitive("current-input-port", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		return toInputPort(args[0])
+	})
+	currentOutputPort.converter = NewPrimitive("current-output-port", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		return toOutputPort(args[0])
+	})
+
+	definePrimitive("input-port?", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		_, ok := args[0].(*InputPort)
+		return FromBool(ok), nil
+	})
+	definePrimitive("output-port?", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		_, ok := args[0].(*OutputPort)
+		return FromBool(ok), nil
+	})
+	definePrimitive("eof-object", 0, 0, func(_ *VM, args []Object) (Object, error) {
+		return EOF, nil
+	})
+	definePrimitive("eof-object?", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		return FromBool(args[0] == EOF), nil
+	})
+	definePrimitiveWith(capPorts, "close-port", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		var closer *io.Closer
+		switch port := args[0].(type) {
+		case *InputPort:
+			closer = &port.closer
+		case *OutputPort:
+			closer = &port.closer
+		default:
+			return nil, fmt.Errorf("port expected, but got %s", ToString(args[0]))
+		}
+		// closing a port again has no effect
+		c := *closer
+		*closer = nil
+		if c == nil {
+			return nil, nil
+		}
+		return nil, c.Close()
+	})
+	definePrimitiveWith(capPorts, "display", 1, 2, func(vm *VM, args []Object) (Object, error) {
+		port, err := outputPortArg(vm, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		p := printerFromGlobals()
+		p.Display = true
+		return nil, port.WriteString(p.ToString(args[0]))
+	})
+	definePrimitiveWith(capPorts, "write", 1, 2, func(vm *VM, args []Object) (Object, error) {
+		port, err := outputPortArg(vm, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return nil, port.WriteString(ToString(args[0]))
+	})
+	definePrimitiveWith(capPorts, "newline", 0, 1, func(vm *VM, args []Object) (Object, error) {
+		port, err := outputPortArg(vm, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return nil, port.WriteString("\n")
+	})
+	definePrimitiveWith(capPorts, "read-char", 0, 1, func(vm *VM, args []Object) (Object, error) {
+		port, err := inputPortArg(vm, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return port.ReadChar()
+	})
+	definePrimitiveWith(capPorts, "read-line", 0, 1, func(vm *VM, args []Object) (Object, error) {
+		port, err := inputPortArg(vm, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return port.ReadLine()
+	})
+	definePrimitiveWith(capPorts, "read", 0, 1, func(vm *VM, args []Object) (Object, error) {
+		port, err := inputPortArg(vm, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		if vm.interpreter != nil {
+			port.reader.SetReadtable(vm.interpreter.Readtable())
+		}
+		return port.Read()
+	})
+	definePrimitive("open-input-string", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		s, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return NewInputPort(strings.NewReader(string(s))), nil
+	})
+	definePrimitive("open-output-string", 0, 0, func(_ *VM, args []Object) (Object, error) {
+		return NewOutputPort(&strings.Builder{}), nil
+	})
+	definePrimitive("get-output-string", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		port, err := toOutputPort(args[0])
+		if err != nil {
+			return nil, err
+		}
+		sb, ok := port.writer.(*strings.Builder)
+		if !ok {
+			return nil, fmt.Errorf("string output port expected, but got %s", ToString(args[0]))
+		}
+		return sb.String(), nil
+	})
+	definePrimitive("with-output-to-string", 1, 1, func(vm *VM, args []Object) (Object, error) {
+		var sb strings.Builder
+		_, err := parameterize(vm, []Object{args[0], currentOutputPort, NewOutputPort(&sb)})
+		if err != nil {
+			return nil, err
+		}
+		return sb.String(), nil
+	})
+}
@@ -0,0 +1,114 @@
+package lisp
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputPorts(t *testing.T) {
+	tests := []struct {
+		in     string
+		out    string
+		output string
+	}{
+		{`(display "hello")`, "nil", "hello"},
+		{`(write "hello")`, "nil", `"hello"`},
+		{`(display #\a)`, "nil", "a"},
+		{`(write #\a)`, "nil", `#\a`},
+		{`(display '("a" #\b c 1))`, "nil", "(a b c 1)"},
+		{`(write '("a" #\b c 1))`, "nil", `("a" #\b c 1)`},
+		{`(newline)`, "nil", "\n"},
+		{`(begin (display 1) (newline) (display 2))`, "nil", "1\n2"},
+		{`(parameterize ((*print-length* 2)) (write '(1 2 3)))`, "nil", "(1 2 ...)"},
+		{`(with-output-to-string (lambda () (display "a") (write "b")))`, `"a\"b\""`, ""},
+		{`(with-output-to-string (lambda () 1))`, `""`, ""},
+		{`(begin (with-output-to-string (lambda () (display 1))) (display 2))`, "nil", "2"},
+		{`(try (with-output-to-string (lambda () (raise 'oops))) (catch e (display e)))`, "nil", "oops"},
+		{`((lambda (p) (write 'a p) (display " b" p) (get-output-string p)) (open-output-string))`, `"a b"`, ""},
+		{`((lambda (p) (with-output-to-string (lambda () (display 1 p))) (get-output-string p)) (open-output-string))`, `"1"`, ""},
+		{`(parameterize ((current-output-port (open-output-string))) (display 1) (get-output-string (current-output-port)))`, `"1"`, ""},
+		{`(output-port? (current-output-port))`, "t", ""},
+		{`(output-port? (current-input-port))`, "nil", ""},
+		{`(current-output-port)`, "#<output-port>", ""},
+		{`(display 1 2)`, "error: output port expected, but got 2", ""},
+		{`(get-output-string (current-output-port))`, "error: string output port expected, but got #<output-port>", ""},
+		{`(parameterize ((current-output-port 1)) 2)`, "error: output port expected, but got 1", ""},
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			in.SetCurrentOutputPort(&buf)
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+			assert.Equal(t, tt.output, buf.String(), tt.in)
+		}
+	}
+}
+
+func TestInputPorts(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(read-line)`, `"first line"`},
+		{`(read-char)`, `#\s`},
+		{`(read-line)`, `"econd line"`},
+		{`(read)`, "(a b)"},
+		{`(read)`, "42"},
+		{`(read-line)`, `""`},
+		{`(read-line)`, `"last"`},
+		{`(read-line)`, "#<eof>"},
+		{`(eof-object? (read-char))`, "t"},
+		{`(eof-object? (read))`, "t"},
+		{`(eof-object? (eof-object))`, "t"},
+		{`(eof-object? "")`, "nil"},
+		{`((lambda (p) (vector (read-char p) (read-line p) (read-line p) (read-line p))) (open-input-string "ab\ncd"))`, `#(#\a "b" "cd" #<eof>)`},
+		{`(read (open-input-string "(1 . 2) 3"))`, "(1 . 2)"},
+		{`(input-port? (open-input-string ""))`, "t"},
+		{`(input-port? (current-output-port))`, "nil"},
+		{`(read-char (current-output-port))`, "error: input port expected, but got #<output-port>"},
+	}
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		in := NewInterpreter()
+		in.SetEngine(engine)
+		in.SetCurrentInputPort(strings.NewReader("first line\nsecond line\n(a b) 42\nlast"))
+		for _, tt := range tests {
+			out, _ := evalIn(in, tt.in)
+			assert.Equal(t, tt.out, out, tt.in)
+		}
+	}
+}
+
+func TestPortsPerInterpreter(t *testing.T) {
+	var bufA, bufB bytes.Buffer
+	a, b := NewInterpreter(), NewInterpreter()
+	a.SetCurrentOutputPort(&bufA)
+	b.SetCurrentOutputPort(&bufB)
+	a.SetCurrentInputPort(strings.NewReader("from-a"))
+	b.SetCurrentInputPort(strings.NewReader("from-b"))
+	p, err := NewGoFunc("port-run-b", func(input string) string {
+		out, _ := evalIn(b, input)
+		return out
+	})
+	assert.NoError(t, err)
+	Intern("port-run-b").SetValue(p)
+	defer Intern("port-run-b").Unbind()
+
+	out, _ := evalIn(a, `(begin (display "a") (port-run-b "(display 'b)"))`)
+	assert.Equal(t, `"nil"`, out)
+	out, _ = evalIn(a, `(with-output-to-string (lambda () (display 1) (port-run-b "(display 2)")))`)
+	assert.Equal(t, `"1"`, out)
+	out, _ = evalIn(a, `(cons (read) (port-run-b "(read)"))`)
+	assert.Equal(t, `(from-a . "from-b")`, out)
+	assert.Equal(t, "a", bufA.String())
+	assert.Equal(t, "b2", bufB.String())
+
+	// the code run outside interpreters uses the standard ports
+	assert.Equal(t, os.Stdout, currentOutputPort.Value().(*OutputPort).writer)
+}
@@ -0,0 +1,68 @@
+package lisp
+
+import "fmt"
+
+// Pos is a position in source code. Lines and columns count from 1.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// SourceMap records where the lists read by a Reader started. The
+// positions of a form are forgotten once a compiler has compiled it.
+type SourceMap map[*Cons]Pos
+
+func (sm SourceMap) PosOf(obj Object) Pos {
+	if c, ok := obj.(*Cons); ok {
+		return sm[c]
+	}
+	return Pos{}
+}
+
+// forget removes the positions of the lists in obj, which are no longer
+// needed after obj has been compiled.
+func (sm SourceMap) forget(obj Object) {
+	if len(sm) == 0 {
+		return
+	}
+	// literals may be cyclic
+	seen := map[*Cons]bool{}
+	var walk func(obj Object)
+	walk = func(obj Object) {
+		for {
+			switch o := obj.(type) {
+			case *Cons:
+				if seen[o] {
+					return
+				}
+				seen[o] = true
+				delete(sm, o)
+				walk(o.car)
+				obj = o.cdr
+			case *Vector:
+				for _, elem := range o.elems {
+					walk(elem)
+				}
+				return
+			default:
+				return
+			}
+		}
+	}
+	walk(obj)
+}
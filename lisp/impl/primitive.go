@@ -0,0 +1,288 @@
+package lisp
+
+import "fmt"
+
+// Primitive is a built-in function implemented in Go. It takes at least
+// minArgs arguments, and at most maxArgs unless maxArgs is negative.
+type Primitive struct {
+	name    string
+	minArgs int
+	maxArgs int
+	fn      func(vm *VM, args []Object) (Object, error)
+	// capability is what the interpreter must grant to call it
+	capability capability
+}
+
+// applicable is implemented by the objects other than functions that can
+// be called like them.
+type applicable interface {
+	call(vm *VM, args []Object) (Object, error)
+}
+
+func NewPrimitive(name string, minArgs, maxArgs int, fn func(*VM, []Object) (Object, error)) *Primitive {
+	return &Primitive{name: name, minArgs: minArgs, maxArgs: maxArgs, fn: fn}
+}
+
+func (p *Primitive) Name() string {
+	return p.name
+}
+
+func (p *Primitive) call(vm *VM, args []Object) (Object, error) {
+	if vm.interpreter != nil && !vm.interpreter.permits(p) {
+		return nil, fmt.Errorf("permission denied: %s", p.name)
+	}
+	nargs := len(args)
+	if nargs < p.minArgs || (p.maxArgs >= 0 && nargs > p.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments to %s: expected %s, got %d", p.name, p.arity(), nargs)
+	}
+	return p.fn(vm, args)
+}
+
+func arityString(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("at least %d", min)
+	case min == max:
+		return fmt.Sprint(min)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
+	}
+}
+
+func (p *Primitive) arity() string {
+	return arityString(p.minArgs, p.maxArgs)
+}
+
+// definePrimitive binds a primitive to the global variable of the same name.
+func definePrimitive(name string, minArgs, maxArgs int, fn func(*VM, []Object) (Object, error)) {
+	Intern(name).SetValue(NewPrimitive(name, minArgs, maxArgs, fn))
+}
+
+// definePrimitiveWith is definePrimitive for primitives needing cap to be
+// called.
+func definePrimitiveWith(cap capability, name string, minArgs, maxArgs int, fn func(*VM, []Object) (Object, error)) {
+	p := NewPrimitive(name, minArgs, maxArgs, fn)
+	p.capability = cap
+	Intern(name).SetValue(p)
+}
+
+func toCons(obj Object) (*Cons, error) {
+	c, ok := obj.(*Cons)
+	if !ok {
+		return nil, fmt.Errorf("cons expected, but got %s", ToString(obj))
+	}
+	return c, nil
+}
+
+func toVector(obj Object) (*Vector, error) {
+	v, ok := obj.(*Vector)
+	if !ok {
+		return nil, fmt.Errorf("vector expected, but got %s", ToString(obj))
+	}
+	return v, nil
+}
+
+func toChar(obj Object) (rune, error) {
+	c, ok := obj.(rune)
+	if !ok {
+		return 0, fmt.Errorf("character expected, but got %s", ToString(obj))
+	}
+	return c, nil
+}
+
+func toMutableString(obj Object) (*MutableString, error) {
+	switch s := obj.(type) {
+	case *MutableString:
+		return s, nil
+	case string:
+		return nil, fmt.Errorf("cannot mutate immutable string %s", ToString(s))
+	default:
+		return nil, fmt.Errorf("string expected, but got %s", ToString(obj))
+	}
+}
+
+func toRunes(obj Object) ([]rune, error) {
+	switch s := obj.(type) {
+	case *MutableString:
+		return s.runes, nil
+	case string:
+		return []rune(s), nil
+	default:
+		return nil, fmt.Errorf("string expected, but got %s", ToString(obj))
+	}
+}
+
+func toIndex(obj Object, length int) (int, error) {
+	k, err := ToNumber(obj)
+	if err != nil {
+		return 0, err
+	}
+	if k < 0 || k >= length {
+		return 0, fmt.Errorf("index out of range: %d", k)
+	}
+	return k, nil
+}
+
+func toLength(obj Object) (int, error) {
+	n, err := ToNumber(obj)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative length: %d", n)
+	}
+	return n, nil
+}
+
+func init() {
+	definePrimitive("eq?", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		return FromBool(args[0] == args[1]), nil
+	})
+
+	definePrimitive("set-car!", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		c, err := toCons(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.car = args[1]
+		return nil, nil
+	})
+	definePrimitive("set-cdr!", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		c, err := toCons(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.cdr = args[1]
+		return nil, nil
+	})
+
+	definePrimitive("vector", 0, -1, func(_ *VM, args []Object) (Object, error) {
+		return NewVector(append([]Object(nil), args...)), nil
+	})
+	definePrimitive("make-vector", 1, 2, func(_ *VM, args []Object) (Object, error) {
+		n, err := toLength(args[0])
+		if err != nil {
+			return nil, err
+		}
+		elems := make([]Object, n)
+		if len(args) > 1 {
+			for i := range elems {
+				elems[i] = args[1]
+			}
+		}
+		return NewVector(elems), nil
+	})
+	definePrimitive("vector-length", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		v, err := toVector(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return len(v.elems), nil
+	})
+	definePrimitive("vector-ref", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		v, err := toVector(args[0])
+		if err != nil {
+			return nil, err
+		}
+		k, err := toIndex(args[1], len(v.elems))
+		if err != nil {
+			return nil, err
+		}
+		return v.elems[k], nil
+	})
+	definePrimitive("vector-set!", 3, 3, func(_ *VM, args []Object) (Object, error) {
+		v, err := toVector(args[0])
+		if err != nil {
+			return nil, err
+		}
+		k, err := toIndex(args[1], len(v.elems))
+		if err != nil {
+			return nil, err
+		}
+		v.elems[k] = args[2]
+		return nil, nil
+	})
+	definePrimitive("vector-fill!", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		v, err := toVector(args[0])
+		if err != nil {
+			return nil, err
+		}
+		for i := range v.elems {
+			v.elems[i] = args[1]
+		}
+		return nil, nil
+	})
+
+	definePrimitive("make-string", 1, 2, func(_ *VM, args []Object) (Object, error) {
+		n, err := toLength(args[0])
+		if err != nil {
+			return nil, err
+		}
+		fill := ' '
+		if len(args) > 1 {
+			if fill, err = toChar(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		runes := make([]rune, n)
+		for i := range runes {
+			runes[i] = fill
+		}
+		return &MutableString{runes}, nil
+	})
+	definePrimitive("string-copy", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		runes, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &MutableString{append([]rune(nil), runes...)}, nil
+	})
+	definePrimitive("string-length", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		runes, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return len(runes), nil
+	})
+	definePrimitive("string-ref", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		runes, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		k, err := toIndex(args[1], len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return runes[k], nil
+	})
+	definePrimitive("string-set!", 3, 3, func(_ *VM, args []Object) (Object, error) {
+		s, err := toMutableString(args[0])
+		if err != nil {
+			return nil, err
+		}
+		k, err := toIndex(args[1], len(s.runes))
+		if err != nil {
+			return nil, err
+		}
+		c, err := toChar(args[2])
+		if err != nil {
+			return nil, err
+		}
+		s.runes[k] = c
+		return nil, nil
+	})
+	definePrimitive("string-fill!", 2, 2, func(_ *VM, args []Object) (Object, error) {
+		s, err := toMutableString(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c, err := toChar(args[1])
+		if err != nil {
+			return nil, err
+		}
+		for i := range s.runes {
+			s.runes[i] = c
+		}
+		return nil, nil
+	})
+}
@@ -0,0 +1,97 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func run(input string) (Object, error) {
+	obj, err := ReadFromString(input)
+	if err != nil {
+		return nil, err
+	}
+	code, err := Compile(obj)
+	if err != nil {
+		return nil, err
+	}
+	return NewVM(code).Run()
+}
+
+func TestMutationPrimitives(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(begin (define c (cons 1 2)) (set-car! c 3) c)", "(3 . 2)"},
+		{"(begin (define c (cons 1 2)) (set-cdr! c (cons 4 nil)) c)", "(1 4)"},
+		{"(begin (define c (cons 1 nil)) (set-cdr! c c) c)", "#1=(1 . #1#)"},
+		{"(vector 1 2 3)", "#(1 2 3)"},
+		{"#(1 #(2) \"three\")", `#(1 #(2) "three")`},
+		{"(make-vector 2 'x)", "#(x x)"},
+		{"(vector-length (make-vector 3))", "3"},
+		{"(vector-ref #(1 2 3) 1)", "2"},
+		{"(begin (define v (vector 1 2 3)) (vector-set! v 0 'a) v)", "#(a 2 3)"},
+		{"(begin (define v (vector 1 2)) (vector-fill! v 0) v)", "#(0 0)"},
+		{"(make-string 3 #\\a)", `"aaa"`},
+		{"(string-length \"foo\")", "3"},
+		{"(string-ref \"foo\" 1)", "#\\o"},
+		{"(string-ref \"a b\" 1)", "#\\space"},
+		{"(begin (define s (string-copy \"foo\")) (string-set! s 0 #\\b) s)", `"boo"`},
+		{"(begin (define s (make-string 2)) (string-fill! s #\\z) s)", `"zz"`},
+		{"(begin (define c (cons 1 2)) (eq? c c))", "t"},
+		{"(eq? (cons 1 2) (cons 1 2))", "nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := run(tt.in)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.out, ToString(v))
+		})
+	}
+}
+
+func TestMutationPrimitiveErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"(set-car! 1 2)", "cons expected, but got 1"},
+		{"(set-car! (cons 1 2))", "wrong number of arguments to set-car!: expected 2, got 1"},
+		{"(vector-ref #(1 2) 2)", "index out of range: 2"},
+		{"(string-set! \"foo\" 0 #\\b)", `cannot mutate immutable string "foo"`},
+		{"(string-set! (string-copy \"foo\") 0 1)", "character expected, but got 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := run(tt.in)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestLiteralsAreNotShared(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"(begin (define f (lambda () '(1 2))) (set-car! (f) 99) (f))", "(1 2)"},
+		{"(begin (define f (lambda () #(1 2))) (vector-set! (f) 0 99) (f))", "#(1 2)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := run(tt.in)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.out, ToString(v))
+		})
+	}
+
+	code, err := Compile(&Cons{Intern("quote"), &Cons{&Cons{1, nil}, nil}})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		v, err := NewVM(code).Run()
+		assert.Nil(t, err)
+		v.(*Cons).car = 99
+		assert.Equal(t, &Cons{1, nil}, code[0].operands[0])
+	}
+}
@@ -0,0 +1,397 @@
+package lisp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultRightMargin = 80
+
+// Parameters controlling how ToString prints objects, which can be
+// rebound with parameterize. A nil limit means no limit.
+var (
+	printLength      = defineParameter("*print-length*", nil)
+	printLevel       = defineParameter("*print-level*", nil)
+	printShared      = defineParameter("*print-shared*", nil)
+	printPretty      = defineParameter("*print-pretty*", nil)
+	printRightMargin = defineParameter("*print-right-margin*", defaultRightMargin)
+)
+
+// Printer converts objects to their textual representation.
+//
+// Cyclic structure is always printed with datum labels (#1=, #1#) so that
+// printing terminates. If Shared is set, any cons or vector reachable more
+// than once is labelled as well. Length and Level cut off long and deeply
+// nested lists when they are non-negative, and Pretty breaks lists that do
+// not fit in Width columns over multiple lines. Display prints strings and
+// characters as their contents rather than as they are written in code.
+type Printer struct {
+	Length  int
+	Level   int
+	Shared  bool
+	Pretty  bool
+	Width   int
+	Display bool
+}
+
+func NewPrinter() *Printer {
+	return &Printer{Length: -1, Level: -1, Width: defaultRightMargin}
+}
+
+func intOr(obj Object, n int) int {
+	if i, ok := obj.(int); ok {
+		return i
+	}
+	return n
+}
+
+// printerFromGlobals makes a printer configured by the *print-...*
+// parameters.
+func printerFromGlobals() *Printer {
+	return &Printer{
+		Length: intOr(printLength.value, -1),
+		Level:  intOr(printLevel.value, -1),
+		Shared: ToBool(printShared.value),
+		Pretty: ToBool(printPretty.value),
+		Width:  intOr(printRightMargin.value, defaultRightMargin),
+	}
+}
+
+// pnode is an intermediate representation of a printed object, which is
+// rendered either on a single line or laid out by the pretty printer.
+type pnode struct {
+	text   string
+	prefix string
+	elems  []*pnode
+	tail   *pnode
+	width  int
+}
+
+func (n *pnode) isList() bool {
+	return n.prefix != ""
+}
+
+type printState struct {
+	*Printer
+	labels  map[Object]int
+	printed map[Object]bool
+	next    int
+}
+
+func isCompound(obj Object) bool {
+	switch obj.(type) {
+	case *Cons, *Vector:
+		return true
+	default:
+		return false
+	}
+}
+
+// findLabels marks the conses and vectors that need datum labels: those on
+// a cycle, and with shared set, those reachable more than once.
+func findLabels(obj Object, shared bool) map[Object]int {
+	labels := map[Object]int{}
+	visited := map[Object]bool{}
+	onPath := map[Object]bool{}
+	var visit func(Object)
+	visit = func(obj Object) {
+		var spine []Object
+		for isCompound(obj) {
+			if visited[obj] {
+				if onPath[obj] || shared {
+					labels[obj] = 0
+				}
+				break
+			}
+			visited[obj] = true
+			onPath[obj] = true
+			spine = append(spine, obj)
+			switch o := obj.(type) {
+			case *Cons:
+				visit(o.car)
+				obj = o.cdr
+			case *Vector:
+				for _, elem := range o.elems {
+					visit(elem)
+				}
+				obj = nil
+			}
+		}
+		for _, obj := range spine {
+			delete(onPath, obj)
+		}
+	}
+	visit(obj)
+	return labels
+}
+
+func (p *Printer) ToString(obj Object) string {
+	state := &printState{Printer: p, printed: map[Object]bool{}, next: 1}
+	if isCompound(obj) {
+		state.labels = findLabels(obj, p.Shared)
+	}
+	n := state.build(obj, 0)
+	if !p.Pretty {
+		return n.flat()
+	}
+	var sb strings.Builder
+	p.layout(&sb, n, 0)
+	return sb.String()
+}
+
+func textNode(s string) *pnode {
+	return &pnode{text: s, width: utf8.RuneCountInString(s)}
+}
+
+func (s *printState) build(obj Object, depth int) *pnode {
+	if !isCompound(obj) {
+		return textNode(s.atom(obj))
+	}
+	if s.Level >= 0 && depth >= s.Level {
+		return textNode("#")
+	}
+	prefix := ""
+	if _, ok := s.labels[obj]; ok {
+		if s.printed[obj] {
+			return textNode(fmt.Sprintf("#%d#", s.labels[obj]))
+		}
+		s.labels[obj] = s.next
+		prefix = fmt.Sprintf("#%d=", s.next)
+		s.next++
+	}
+	s.printed[obj] = true
+	var n *pnode
+	if v, ok := obj.(*Vector); ok {
+		n = &pnode{prefix: prefix + "#("}
+		for _, elem := range v.elems {
+			if s.Length >= 0 && len(n.elems) >= s.Length {
+				n.elems = append(n.elems, textNode("..."))
+				break
+			}
+			n.elems = append(n.elems, s.build(elem, depth+1))
+		}
+	} else {
+		n = s.buildList(obj.(*Cons), prefix+"(", depth)
+	}
+	n.width = utf8.RuneCountInString(n.prefix) + 1
+	if len(n.elems) > 0 {
+		n.width += len(n.elems) - 1
+	}
+	for _, elem := range n.elems {
+		n.width += elem.width
+	}
+	if n.tail != nil {
+		n.width += 3 + n.tail.width
+	}
+	return n
+}
+
+func (s *printState) buildList(c *Cons, prefix string, depth int) *pnode {
+	n := &pnode{prefix: prefix}
+	for {
+		if s.Length >= 0 && len(n.elems) >= s.Length {
+			n.elems = append(n.elems, textNode("..."))
+			break
+		}
+		n.elems = append(n.elems, s.build(c.car, depth+1))
+		next, ok := c.cdr.(*Cons)
+		if !ok {
+			if c.cdr != nil {
+				n.tail = s.build(c.cdr, depth+1)
+			}
+			break
+		}
+		if _, labelled := s.labels[next]; labelled {
+			n.tail = s.build(next, depth+1)
+			break
+		}
+		s.printed[next] = true
+		c = next
+	}
+	return n
+}
+
+func (n *pnode) flat() string {
+	if !n.isList() {
+		return n.text
+	}
+	var sb strings.Builder
+	n.writeFlat(&sb)
+	return sb.String()
+}
+
+func (n *pnode) writeFlat(sb *strings.Builder) {
+	if !n.isList() {
+		sb.WriteString(n.text)
+		return
+	}
+	sb.WriteString(n.prefix)
+	for i, elem := range n.elems {
+		if i > 0 {
+			sb.WriteRune(' ')
+		}
+		elem.writeFlat(sb)
+	}
+	if n.tail != nil {
+		sb.WriteString(" . ")
+		n.tail.writeFlat(sb)
+	}
+	sb.WriteRune(')')
+}
+
+// specialIndents tells how many arguments of each special form stay on the
+// line of the operator. The rest of the form is indented by two columns.
+var specialIndents = map[string]int{
+	"lambda": 1,
+	"define": 1,
+	"set!":   1,
+	"begin":  0,
+	"let":    1,
+	"letrec": 1,
+}
+
+func newline(sb *strings.Builder, col int) int {
+	sb.WriteRune('\n')
+	sb.WriteString(strings.Repeat(" ", col))
+	return col
+}
+
+// layout writes n starting at column col and returns the column where the
+// output ends.
+func (p *Printer) layout(sb *strings.Builder, n *pnode, col int) int {
+	if !n.isList() || len(n.elems) == 0 || col+n.width <= p.Width {
+		n.writeFlat(sb)
+		return col + n.width
+	}
+	sb.WriteString(n.prefix)
+	open := col + utf8.RuneCountInString(n.prefix)
+	elems := n.elems
+	cur := p.layout(sb, elems[0], open)
+	indent := open
+	if head := elems[0]; !head.isList() && len(elems) > 1 {
+		if k, ok := specialIndents[head.text]; ok {
+			if k >= len(elems) {
+				k = len(elems) - 1
+			}
+			for _, elem := range elems[1 : 1+k] {
+				sb.WriteRune(' ')
+				cur = p.layout(sb, elem, cur+1)
+			}
+			elems = elems[1+k:]
+			indent = col + 2
+		} else {
+			sb.WriteRune(' ')
+			indent = cur + 1
+			cur = p.layout(sb, elems[1], indent)
+			elems = elems[2:]
+		}
+	} else {
+		elems = elems[1:]
+	}
+	for _, elem := range elems {
+		cur = p.layout(sb, elem, newline(sb, indent))
+	}
+	if n.tail != nil {
+		newline(sb, indent)
+		sb.WriteString(". ")
+		cur = p.layout(sb, n.tail, indent+2)
+	}
+	sb.WriteRune(')')
+	return cur + 1
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteRune('"')
+	for _, c := range s {
+		switch c {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	sb.WriteRune('"')
+	return sb.String()
+}
+
+func charToString(c rune) string {
+	for name, named := range charNames {
+		if c == named {
+			return "#\\" + name
+		}
+	}
+	return "#\\" + string(c)
+}
+
+func (p *Printer) atom(obj Object) string {
+	if p.Display {
+		switch obj := obj.(type) {
+		case rune:
+			return string(obj)
+		case string:
+			return obj
+		case *MutableString:
+			return obj.String()
+		}
+	}
+	return atomToString(obj)
+}
+
+func atomToString(obj Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if !obj {
+			break
+		}
+		return "t"
+	case int:
+		return strconv.Itoa(obj)
+	case rune:
+		return charToString(obj)
+	case string:
+		return quoteString(obj)
+	case *MutableString:
+		return quoteString(obj.String())
+	case *Symbol:
+		return obj.name
+	case *Func:
+		return fmt.Sprintf("#<func %s/%d>", obj.Name(), obj.Arity())
+	case *Primitive:
+		return fmt.Sprintf("#<primitive %s>", obj.name)
+	case *Parameter:
+		return "#<parameter>"
+	case *InputPort:
+		return "#<input-port>"
+	case *OutputPort:
+		return "#<output-port>"
+	case *eofObject:
+		return "#<eof>"
+	case *Condition:
+		s := "#<error " + quoteString(obj.message)
+		for _, irritant := range obj.irritants {
+			s += " " + ToString(irritant)
+		}
+		return s + ">"
+	}
+	// host values that reach Lisp print unreadably with their Go types
+	return fmt.Sprintf("#<%T %v>", obj, obj)
+}
+
+// PrettyString lays out obj to fit in width columns where possible.
+func PrettyString(obj Object, width int) string {
+	p := printerFromGlobals()
+	p.Pretty = true
+	p.Width = width
+	return p.ToString(obj)
+}
@@ -0,0 +1,131 @@
+package lisp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func list(elems ...Object) Object {
+	var ret Object
+	for i := len(elems) - 1; i >= 0; i-- {
+		ret = &Cons{elems[i], ret}
+	}
+	return ret
+}
+
+func TestPrinterLimits(t *testing.T) {
+	tree := list(1, list(2, list(3, list(4))), 5, 6)
+	tests := []struct {
+		title  string
+		length int
+		level  int
+		out    string
+	}{
+		{"no limits", -1, -1, "(1 (2 (3 (4))) 5 6)"},
+		{"length 2", 2, -1, "(1 (2 (3 (4))) ...)"},
+		{"length 1", 1, -1, "(1 ...)"},
+		{"level 0", -1, 0, "#"},
+		{"level 2", -1, 2, "(1 (2 #) 5 6)"},
+		{"both", 1, 2, "(1 ...)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			p := NewPrinter()
+			p.Length = tt.length
+			p.Level = tt.level
+			assert.Equal(t, tt.out, p.ToString(tree))
+		})
+	}
+}
+
+func TestPrinterHostValues(t *testing.T) {
+	tests := []struct {
+		in  Object
+		out string
+	}{
+		{1.5, "#<float64 1.5>"},
+		{false, "#<bool false>"},
+		{marshalPoint{1, 2}, "#<lisp.marshalPoint {1 2}>"},
+		{[]int{1, 2}, "#<[]int [1 2]>"},
+		{list(1, map[string]int{"a": 1}), "(1 #<map[string]int map[a:1]>)"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, ToString(tt.in))
+		assert.Equal(t, tt.out, PrettyString(tt.in, 80))
+	}
+}
+
+func TestPrinterLabels(t *testing.T) {
+	circular := &Cons{1, &Cons{2, nil}}
+	circular.cdr.(*Cons).cdr = circular
+	selfRef := &Cons{1, nil}
+	selfRef.car = selfRef
+	shared := list(3)
+	sharing := list(shared, shared)
+	nested := &Cons{Intern("a"), nil}
+	nested.cdr = &Cons{nested, nil}
+	circularVector := NewVector([]Object{1, nil})
+	circularVector.elems[1] = circularVector
+
+	tests := []struct {
+		title  string
+		in     Object
+		shared bool
+		out    string
+	}{
+		{"circular cdr", circular, false, "#1=(1 2 . #1#)"},
+		{"circular car", selfRef, false, "#1=(#1#)"},
+		{"cycle through car", nested, false, "#1=(a #1#)"},
+		{"shared without labels", sharing, false, "((3) (3))"},
+		{"shared with labels", sharing, true, "(#1=(3) #1#)"},
+		{"tail sharing", list(list(1, 2), list(1, 2)), true, "((1 2) (1 2))"},
+		{"circular vector", circularVector, false, "#1=#(1 #1#)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			p := NewPrinter()
+			p.Shared = tt.shared
+			assert.Equal(t, tt.out, p.ToString(tt.in))
+		})
+	}
+}
+
+func TestPrinterGlobals(t *testing.T) {
+	defer printLength.SetValue(nil)
+	printLength.SetValue(2)
+	assert.Equal(t, "(1 2 ...)", ToString(list(1, 2, 3)))
+}
+
+func TestPrettyString(t *testing.T) {
+	fact, err := ReadFromString(`
+(define fact
+  (lambda (n)
+    (if (= n 0) 1 (* n (fact (- n 1))))))`)
+	assert.Nil(t, err)
+	tests := []struct {
+		width int
+		out   string
+	}{
+		{80, "(define fact (lambda (n) (if (= n 0) 1 (* n (fact (- n 1))))))"},
+		{
+			40,
+			`(define fact
+  (lambda (n)
+    (if (= n 0) 1 (* n (fact (- n 1))))))`,
+		},
+		{
+			30,
+			`(define fact
+  (lambda (n)
+    (if (= n 0)
+        1
+        (* n (fact (- n 1))))))`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.out, func(t *testing.T) {
+			assert.Equal(t, tt.out, PrettyString(fact, tt.width))
+		})
+	}
+}
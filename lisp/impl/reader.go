@@ -3,26 +3,47 @@ package lisp
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
-var delimiters = map[rune]bool{
-	'(':  true,
-	')':  true,
-	'\'': true,
-	'"':  true,
-	'.':  true,
-}
-
 type Reader struct {
-	reader *bufio.Reader
+	reader    *bufio.Reader
+	readtable *Readtable
+	pos       Pos
+	prevPos   Pos
+	srcmap    SourceMap
 }
 
 func NewReader(reader io.Reader) *Reader {
-	return &Reader{bufio.NewReader(reader)}
+	return &Reader{
+		reader:    bufio.NewReader(reader),
+		readtable: StandardReadtable(),
+		pos:       Pos{Line: 1, Col: 1},
+		srcmap:    SourceMap{},
+	}
+}
+
+// SetFilename sets the file name recorded in the positions of data read
+// from now on.
+func (r *Reader) SetFilename(name string) {
+	r.pos.File = name
+}
+
+func (r *Reader) SourceMap() SourceMap {
+	return r.srcmap
+}
+
+func (r *Reader) Readtable() *Readtable {
+	return r.readtable
+}
+
+func (r *Reader) SetReadtable(rt *Readtable) {
+	r.readtable = rt
 }
 
 func (r *Reader) readRune() (rune, error) {
@@ -30,6 +51,13 @@ func (r *Reader) readRune() (rune, error) {
 	if err != nil {
 		return 0, err
 	}
+	r.prevPos = r.pos
+	if c == '\n' {
+		r.pos.Line++
+		r.pos.Col = 1
+	} else {
+		r.pos.Col++
+	}
 	return c, nil
 }
 
@@ -38,6 +66,13 @@ func (r *Reader) unread() {
 	if err != nil {
 		panic(err)
 	}
+	r.pos = r.prevPos
+}
+
+func (r *Reader) discard(n int) {
+	for i := 0; i < n; i++ {
+		r.readRune()
+	}
 }
 
 func (r *Reader) peekRune() (rune, error) {
@@ -49,6 +84,16 @@ func (r *Reader) peekRune() (rune, error) {
 	return c, nil
 }
 
+// ReadChar consumes and returns the next character. Along with PeekChar,
+// it lets reader macros scan input that is not made up of data.
+func (r *Reader) ReadChar() (rune, error) {
+	return r.readRune()
+}
+
+func (r *Reader) PeekChar() (rune, error) {
+	return r.peekRune()
+}
+
 func (r *Reader) readWhile(pred func(rune) bool) (string, error) {
 	var sb strings.Builder
 	for {
@@ -83,8 +128,67 @@ func (r *Reader) dropWhile(pred func(rune) bool) error {
 	}
 }
 
+// startsWith reports whether the upcoming input begins with prefix without
+// consuming it.
+func (r *Reader) startsWith(prefix string) bool {
+	bs, err := r.reader.Peek(len(prefix))
+	return err == nil && string(bs) == prefix
+}
+
+func (r *Reader) skipLineComment() error {
+	return r.dropWhile(func(c rune) bool { return c != '\n' })
+}
+
+func (r *Reader) skipBlockComment() error {
+	// discards preceding "#|"
+	r.discard(2)
+	depth := 1
+	for depth > 0 {
+		switch {
+		case r.startsWith("#|"):
+			r.discard(2)
+			depth++
+		case r.startsWith("|#"):
+			r.discard(2)
+			depth--
+		default:
+			if _, err := r.readRune(); err != nil {
+				return wrapErr(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Reader) skipDatumComment() error {
+	// discards preceding "#;"
+	r.discard(2)
+	_, err := r.Read()
+	return wrapErr(err)
+}
+
+// skipWhitespaces skips whitespaces as well as line comments (; ...),
+// block comments (#| ... |#) and datum comments (#; <datum>).
 func (r *Reader) skipWhitespaces() error {
-	return r.dropWhile(unicode.IsSpace)
+	for {
+		if err := r.dropWhile(unicode.IsSpace); err != nil {
+			return err
+		}
+		var err error
+		switch {
+		case r.startsWith(";"):
+			err = r.skipLineComment()
+		case r.startsWith("#|"):
+			err = r.skipBlockComment()
+		case r.startsWith("#;"):
+			err = r.skipDatumComment()
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 func (r *Reader) readNumber(negative bool) (Object, error) {
@@ -127,8 +231,11 @@ func (r *Reader) readSymbol() (Object, error) {
 			return r.readNumber(true)
 		}
 	}
+	// dots delimit symbols except for the ones starting with dots, such as
+	// the ellipsis ...
+	dotted := c == '.'
 	name, err := r.readWhile(func(c rune) bool {
-		return !delimiters[c] && !unicode.IsSpace(c)
+		return (c == '.' && dotted || !r.readtable.isDelimiter(c)) && !unicode.IsSpace(c)
 	})
 	if err != nil {
 		return nil, err
@@ -151,30 +258,32 @@ func wrapErr(err error) error {
 	return err
 }
 
-func (r *Reader) readList() (Object, error) {
-	// discards preceding '('
-	r.readRune()
+// readList reads elements up to close, the opening character having been
+// consumed already. Dotted pairs are accepted only if allowDot is set.
+func (r *Reader) readList(close rune, allowDot bool) (Object, error) {
 	var elems []Object
 	var improper Object
 	for {
-		r.skipWhitespaces()
+		if err := r.skipWhitespaces(); err != nil {
+			return nil, err
+		}
 		c, err := r.peekRune()
 		if err != nil {
 			return nil, wrapErr(err)
 		}
-		switch c {
-		case ')':
+		switch {
+		case c == close:
 			r.readRune()
 			var ret Object = improper
 			for i := range elems {
 				ret = NewCons(elems[len(elems)-i-1], ret)
 			}
 			return ret, nil
-		case '.':
+		case allowDot && r.atDot():
 			r.readRune()
 			improper, err = r.Read()
 			if err != nil {
-				return nil, err
+				return nil, wrapErr(err)
 			}
 		default:
 			elem, err := r.Read()
@@ -189,6 +298,26 @@ func (r *Reader) readList() (Object, error) {
 	}
 }
 
+// atDot reports whether the next character is a dot standing alone, as in
+// dotted pairs, rather than the start of a symbol such as ...
+func (r *Reader) atDot() bool {
+	b, _ := r.reader.Peek(2)
+	if len(b) == 0 || b[0] != '.' {
+		return false
+	}
+	if len(b) == 1 {
+		return true
+	}
+	c := rune(b[1])
+	return c < utf8.RuneSelf && c != '.' && (unicode.IsSpace(c) || r.readtable.isDelimiter(c))
+}
+
+// ReadDelimitedList reads data up to close and returns them as a list. It
+// is meant to be called from reader macros for bracketing syntax.
+func (r *Reader) ReadDelimitedList(close rune) (Object, error) {
+	return r.readList(close, false)
+}
+
 func (r *Reader) Read() (Object, error) {
 	err := r.skipWhitespaces()
 	if err != nil {
@@ -196,28 +325,50 @@ func (r *Reader) Read() (Object, error) {
 	}
 	c, err := r.peekRune()
 	if err != nil {
-		return nil, wrapErr(err)
+		return nil, err
+	}
+	pos := r.pos
+	if fn, ok := r.readtable.macros[c]; ok {
+		r.readRune()
+		obj, err := fn(r, c)
+		if err != nil {
+			return nil, err
+		}
+		r.record(obj, pos)
+		return obj, nil
 	}
 	switch {
 	case unicode.IsDigit(c):
 		return r.readNumber(false)
-	case c == '(':
-		return r.readList()
-	case c == ')':
-		return nil, errors.New("unexpected )")
-	case c == '\'':
-		r.readRune()
-		obj, err := r.Read()
+	case c == '#':
+		obj, err := r.readDispatch()
 		if err != nil {
 			return nil, err
 		}
-		return &Cons{Intern("quote"), &Cons{obj, nil}}, nil
+		r.record(obj, pos)
+		return obj, nil
+	case c != '.' && r.readtable.isDelimiter(c):
+		return nil, fmt.Errorf("unexpected %c", c)
 	default:
 		return r.readSymbol()
 	}
 }
 
+// record remembers pos as the position of obj if it is a list whose
+// position is not known yet.
+func (r *Reader) record(obj Object, pos Pos) {
+	if r.srcmap == nil {
+		return
+	}
+	if c, ok := obj.(*Cons); ok {
+		if _, seen := r.srcmap[c]; !seen {
+			r.srcmap[c] = pos
+		}
+	}
+}
+
 func ReadFromString(input string) (Object, error) {
 	r := NewReader(strings.NewReader(input))
+	r.srcmap = nil
 	return r.Read()
 }
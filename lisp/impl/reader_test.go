@@ -1,6 +1,8 @@
 package lisp
 
 import (
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,6 +23,8 @@ func TestReadFromString(t *testing.T) {
 		{"(1 . 2)", &Cons{1, 2}},
 		{"(+ 1 2)", &Cons{Intern("+"), &Cons{1, &Cons{2, nil}}}},
 		{"(1 2 3 . 4)", &Cons{1, &Cons{2, &Cons{3, 4}}}},
+		{"...", Intern("...")},
+		{"(x ... . y)", &Cons{Intern("x"), &Cons{Intern("..."), Intern("y")}}},
 		{
 			"(+ (* 3 3) (* 4 4))",
 			&Cons{
@@ -33,6 +37,11 @@ func TestReadFromString(t *testing.T) {
 		},
 		{"'foo", &Cons{Intern("quote"), &Cons{Intern("foo"), nil}}},
 		{"'(1 2)", &Cons{Intern("quote"), &Cons{&Cons{1, &Cons{2, nil}}, nil}}},
+		{"#(1 foo)", &Vector{[]Object{1, Intern("foo")}}},
+		{"#()", &Vector{nil}},
+		{"#\\a", 'a'},
+		{"#\\newline", '\n'},
+		{"(#\\( #\\))", &Cons{'(', &Cons{')', nil}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.in, func(t *testing.T) {
@@ -42,3 +51,115 @@ func TestReadFromString(t *testing.T) {
 		})
 	}
 }
+
+func TestReadComments(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Object
+	}{
+		{"; comment\n42", 42},
+		{"foo; comment", Intern("foo")},
+		{"(1 ; one\n 2)", &Cons{1, &Cons{2, nil}}},
+		{"#| block |# 42", 42},
+		{"#| outer #| inner |# still outer |# 42", 42},
+		{"(1 #| two |# 3)", &Cons{1, &Cons{3, nil}}},
+		{"#;(ignored form) 42", 42},
+		{"(1 #;2 3)", &Cons{1, &Cons{3, nil}}},
+		{"(1 #;2)", &Cons{1, nil}},
+		{"(1 #; #;2 3 4)", &Cons{1, &Cons{4, nil}}},
+		{"(1 . #;2 3)", &Cons{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			obj, err := ReadFromString(tt.in)
+			assert.Equal(t, tt.out, obj)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestReadCommentErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err error
+	}{
+		{"; only a comment", io.EOF},
+		{"#| only a comment |#", io.EOF},
+		{"#| unterminated", io.ErrUnexpectedEOF},
+		{"#;", io.ErrUnexpectedEOF},
+		{"(1 #| unterminated", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := ReadFromString(tt.in)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestReadMultipleForms(t *testing.T) {
+	input := `; a file with several forms
+(define x 1) #| block
+comment |#
+#;(define y 2)
+(define z 3) ; trailing comment
+`
+	r := NewReader(strings.NewReader(input))
+	var forms []Object
+	for {
+		obj, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		forms = append(forms, obj)
+	}
+	assert.Equal(t, []Object{
+		&Cons{Intern("define"), &Cons{Intern("x"), &Cons{1, nil}}},
+		&Cons{Intern("define"), &Cons{Intern("z"), &Cons{3, nil}}},
+	}, forms)
+}
+
+func TestReaderSourceMap(t *testing.T) {
+	r := NewReader(strings.NewReader("(a\n  (b c)\n  '(d))"))
+	r.SetFilename("test.lisp")
+	obj, err := r.Read()
+	assert.Nil(t, err)
+	elems, _, _ := ListToSlice(obj)
+	sm := r.SourceMap()
+	assert.Equal(t, Pos{"test.lisp", 1, 1}, sm.PosOf(obj))
+	assert.Equal(t, Pos{"test.lisp", 2, 3}, sm.PosOf(elems[1]))
+	assert.Equal(t, Pos{"test.lisp", 3, 3}, sm.PosOf(elems[2]))
+	assert.Equal(t, "test.lisp:2:3", sm.PosOf(elems[1]).String())
+	assert.False(t, sm.PosOf(elems[0]).IsValid())
+}
+
+func TestSourceMapForgotten(t *testing.T) {
+	r := NewReader(strings.NewReader("(define f (lambda (x) '(x #((y)))))\n(f 1)"))
+	c := NewCompiler()
+	c.SetSourceMap(r.SourceMap())
+	for {
+		obj, err := r.Read()
+		if err != nil {
+			break
+		}
+		assert.NotEmpty(t, r.SourceMap())
+		_, err = c.Compile(obj)
+		assert.Nil(t, err)
+		assert.Empty(t, r.SourceMap())
+	}
+
+	cyclic := &Cons{1, nil}
+	cyclic.cdr = cyclic
+	sm := SourceMap{cyclic: {Line: 1, Col: 1}}
+	c.SetSourceMap(sm)
+	_, err := c.Compile(&Cons{Intern("quote"), &Cons{cyclic, nil}})
+	assert.Nil(t, err)
+	assert.Empty(t, sm)
+
+	// nothing compiles the data read from ports
+	port := NewInputPort(strings.NewReader("(a (b))"))
+	_, err = port.Read()
+	assert.Nil(t, err)
+	assert.Empty(t, port.reader.SourceMap())
+}
@@ -0,0 +1,253 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ReaderMacro reads an object for the syntax introduced by c. The macro
+// character itself (or, for dispatch macros, the character following '#')
+// has already been consumed when the function is called.
+type ReaderMacro func(r *Reader, c rune) (Object, error)
+
+// Readtable maps characters to the reader functions used to parse them.
+// Characters bound with SetMacro also terminate symbols, as do characters
+// registered with SetDelimiter.
+type Readtable struct {
+	macros     map[rune]ReaderMacro
+	dispatch   map[rune]ReaderMacro
+	delimiters map[rune]bool
+}
+
+func NewReadtable() *Readtable {
+	return &Readtable{
+		macros:     map[rune]ReaderMacro{},
+		dispatch:   map[rune]ReaderMacro{},
+		delimiters: map[rune]bool{},
+	}
+}
+
+// StandardReadtable returns a fresh copy of the readtable readers use by
+// default.
+func StandardReadtable() *Readtable {
+	rt := NewReadtable()
+	rt.SetMacro('(', readList)
+	rt.SetMacro('\'', readQuote)
+	rt.SetMacro('"', readString)
+	rt.SetDispatchMacro('(', readVector)
+	rt.SetDispatchMacro('\\', readChar)
+	rt.SetDelimiter(')')
+	rt.SetDelimiter('.')
+	rt.SetDelimiter(';')
+	return rt
+}
+
+func (rt *Readtable) Copy() *Readtable {
+	ret := NewReadtable()
+	for c, fn := range rt.macros {
+		ret.macros[c] = fn
+	}
+	for c, fn := range rt.dispatch {
+		ret.dispatch[c] = fn
+	}
+	for c := range rt.delimiters {
+		ret.delimiters[c] = true
+	}
+	return ret
+}
+
+func (rt *Readtable) SetMacro(c rune, fn ReaderMacro) {
+	rt.macros[c] = fn
+	rt.delimiters[c] = true
+}
+
+// SetDispatchMacro binds fn to the two-character sequence #c.
+func (rt *Readtable) SetDispatchMacro(c rune, fn ReaderMacro) {
+	rt.dispatch[c] = fn
+}
+
+// SetDelimiter makes c terminate symbols and numbers, which is typically
+// needed for the closing character of a bracketing macro.
+func (rt *Readtable) SetDelimiter(c rune) {
+	rt.delimiters[c] = true
+}
+
+func (rt *Readtable) isDelimiter(c rune) bool {
+	return rt.delimiters[c]
+}
+
+// LispReaderMacro makes a reader macro out of a Lisp function. The macro
+// reads the next datum and replaces it with the result of applying fn to it
+// in the interpreter in.
+func LispReaderMacro(in *Interpreter, fn Object) ReaderMacro {
+	return func(r *Reader, _ rune) (Object, error) {
+		obj, err := r.Read()
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		return in.Apply(fn, []Object{obj})
+	}
+}
+
+// LispListReaderMacro makes a bracketing reader macro out of a Lisp
+// function. The macro reads data up to close and replaces them with the
+// result of applying fn to the list of them in the interpreter in.
+func LispListReaderMacro(in *Interpreter, close rune, fn Object) ReaderMacro {
+	return func(r *Reader, _ rune) (Object, error) {
+		list, err := r.ReadDelimitedList(close)
+		if err != nil {
+			return nil, err
+		}
+		return in.Apply(fn, []Object{list})
+	}
+}
+
+func readList(r *Reader, _ rune) (Object, error) {
+	return r.readList(')', true)
+}
+
+func readQuote(r *Reader, _ rune) (Object, error) {
+	obj, err := r.Read()
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return &Cons{Intern("quote"), &Cons{obj, nil}}, nil
+}
+
+var stringEscapes = map[rune]rune{
+	'"':  '"',
+	'\\': '\\',
+	'n':  '\n',
+	't':  '\t',
+}
+
+func readString(r *Reader, _ rune) (Object, error) {
+	var sb strings.Builder
+	for {
+		c, err := r.readRune()
+		if err != nil {
+			return nil, wrapErr(err)
+		}
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			c, err = r.readRune()
+			if err != nil {
+				return nil, wrapErr(err)
+			}
+			escaped, ok := stringEscapes[c]
+			if !ok {
+				return nil, fmt.Errorf("unknown escape sequence: \\%c", c)
+			}
+			sb.WriteRune(escaped)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+}
+
+func readVector(r *Reader, _ rune) (Object, error) {
+	list, err := r.ReadDelimitedList(')')
+	if err != nil {
+		return nil, err
+	}
+	elems, _, _ := ListToSlice(list)
+	return NewVector(elems), nil
+}
+
+var charNames = map[string]rune{
+	"space":   ' ',
+	"newline": '\n',
+	"tab":     '\t',
+}
+
+func readChar(r *Reader, _ rune) (Object, error) {
+	c, err := r.readRune()
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	rest, err := r.readWhile(func(c rune) bool {
+		return !r.readtable.isDelimiter(c) && !unicode.IsSpace(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rest == "" {
+		return c, nil
+	}
+	name := string(c) + rest
+	if c, ok := charNames[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown character name: #\\%s", name)
+}
+
+func (r *Reader) readDispatch() (Object, error) {
+	// discards preceding '#'
+	r.readRune()
+	c, err := r.readRune()
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	fn, ok := r.readtable.dispatch[c]
+	if !ok {
+		return nil, fmt.Errorf("no dispatch macro defined for #%c", c)
+	}
+	return fn(r, c)
+}
+
+// readtableOf returns the readtable of the interpreter running vm, which
+// the reader macros defined in Lisp are applied in.
+func readtableOf(vm *VM) (*Readtable, error) {
+	if vm.interpreter == nil {
+		return nil, errors.New("no interpreter to define reader macros for")
+	}
+	return vm.interpreter.Readtable(), nil
+}
+
+func init() {
+	definePrimitive("set-reader-macro!", 2, 2, func(vm *VM, args []Object) (Object, error) {
+		rt, err := readtableOf(vm)
+		if err != nil {
+			return nil, err
+		}
+		c, err := toChar(args[0])
+		if err != nil {
+			return nil, err
+		}
+		rt.SetMacro(c, LispReaderMacro(vm.interpreter, args[1]))
+		return nil, nil
+	})
+	definePrimitive("set-dispatch-reader-macro!", 2, 2, func(vm *VM, args []Object) (Object, error) {
+		rt, err := readtableOf(vm)
+		if err != nil {
+			return nil, err
+		}
+		c, err := toChar(args[0])
+		if err != nil {
+			return nil, err
+		}
+		rt.SetDispatchMacro(c, LispReaderMacro(vm.interpreter, args[1]))
+		return nil, nil
+	})
+	definePrimitive("set-list-reader-macro!", 3, 3, func(vm *VM, args []Object) (Object, error) {
+		rt, err := readtableOf(vm)
+		if err != nil {
+			return nil, err
+		}
+		open, err := toChar(args[0])
+		if err != nil {
+			return nil, err
+		}
+		close, err := toChar(args[1])
+		if err != nil {
+			return nil, err
+		}
+		rt.SetMacro(open, LispListReaderMacro(vm.interpreter, close, args[2]))
+		rt.SetDelimiter(close)
+		return nil, nil
+	})
+}
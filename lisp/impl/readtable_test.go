@@ -0,0 +1,176 @@
+package lisp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func evalString(t *testing.T, input string) Object {
+	obj, err := ReadFromString(input)
+	assert.Nil(t, err)
+	code, err := Compile(obj)
+	assert.Nil(t, err)
+	v, err := NewVM(code).Run()
+	assert.Nil(t, err)
+	return v
+}
+
+func readHex(r *Reader, _ rune) (Object, error) {
+	var digits strings.Builder
+	for {
+		c, err := r.PeekChar()
+		if err != nil || !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			break
+		}
+		r.ReadChar()
+		digits.WriteRune(c)
+	}
+	n, err := strconv.ParseInt(digits.String(), 16, 0)
+	if err != nil {
+		return nil, err
+	}
+	return int(n), nil
+}
+
+func readRegexp(r *Reader, _ rune) (Object, error) {
+	if c, err := r.ReadChar(); err != nil || c != 'e' {
+		return nil, errors.New("#re must be followed by a string")
+	}
+	obj, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	return &Cons{Intern("regexp"), &Cons{obj, nil}}, nil
+}
+
+func readMap(r *Reader, _ rune) (Object, error) {
+	elems, err := r.ReadDelimitedList('}')
+	if err != nil {
+		return nil, err
+	}
+	return &Cons{Intern("hash-map"), elems}, nil
+}
+
+func TestReadtable(t *testing.T) {
+	rt := StandardReadtable()
+	rt.SetDispatchMacro('x', readHex)
+	rt.SetDispatchMacro('r', readRegexp)
+	rt.SetMacro('{', readMap)
+	rt.SetDelimiter('}')
+	in := NewInterpreter()
+	rt.SetDispatchMacro('!', LispReaderMacro(in, evalString(t, "(lambda (x) (cons 'tagged x))")))
+	rt.SetMacro('[', LispListReaderMacro(in, ']', evalString(t, "(lambda (xs) (cons 'vec xs))")))
+	rt.SetDelimiter(']')
+
+	tests := []struct {
+		in  string
+		out Object
+	}{
+		{`"foo"`, "foo"},
+		{`"say \"hi\"\n"`, "say \"hi\"\n"},
+		{`("a" "b")`, &Cons{"a", &Cons{"b", nil}}},
+		{"#x1F", 31},
+		{"(+ #xff 1)", &Cons{Intern("+"), &Cons{255, &Cons{1, nil}}}},
+		{`#re"a+b"`, &Cons{Intern("regexp"), &Cons{"a+b", nil}}},
+		{
+			"{a 1 b 2}",
+			&Cons{Intern("hash-map"), &Cons{Intern("a"), &Cons{1, &Cons{Intern("b"), &Cons{2, nil}}}}},
+		},
+		{"#!foo", &Cons{Intern("tagged"), Intern("foo")}},
+		{"[1 2]", &Cons{Intern("vec"), &Cons{1, &Cons{2, nil}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.in))
+			r.SetReadtable(rt)
+			obj, err := r.Read()
+			assert.Equal(t, tt.out, obj)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestLispReaderMacros(t *testing.T) {
+	defineMacros := func(profile Profile) *Interpreter {
+		in := NewInterpreter()
+		in.SetProfile(profile)
+		in.SetCurrentOutputPort(&strings.Builder{})
+		for _, def := range []string{
+			`(set-dispatch-reader-macro! #\! (lambda (x) (cons 'tagged x)))`,
+			`(set-reader-macro! #\^ (lambda (x) (cons 'square (cons x '()))))`,
+			`(set-list-reader-macro! #\[ #\] (lambda (xs) (cons 'vec xs)))`,
+			`(set-dispatch-reader-macro! #\o (lambda (x) (display x) x))`,
+		} {
+			out, _ := evalIn(in, def)
+			assert.Equal(t, "nil", out)
+		}
+		return in
+	}
+	readIn := func(in *Interpreter, input string) string {
+		obj, err := in.NewReader(strings.NewReader(input)).Read()
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return ToString(obj)
+	}
+
+	tests := []struct {
+		in   string
+		out  string
+		pure string
+	}{
+		{"#!foo", "(tagged . foo)", "(tagged . foo)"},
+		{"(f ^x)", "(f (square x))", "(f (square x))"},
+		{"[1 ^2]", "(vec 1 (square 2))", "(vec 1 (square 2))"},
+		// the macros run in the interpreter defining them, under its profile
+		{"#ofoo", "foo", "error: permission denied: display"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			in := defineMacros(FullProfile)
+			assert.Equal(t, tt.out, readIn(in, tt.in))
+			out, _ := evalIn(in, fmt.Sprintf("(read (open-input-string %q))", tt.in))
+			assert.Equal(t, tt.out, out)
+			assert.Equal(t, tt.pure, readIn(defineMacros(PureProfile), tt.in))
+		})
+	}
+	assert.Equal(t, "error: no dispatch macro defined for #!", readIn(NewInterpreter(), "#!foo"))
+}
+
+func TestReadtableErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{")", "unexpected )"},
+		{"#x1F", "no dispatch macro defined for #x"},
+		{`"unterminated`, "unexpected EOF"},
+		{`"\q"`, "unknown escape sequence: \\q"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := ReadFromString(tt.in)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestReadtableCopy(t *testing.T) {
+	rt := StandardReadtable()
+	copied := rt.Copy()
+	copied.SetDispatchMacro('x', readHex)
+	r := NewReader(strings.NewReader("#x10"))
+	r.SetReadtable(rt)
+	_, err := r.Read()
+	assert.NotNil(t, err)
+	r = NewReader(strings.NewReader("#x10"))
+	r.SetReadtable(copied)
+	obj, err := r.Read()
+	assert.Equal(t, 16, obj)
+	assert.Nil(t, err)
+}
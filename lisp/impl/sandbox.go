@@ -0,0 +1,134 @@
+package lisp
+
+import "fmt"
+
+// capability is what a primitive needs to be granted to be called.
+type capability int
+
+const (
+	// capPure primitives affect nothing outside the interpreter.
+	capPure capability = iota
+	// capPorts primitives read from and write to ports, including the
+	// standard input and output.
+	capPorts
+	capReadFiles
+	capWriteFiles
+	// capGo primitives call Go functions of the embedder, which can do
+	// anything.
+	capGo
+)
+
+// Profile is a named set of capabilities that an interpreter grants to
+// the primitives it calls. Denied primitives stay bound, but calling them
+// fails.
+type Profile int
+
+const (
+	// FullProfile allows all the primitives.
+	FullProfile Profile = iota
+	// PureProfile allows only the primitives that affect nothing outside
+	// the interpreter.
+	PureProfile
+	// IOReadOnlyProfile allows reading and writing ports and reading
+	// files, but not creating or deleting them. Neither this nor
+	// PureProfile allows the Go functions defined by the embedder.
+	IOReadOnlyProfile
+)
+
+var profileNames = []string{
+	FullProfile:       "full",
+	PureProfile:       "pure",
+	IOReadOnlyProfile: "io-readonly",
+}
+
+// ParseProfile returns the profile named name.
+func ParseProfile(name string) (Profile, error) {
+	for p, n := range profileNames {
+		if n == name {
+			return Profile(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown profile: %s", name)
+}
+
+func (p Profile) String() string {
+	return profileNames[p]
+}
+
+func (p Profile) grants(cap capability) bool {
+	switch p {
+	case PureProfile:
+		return cap == capPure
+	case IOReadOnlyProfile:
+		return cap == capPure || cap == capPorts || cap == capReadFiles
+	default:
+		return true
+	}
+}
+
+// SetProfile sets the profile deciding which primitives the interpreter
+// may call. The primitives allowed or denied by name are not affected.
+// An interpreter denied any primitives cannot define or assign the global
+// variables that the host or the other interpreters have.
+func (in *Interpreter) SetProfile(p Profile) {
+	in.profile = p
+}
+
+// Allow lets the interpreter call the primitives named names whatever its
+// profile is.
+func (in *Interpreter) Allow(names ...string) {
+	in.setPermissions(names, true)
+}
+
+// Deny keeps the interpreter from calling the primitives named names
+// whatever its profile is.
+func (in *Interpreter) Deny(names ...string) {
+	in.setPermissions(names, false)
+}
+
+func (in *Interpreter) setPermissions(names []string, allowed bool) {
+	if in.permissions == nil {
+		in.permissions = map[string]bool{}
+	}
+	for _, name := range names {
+		in.permissions[name] = allowed
+	}
+}
+
+// restricted reports whether the interpreter is denied any primitives.
+func (in *Interpreter) restricted() bool {
+	if in.profile != FullProfile {
+		return true
+	}
+	for _, allowed := range in.permissions {
+		if !allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// assignGlobal defines or assigns the global variable sym to v for the
+// interpreter running vm. Restricted interpreters can define new variables
+// and assign the ones they defined, but not the primitives or the
+// variables of the other interpreters, which could then call the functions
+// put there with more permissions.
+func assignGlobal(vm *VM, sym *Symbol, v Object, define bool) error {
+	in := vm.interpreter
+	if in != nil && in.restricted() && sym.bound && sym.owner != in {
+		if define {
+			return fmt.Errorf("permission denied: define %s", sym.name)
+		}
+		return fmt.Errorf("permission denied: set! %s", sym.name)
+	}
+	sym.SetValue(v)
+	sym.owner = in
+	return nil
+}
+
+func (in *Interpreter) permits(p *Primitive) bool {
+	if allowed, ok := in.permissions[p.name]; ok {
+		return allowed
+	}
+	return in.profile.grants(p.capability)
+}
@@ -0,0 +1,142 @@
+package lisp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	tests := []struct {
+		in   string
+		pure string
+		ro   string
+		full string
+	}{
+		{`(vector-length (vector 1 2))`, "2", "2", "2"},
+		{`(with-output-to-string (lambda () 1))`, `""`, `""`, `""`},
+		{`(with-output-to-string (lambda () (display 1)))`, "error: permission denied: display", `"1"`, `"1"`},
+		{`(read (open-input-string "x"))`, "error: permission denied: read", "x", "x"},
+		{`(file-exists? "data.txt")`, "error: permission denied: file-exists?", "t", "t"},
+		{`(close-port (open-output-file "new.txt"))`, "error: permission denied: open-output-file", "error: permission denied: open-output-file", "nil"},
+		{`(delete-file "new.txt")`, "error: permission denied: delete-file", "error: permission denied: delete-file", "nil"},
+		{`((lambda (f) (f "new.txt")) open-output-file)`, "error: permission denied: open-output-file", "error: permission denied: open-output-file", "#<output-port>"},
+		{`(try (open-output-file "new.txt") (catch e (error-message e)))`, `"permission denied: open-output-file"`, `"permission denied: open-output-file"`, "#<output-port>"},
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.txt"), nil, 0644))
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		for _, profile := range []Profile{PureProfile, IOReadOnlyProfile, FullProfile} {
+			in := NewInterpreter()
+			in.SetEngine(engine)
+			in.SetFileSystem(NewDirFS(dir))
+			in.SetProfile(profile)
+			for _, tt := range tests {
+				expected := map[Profile]string{PureProfile: tt.pure, IOReadOnlyProfile: tt.ro, FullProfile: tt.full}[profile]
+				out, _ := evalIn(in, tt.in)
+				assert.Equal(t, expected, out, "%s: %s", profile, tt.in)
+			}
+		}
+	}
+}
+
+func TestAllowAndDeny(t *testing.T) {
+	dir := t.TempDir()
+	in := NewInterpreter()
+	in.SetFileSystem(NewDirFS(dir))
+	in.SetProfile(PureProfile)
+	in.Allow("open-output-file", "close-port")
+	in.Deny("vector")
+	out, _ := evalIn(in, `(close-port (open-output-file "new.txt"))`)
+	assert.Equal(t, "nil", out)
+	out, _ = evalIn(in, `(delete-file "new.txt")`)
+	assert.Equal(t, "error: permission denied: delete-file", out)
+	out, _ = evalIn(in, `(vector 1)`)
+	assert.Equal(t, "error: permission denied: vector", out)
+
+	in.SetProfile(FullProfile)
+	in.Deny("open-output-file")
+	out, _ = evalIn(in, `(open-output-file "new.txt")`)
+	assert.Equal(t, "error: permission denied: open-output-file", out)
+	out, _ = evalIn(in, `(delete-file "new.txt")`)
+	assert.Equal(t, "nil", out)
+
+	// interpreters sharing the global variables keep their own permissions
+	trusted := NewInterpreter()
+	trusted.SetFileSystem(NewDirFS(dir))
+	out, _ = evalIn(trusted, `(define sandbox-open open-output-file)`)
+	assert.Equal(t, "#<primitive open-output-file>", out)
+	out, _ = evalIn(trusted, `(close-port (sandbox-open "new.txt"))`)
+	assert.Equal(t, "nil", out)
+	out, _ = evalIn(in, `(sandbox-open "new.txt")`)
+	assert.Equal(t, "error: permission denied: open-output-file", out)
+}
+
+func TestRestrictedAssignment(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{`(define sandbox-square (lambda (x) (* x x)))`, "#<func sandbox-square/1>"},
+		{`(sandbox-square 3)`, "9"},
+		{`(set! sandbox-square (lambda (x) (+ x x)))`, "#<func lambda/1>"},
+		{`(sandbox-square 3)`, "6"},
+		{`(define sandbox-square 1)`, "1"},
+		{`(set! sandbox-shared (lambda (x) (display "pwned")))`, "error: permission denied: set! sandbox-shared"},
+		{`(define sandbox-shared (lambda (x) (display "pwned")))`, "error: permission denied: define sandbox-shared"},
+		{`((lambda (f) (f 1)) (lambda (x) (set! sandbox-shared x)))`, "error: permission denied: set! sandbox-shared"},
+		{`(try (set! sandbox-shared 1) (catch e (error-message e)))`, `"permission denied: set! sandbox-shared"`},
+		{`sandbox-shared`, "0"},
+		{`(define display (lambda (x) x))`, "error: permission denied: define display"},
+		{`(set! vector-length 1)`, "error: permission denied: set! vector-length"},
+		{`(module (sandbox mod) (export f) (define f (lambda () 1)) (set! f (lambda () 2)))`, "(sandbox mod)"},
+		{`(begin (import (sandbox mod)) (f))`, "2"},
+		{`((lambda (x) (set! x 2) x) 1)`, "2"},
+	}
+	trusted := NewInterpreter()
+	out, _ := evalIn(trusted, `(define sandbox-shared 0)`)
+	require.Equal(t, "0", out)
+	for _, engine := range []Engine{SECDEngine, ClosureEngine} {
+		for _, restrict := range []func(*Interpreter){
+			func(in *Interpreter) { in.SetProfile(PureProfile) },
+			func(in *Interpreter) { in.Deny("display") },
+		} {
+			Intern("sandbox-square").Unbind()
+			in := NewInterpreter()
+			in.SetEngine(engine)
+			restrict(in)
+			for _, tt := range tests {
+				out, _ := evalIn(in, tt.in)
+				assert.Equal(t, tt.out, out, tt.in)
+			}
+			// the variables defined by a sandbox are its own
+			out, _ = evalIn(NewInterpreter(), `(define sandbox-square 2)`)
+			assert.Equal(t, "2", out)
+			out, _ = evalIn(in, `(set! sandbox-square 3)`)
+			assert.Equal(t, "error: permission denied: set! sandbox-square", out)
+		}
+	}
+	out, _ = evalIn(trusted, `sandbox-shared`)
+	assert.Equal(t, "0", out)
+	assert.Equal(t, "#<primitive display>", ToString(Intern("display").value))
+	Intern("sandbox-square").Unbind()
+
+	// allowing primitives keeps the interpreter unrestricted
+	in := NewInterpreter()
+	in.Allow("display")
+	out, _ = evalIn(in, `(define sandbox-defined 1)`)
+	assert.Equal(t, "1", out)
+}
+
+func TestParseProfile(t *testing.T) {
+	for _, p := range []Profile{PureProfile, IOReadOnlyProfile, FullProfile} {
+		parsed, err := ParseProfile(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseProfile("admin")
+	assert.EqualError(t, err, "unknown profile: admin")
+}
@@ -1,8 +1,18 @@
 package lisp
 
+import "fmt"
+
+// Symbol doubles as the global variable of the same name. A symbol is
+// unbound until a value is set, which is distinct from being bound to nil.
 type Symbol struct {
-	name string
+	name  string
 	value Object
+	bound bool
+	// alias is the symbol a macro expansion renamed into this one
+	alias *Symbol
+	// owner is the interpreter that assigned the value last, or nil for
+	// the values set by the host, such as primitives
+	owner *Interpreter
 }
 
 var symbolTable = map[string]*Symbol{}
@@ -16,6 +26,72 @@ func Intern(name string) *Symbol {
 	return sym
 }
 
+// NewSymbol returns an uninterned symbol, which is distinct from every other
+// symbol even if they have the same name.
+func NewSymbol(name string) *Symbol {
+	return &Symbol{name: name}
+}
+
+var gensymCounter int
+
+// Gensym returns a new uninterned symbol named prefix followed by a number.
+func Gensym(prefix string) *Symbol {
+	gensymCounter++
+	return NewSymbol(fmt.Sprintf("%s%d", prefix, gensymCounter))
+}
+
+func (sym *Symbol) IsInterned() bool {
+	return symbolTable[sym.name] == sym
+}
+
+// original returns the symbol that macro expansions renamed into sym, or
+// sym itself if it was not renamed.
+func (sym *Symbol) original() *Symbol {
+	for sym.alias != nil {
+		sym = sym.alias
+	}
+	return sym
+}
+
 func (sym *Symbol) SetValue(val Object) {
 	sym.value = val
+	sym.bound = true
+	sym.owner = nil
+}
+
+func (sym *Symbol) IsBound() bool {
+	return sym.bound
+}
+
+func (sym *Symbol) Unbind() {
+	sym.value = nil
+	sym.bound = false
+	sym.owner = nil
+}
+
+func init() {
+	definePrimitive("gensym", 0, 1, func(_ *VM, args []Object) (Object, error) {
+		if len(args) == 0 {
+			return Gensym("g"), nil
+		}
+		prefix, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return Gensym(string(prefix)), nil
+	})
+	definePrimitive("make-symbol", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		name, err := toRunes(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return NewSymbol(string(name)), nil
+	})
+	definePrimitive("symbol-name", 1, 1, func(_ *VM, args []Object) (Object, error) {
+		sym, ok := args[0].(*Symbol)
+		if !ok {
+			return nil, fmt.Errorf("symbol expected, but got %s", ToString(args[0]))
+		}
+		return sym.name, nil
+	})
 }
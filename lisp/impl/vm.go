@@ -1,6 +1,10 @@
 package lisp
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
 
 type PC int
 type Stack []Object
@@ -15,11 +19,14 @@ type VM struct {
 	code  Code
 	dump  Dump
 	pc    PC
-}
+	fn    *Func
 
-type SelDumpEntry struct {
-	code Code
-	pc   PC
+	interrupted *int32
+	// callers returns the calls the VM was started from, if any
+	callers func() []*Func
+	// interpreter is the one running the VM, if any, which decides what
+	// the primitives may access
+	interpreter *Interpreter
 }
 
 type ApDumpEntry struct {
@@ -27,10 +34,85 @@ type ApDumpEntry struct {
 	env   *Env
 	code  Code
 	pc    PC
+	fn    *Func
+}
+
+type HandlerDumpEntry struct {
+	stack   Stack
+	env     *Env
+	code    Code
+	pc      PC
+	fn      *Func
+	handler *Func
+}
+
+type WindDumpEntry struct {
+	after *Func
 }
 
 func NewVM(code Code) *VM {
-	return &VM{code: code}
+	return &VM{code: code, interrupted: new(int32)}
+}
+
+// Interrupt asks the running VM to abort at the next instruction boundary.
+// It is safe to call from another goroutine.
+func (vm *VM) Interrupt() {
+	atomic.StoreInt32(vm.interrupted, 1)
+}
+
+// error attaches the backtrace to err unless it already has one, as errors
+// from functions run by child VMs do.
+func (vm *VM) error(err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{err, vm.backtrace()}
+}
+
+func frameName(fn *Func) string {
+	if fn == nil {
+		return "<toplevel>"
+	}
+	if fn.info.pos.IsValid() {
+		return fmt.Sprintf("%s (%s)", ToString(fn), fn.info.pos)
+	}
+	return ToString(fn)
+}
+
+const maxBacktraceDepth = 20
+
+// backtraceOf describes the calls to fns, innermost first, where nil
+// stands for the top level.
+func backtraceOf(fns []*Func) []string {
+	var trace []string
+	for i, fn := range fns {
+		if i == maxBacktraceDepth {
+			trace = append(trace, fmt.Sprintf("... (%d more frames)", len(fns)-i))
+			break
+		}
+		trace = append(trace, frameName(fn))
+	}
+	return trace
+}
+
+// calls returns the functions being called, innermost first, followed by
+// the calls the VM was started from.
+func (vm *VM) calls() []*Func {
+	fns := []*Func{vm.fn}
+	for i := len(vm.dump) - 1; i >= 0; i-- {
+		if entry, ok := vm.dump[i].(*ApDumpEntry); ok {
+			fns = append(fns, entry.fn)
+		}
+	}
+	if vm.callers != nil {
+		// the top level of the VM is just the call from the callers
+		fns = append(fns[:len(fns)-1], vm.callers()...)
+	}
+	return fns
+}
+
+func (vm *VM) backtrace() []string {
+	return backtraceOf(vm.calls())
 }
 
 func (vm *VM) fetchInsn() (*Insn, bool) {
@@ -90,8 +172,38 @@ func (vm *VM) logicalOp(op func(int, int) bool) error {
 	})
 }
 
+// Run executes the code until it finishes. Errors raised while running are
+// passed to the innermost handler installed by TRY, running the cleanups
+// installed by WIND on the way. Errors nobody handles are returned along
+// with the backtrace at the point they were raised. Panics are not errors
+// but bugs, such as malformed code, and are left to propagate; the
+// primitives return errors instead, as the ones made by NewGoFunc do for
+// the panics in Go functions.
 func (vm *VM) Run() (Object, error) {
 	for {
+		v, err := vm.run()
+		if err == nil {
+			return v, nil
+		}
+		if errors.Is(err, ErrInterrupted) {
+			return nil, vm.error(err)
+		}
+		lerr := vm.error(err)
+		handled, err := vm.unwind(raisedValue(err))
+		if err != nil {
+			return nil, vm.error(err)
+		}
+		if !handled {
+			return nil, lerr
+		}
+	}
+}
+
+func (vm *VM) run() (Object, error) {
+	for {
+		if atomic.LoadInt32(vm.interrupted) != 0 {
+			return nil, ErrInterrupted
+		}
 		insn, ok := vm.fetchInsn()
 		if !ok {
 			break
@@ -100,12 +212,15 @@ func (vm *VM) Run() (Object, error) {
 		case NIL:
 			vm.push(nil)
 		case LDC:
-			vm.push(insn.operands[0])
+			vm.push(copyLiteral(insn.operands[0]))
 		case LD:
 			loc := insn.operands[0].(*Location)
 			vm.push(vm.env.Locate(loc))
 		case LDG:
 			sym := insn.operands[0].(*Symbol)
+			if !sym.bound {
+				return nil, fmt.Errorf("unbound variable: %s", sym.name)
+			}
 			vm.push(sym.value)
 		case SV:
 			loc := insn.operands[0].(*Location)
@@ -114,8 +229,20 @@ func (vm *VM) Run() (Object, error) {
 			vm.push(obj)
 		case SVG:
 			sym := insn.operands[0].(*Symbol)
+			if !sym.bound {
+				return nil, fmt.Errorf("cannot set! unbound variable: %s", sym.name)
+			}
 			obj := vm.pop()
-			sym.SetValue(obj)
+			if err := assignGlobal(vm, sym, obj, false); err != nil {
+				return nil, err
+			}
+			vm.push(obj)
+		case DEF:
+			sym := insn.operands[0].(*Symbol)
+			obj := vm.pop()
+			if err := assignGlobal(vm, sym, obj, true); err != nil {
+				return nil, err
+			}
 			vm.push(obj)
 		case POP:
 			vm.pop()
@@ -144,38 +271,76 @@ func (vm *VM) Run() (Object, error) {
 			}
 			vm.push(cdr)
 		case ADD:
-			vm.arithOp(func(x, y int) int { return x + y })
+			if err := vm.arithOp(func(x, y int) int { return x + y }); err != nil {
+				return nil, err
+			}
 		case SUB:
-			vm.arithOp(func(x, y int) int { return x - y })
+			if err := vm.arithOp(func(x, y int) int { return x - y }); err != nil {
+				return nil, err
+			}
 		case MUL:
-			vm.arithOp(func(x, y int) int { return x * y })
+			if err := vm.arithOp(func(x, y int) int { return x * y }); err != nil {
+				return nil, err
+			}
 		case DIV:
-			vm.arithOp(func(x, y int) int { return x / y })
+			if len(vm.stack) > 0 && vm.stack[len(vm.stack)-1] == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if err := vm.arithOp(func(x, y int) int { return x / y }); err != nil {
+				return nil, err
+			}
 		case EQ:
-			vm.logicalOp(func(x, y int) bool { return x == y })
+			if err := vm.logicalOp(func(x, y int) bool { return x == y }); err != nil {
+				return nil, err
+			}
 		case GT:
-			vm.logicalOp(func(x, y int) bool { return x > y })
+			if err := vm.logicalOp(func(x, y int) bool { return x > y }); err != nil {
+				return nil, err
+			}
 		case LT:
-			vm.logicalOp(func(x, y int) bool { return x < y })
+			if err := vm.logicalOp(func(x, y int) bool { return x < y }); err != nil {
+				return nil, err
+			}
 		case GTE:
-			vm.logicalOp(func(x, y int) bool { return x >= y })
+			if err := vm.logicalOp(func(x, y int) bool { return x >= y }); err != nil {
+				return nil, err
+			}
 		case LTE:
-			vm.logicalOp(func(x, y int) bool { return x <= y })
-		case SEL:
-			ct := insn.operands[0].(Code)
-			cf := insn.operands[1].(Code)
-			vm.runSel(ct, cf)
+			if err := vm.logicalOp(func(x, y int) bool { return x <= y }); err != nil {
+				return nil, err
+			}
+		case JMP:
+			vm.pc += PC(insn.operands[0].(int))
 			continue
-		case JOIN:
-			entry := vm.dumpPop()
-			_ = entry.(*SelDumpEntry)
-			entry.restore(vm)
+		case JMPF:
+			if !ToBool(vm.pop()) {
+				vm.pc += PC(insn.operands[0].(int))
+				continue
+			}
 		case LDF:
 			code := insn.operands[0].(Code)
-			env := vm.env
-			vm.push(NewFunc(code, env))
+			info := insn.operands[1].(*LambdaInfo)
+			vm.push(NewFunc(code, vm.env, info))
+		case CLOS:
+			code := insn.operands[0].(Code)
+			info := insn.operands[1].(*LambdaInfo)
+			frame := vm.popFrame(insn.operands[2].(int))
+			vm.push(NewFunc(code, (*Env)(nil).Push(frame), info))
+		case BOX:
+			vm.push(&box{vm.pop()})
+		case UNBOX:
+			vm.push(vm.pop().(*box).value)
+		case SETBOX:
+			obj := vm.pop()
+			vm.pop().(*box).value = obj
+			vm.push(obj)
+		case ENTER:
+			frame := vm.popFrame(insn.operands[0].(int))
+			vm.env = vm.env.Push(frame)
+		case EXIT:
+			vm.env = vm.env.Pop()
 		case AP:
-			if err := vm.runAp(); err != nil {
+			if err := vm.runAp(insn.operands[0].(int)); err != nil {
 				return nil, err
 			}
 			continue
@@ -183,11 +348,17 @@ func (vm *VM) Run() (Object, error) {
 			entry := vm.dumpPop()
 			_ = entry.(*ApDumpEntry)
 			entry.restore(vm)
+		case TRY:
+			vm.runTry(insn.operands[0].(int))
+		case WIND:
+			vm.runWind()
+		case LEAVE:
+			vm.dumpPop()
 		case DUM:
 			frame := make([]Object, 1)
 			vm.env = vm.env.Push(frame)
 		case RAP:
-			if err := vm.runRap(); err != nil {
+			if err := vm.runRap(insn.operands[0].(int)); err != nil {
 				return nil, err
 			}
 			continue
@@ -197,74 +368,171 @@ func (vm *VM) Run() (Object, error) {
 	return vm.pop(), nil
 }
 
-func (entry *SelDumpEntry) restore(vm *VM) {
-	vm.code = entry.code
-	vm.pc = entry.pc
-}
-
-func (vm *VM) runSel(ct, cf Code) {
-	var c Code
-	obj := vm.pop()
-	if ToBool(obj) {
-		c = ct
-	} else {
-		c = cf
-	}
-	vm.code, c = c, vm.code
-	vm.dump = append(vm.dump, &SelDumpEntry{c, vm.pc})
-	vm.pc = 0
-}
-
 func (entry *ApDumpEntry) restore(vm *VM) {
 	v := vm.pop()
 	vm.stack = append(entry.stack, v)
 	vm.env = entry.env
 	vm.code = entry.code
 	vm.pc = entry.pc
+	vm.fn = entry.fn
 }
 
-func (vm *VM) withFn(f func(*Func) Restorer) error {
+// popFrame pops the top n objects off the stack into a new frame, keeping
+// their order.
+func (vm *VM) popFrame(n int) Frame {
+	size := len(vm.stack) - n
+	if size < 0 {
+		panic("stack underflow")
+	}
+	frame := make(Frame, n)
+	copy(frame, vm.stack[size:])
+	vm.stack = vm.stack[:size]
+	return frame
+}
+
+// withFn applies the function on top of the stack to the nargs arguments
+// below it. f returns the dump entry to resume the caller with, and the
+// environment to extend with the arguments.
+func (vm *VM) withFn(nargs int, f func(*Func) (Restorer, *Env)) error {
 	obj := vm.pop()
+	frame := vm.popFrame(nargs)
+	if f, ok := obj.(applicable); ok {
+		v, err := f.call(vm, frame)
+		if err != nil {
+			return err
+		}
+		vm.push(v)
+		vm.pc++
+		return nil
+	}
 	fn, ok := obj.(*Func)
 	if !ok {
 		return errors.New("cannot apply object other than function")
 	}
-	args := vm.pop()
-	frame, improper, err := ListToSlice(args)
-	if err != nil {
-		return err
+	if len(frame) != fn.info.arity {
+		return fmt.Errorf("wrong number of arguments to %s: expected %d, got %d", fn.Name(), fn.info.arity, len(frame))
 	}
-	if improper != nil {
-		return errors.New("improper lists are not allowed for arg lists")
+	if fn.code == nil {
+		// functions created by Eval have no code to run on the VM
+		m := newMachine(vm.interrupted)
+		m.callers = vm.calls
+		m.vm.interpreter = vm.interpreter
+		v, err := m.call(fn, frame)
+		if err != nil {
+			return err
+		}
+		vm.push(v)
+		vm.pc++
+		return nil
 	}
-	entry := f(fn)
+	entry, env := f(fn)
 	vm.stack = nil
-	vm.env = vm.env.Push(frame)
+	vm.env = env.Push(frame)
 	vm.code = fn.code
 	vm.dump = append(vm.dump, entry)
 	vm.pc = 0
+	vm.fn = fn
 	return nil
 }
 
-func (vm *VM) runAp() error {
-	return vm.withFn(func(_ *Func) Restorer {
+func (vm *VM) runAp(nargs int) error {
+	return vm.withFn(nargs, func(fn *Func) (Restorer, *Env) {
 		return &ApDumpEntry{
 			stack: vm.stack,
 			env:   vm.env,
 			code:  vm.code,
 			pc:    vm.pc,
-		}
+			fn:    vm.fn,
+		}, fn.env
 	})
 }
 
-func (vm *VM) runRap() error {
-	return vm.withFn(func(fn *Func) Restorer {
+func (vm *VM) runRap(nargs int) error {
+	return vm.withFn(nargs, func(fn *Func) (Restorer, *Env) {
 		vm.env.frame[0] = fn
 		return &ApDumpEntry{
 			stack: vm.stack,
 			env:   vm.env.Pop(),
 			code:  vm.code,
 			pc:    vm.pc,
-		}
+			fn:    vm.fn,
+		}, vm.env
+	})
+}
+
+// Apply calls fn with args on a fresh VM and returns the result.
+func Apply(fn Object, args []Object) (Object, error) {
+	return NewVM(nil).apply(fn, args)
+}
+
+// restore brings the VM back to the state the handler was installed in,
+// with pc at the LEAVE ending the body.
+func (entry *HandlerDumpEntry) restore(vm *VM) {
+	vm.stack = entry.stack
+	vm.env = entry.env
+	vm.code = entry.code
+	vm.pc = entry.pc
+	vm.fn = entry.fn
+}
+
+// runTry installs the handler on top of the stack until the LEAVE at
+// offset from the TRY. The body follows the TRY directly.
+func (vm *VM) runTry(offset int) {
+	handler := vm.pop().(*Func)
+	vm.dump = append(vm.dump, &HandlerDumpEntry{
+		stack:   vm.stack,
+		env:     vm.env,
+		code:    vm.code,
+		pc:      vm.pc + PC(offset),
+		fn:      vm.fn,
+		handler: handler,
 	})
 }
+
+// restore does nothing, since the code after the LEAVE popping the entry
+// just follows the body.
+func (entry *WindDumpEntry) restore(vm *VM) {}
+
+func (vm *VM) runWind() {
+	after := vm.pop().(*Func)
+	vm.dump = append(vm.dump, &WindDumpEntry{after})
+}
+
+// unwind pops the dump up to the innermost handler, calling the cleanups
+// found on the way, and then arranges for the handler to be applied to obj.
+// It reports whether a handler was found. If a cleanup fails, its error
+// takes over from obj.
+func (vm *VM) unwind(obj Object) (bool, error) {
+	var cleanupErr error
+	for len(vm.dump) > 0 {
+		switch entry := vm.dumpPop().(type) {
+		case *ApDumpEntry:
+			// keeps the calls right for the backtraces from cleanups
+			vm.fn = entry.fn
+		case *WindDumpEntry:
+			if _, err := vm.apply(entry.after, nil); err != nil {
+				if errors.Is(err, ErrInterrupted) {
+					return false, err
+				}
+				obj = raisedValue(err)
+				cleanupErr = err
+			}
+		case *HandlerDumpEntry:
+			entry.restore(vm)
+			vm.stack = append(vm.stack, obj, entry.handler)
+			return true, vm.runAp(1)
+		}
+	}
+	return false, cleanupErr
+}
+
+// apply calls fn with args on a child VM, which can be interrupted
+// together with vm.
+func (vm *VM) apply(fn Object, args []Object) (Object, error) {
+	child := NewVM(Code{{AP, []Operand{len(args)}}})
+	child.interrupted = vm.interrupted
+	child.callers = vm.calls
+	child.interpreter = vm.interpreter
+	child.stack = append(append(make(Stack, 0, len(args)+1), args...), fn)
+	return child.Run()
+}
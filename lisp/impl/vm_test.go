@@ -1,7 +1,10 @@
 package lisp
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -198,36 +201,34 @@ func TestVM(t *testing.T) {
 			nil,
 		},
 		{
-			"nil; null; sel(ldc(1); join, ldc(2); join); -> 1",
+			"nil; null; jmpf(+3); ldc(1); jmp(+2); ldc(2); -> 1",
 			[]Insn{
 				{NIL, nil},
 				{NULL, nil},
-				{SEL, []Operand{
-					Code{{LDC, []Operand{1}}, {JOIN, nil}},
-					Code{{LDC, []Operand{2}}, {JOIN, nil}},
-				}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{1}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{2}},
 			},
 			1,
 		},
 		{
-			"ldc(t); null; sel(ldc(1); join, ldc(2); join); -> 2",
+			"ldc(t); null; jmpf(+3); ldc(1); jmp(+2); ldc(2); -> 2",
 			[]Insn{
 				{LDC, []Operand{true}},
 				{NULL, nil},
-				{SEL, []Operand{
-					Code{{LDC, []Operand{1}}, {JOIN, nil}},
-					Code{{LDC, []Operand{2}}, {JOIN, nil}},
-				}},
+				{JMPF, []Operand{3}},
+				{LDC, []Operand{1}},
+				{JMP, []Operand{2}},
+				{LDC, []Operand{2}},
 			},
 			2,
 		},
 		{
 			// ((lambda (x) (+ x 2)) 3)
-			"ldc(3); nil; cons; ldf(ld(0,0); ldc(2); mul; rtn;); ap; -> 6",
+			"ldc(3); ldf(ld(0,0); ldc(2); mul; rtn;); ap(1); -> 6",
 			[]Insn{
 				{LDC, []Operand{3}},
-				{NIL, nil},
-				{CONS, nil},
 				{LDF, []Operand{
 					Code{
 						{LD, []Operand{&Location{0, 0}}},
@@ -235,8 +236,9 @@ func TestVM(t *testing.T) {
 						{MUL, nil},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
 				}},
-				{AP, nil},
+				{AP, []Operand{1}},
 			},
 			6,
 		},
@@ -244,7 +246,7 @@ func TestVM(t *testing.T) {
 			// (let ((f (lambda (x)
 			//            (* x 2))))
 			//   (f (f 3)))
-			"ldf(ld(0,0); ldc(2); mul; rtn;); nil; cons; cons; ldf(ldc(3); nil; cons; ld(0,0); ap; nil; cons; ld(0,0); ap; rtn;); ap; -> 12",
+			"ldf(ld(0,0); ldc(2); mul; rtn;); ldf(ldc(3); ld(0,0); ap(1); ld(0,0); ap(1); rtn;); ap(1); -> 12",
 			[]Insn{
 				{LDF, []Operand{
 					Code{
@@ -253,24 +255,20 @@ func TestVM(t *testing.T) {
 						{MUL, nil},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
 				}},
-				{NIL, nil},
-				{CONS, nil},
 				{LDF, []Operand{
 					Code{
 						{LDC, []Operand{3}},
-						{NIL, nil},
-						{CONS, nil},
 						{LD, []Operand{&Location{0, 0}}},
-						{AP, nil},
-						{NIL, nil},
-						{CONS, nil},
+						{AP, []Operand{1}},
 						{LD, []Operand{&Location{0, 0}}},
-						{AP, nil},
+						{AP, []Operand{1}},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
 				}},
-				{AP, nil},
+				{AP, []Operand{1}},
 			},
 			12,
 		},
@@ -280,37 +278,31 @@ func TestVM(t *testing.T) {
 			//                 1
 			//                 (* x (f (- x 1)))))))
 			//   (f 5))
-			"ldc(5); nil; cons; ldf(ld(0,0); ldc(0); eq; sel(ldc(1); join;, ld(0,0); ld(0,0); ldc(1); sub; nil; cons; ld(1,0); dum; rap; mul; join;); rtn;); dum; rap; -> 120",
+			"ldc(5); ldf(ld(0,0); ldc(0); eq; jmpf(+3); ldc(1); jmp(+9); ld(0,0); ld(0,0); ldc(1); sub; ld(1,0); dum; rap(1); mul; rtn;); dum; rap(1); -> 120",
 			[]Insn{
 				{LDC, []Operand{5}},
-				{NIL, nil},
-				{CONS, nil},
 				{LDF, []Operand{
 					Code{
 						{LD, []Operand{&Location{0, 0}}},
 						{LDC, []Operand{0}},
 						{EQ, nil},
-						{SEL, []Operand{
-							Code{{LDC, []Operand{1}}, {JOIN, nil}},
-							Code{
-								{LD, []Operand{&Location{0, 0}}},
-								{LD, []Operand{&Location{0, 0}}},
-								{LDC, []Operand{1}},
-								{SUB, nil},
-								{NIL, nil},
-								{CONS, nil},
-								{LD, []Operand{&Location{1, 0}}},
-								{DUM, nil},
-								{RAP, nil},
-								{MUL, nil},
-								{JOIN, nil},
-							},
-						}},
+						{JMPF, []Operand{3}},
+						{LDC, []Operand{1}},
+						{JMP, []Operand{9}},
+						{LD, []Operand{&Location{0, 0}}},
+						{LD, []Operand{&Location{0, 0}}},
+						{LDC, []Operand{1}},
+						{SUB, nil},
+						{LD, []Operand{&Location{1, 0}}},
+						{DUM, nil},
+						{RAP, []Operand{1}},
+						{MUL, nil},
 						{RTN, nil},
 					},
+					&LambdaInfo{arity: 1},
 				}},
 				{DUM, nil},
-				{RAP, nil},
+				{RAP, []Operand{1}},
 			},
 			120,
 		},
@@ -324,3 +316,201 @@ func TestVM(t *testing.T) {
 		})
 	}
 }
+
+func TestVMInterrupt(t *testing.T) {
+	// (begin (define loop (lambda () (loop))) (loop))
+	code := Code{
+		{LDF, []Operand{
+			Code{
+				{LDG, []Operand{Intern("loop")}},
+				{AP, []Operand{0}},
+				{RTN, nil},
+			},
+			&LambdaInfo{name: "loop"},
+		}},
+		{DEF, []Operand{Intern("loop")}},
+		{POP, nil},
+		{LDG, []Operand{Intern("loop")}},
+		{AP, []Operand{0}},
+	}
+	vm := NewVM(code)
+	time.AfterFunc(10*time.Millisecond, vm.Interrupt)
+	v, err := vm.Run()
+	assert.Nil(t, v)
+	assert.True(t, errors.Is(err, ErrInterrupted))
+	var lerr *Error
+	assert.True(t, errors.As(err, &lerr))
+	assert.Equal(t, "#<func loop/0>", lerr.Backtrace()[0])
+	assert.LessOrEqual(t, len(lerr.Backtrace()), maxBacktraceDepth+1)
+}
+
+func TestVMLexicalScope(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{
+			// f sees the x where it is created, not the one where it is called
+			"((lambda (x) ((lambda (f) ((lambda (x) (f)) 2)) (lambda () x))) 1)",
+			"1",
+		},
+		{
+			// closures keep their environment after returning
+			"((((lambda (x) (lambda (y) (lambda () (cons x y)))) 1) 2))",
+			"(1 . 2)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := run(tt.in)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.out, ToString(v))
+		})
+	}
+}
+
+func TestVMGlobals(t *testing.T) {
+	tests := []struct {
+		title string
+		code  Code
+		out   Object
+		err   string
+	}{
+		{
+			"ldg(lenght) -> unbound variable",
+			Code{{LDG, []Operand{Intern("lenght")}}},
+			nil,
+			"unbound variable: lenght",
+		},
+		{
+			"ldc(1); svg(undefined-global) -> unbound variable",
+			Code{
+				{LDC, []Operand{1}},
+				{SVG, []Operand{Intern("undefined-global")}},
+			},
+			nil,
+			"cannot set! unbound variable: undefined-global",
+		},
+		{
+			"nil; def(bound-to-nil); pop; ldg(bound-to-nil) -> nil",
+			Code{
+				{NIL, nil},
+				{DEF, []Operand{Intern("bound-to-nil")}},
+				{POP, nil},
+				{LDG, []Operand{Intern("bound-to-nil")}},
+			},
+			nil,
+			"",
+		},
+		{
+			"ldc(1); def(g); pop; ldc(2); svg(g); pop; ldg(g) -> 2",
+			Code{
+				{LDC, []Operand{1}},
+				{DEF, []Operand{Intern("g")}},
+				{POP, nil},
+				{LDC, []Operand{2}},
+				{SVG, []Operand{Intern("g")}},
+				{POP, nil},
+				{LDG, []Operand{Intern("g")}},
+			},
+			2,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			v, err := NewVM(tt.code).Run()
+			assert.Equal(t, tt.out, v)
+			if tt.err == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVMArity(t *testing.T) {
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{
+			"(begin (define add (lambda (x y) (+ x y))) (add 1))",
+			"wrong number of arguments to add: expected 2, got 1",
+		},
+		{"((lambda (x) x))", "wrong number of arguments to lambda: expected 1, got 0"},
+		{"((lambda () 1) 2)", "wrong number of arguments to lambda: expected 0, got 1"},
+		{"(vector-ref #(1))", "wrong number of arguments to vector-ref: expected 2, got 1"},
+		{"(make-vector)", "wrong number of arguments to make-vector: expected 1 to 2, got 0"},
+		{"(error)", "wrong number of arguments to error: expected at least 1, got 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := run(tt.in)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestVMBacktracePositions(t *testing.T) {
+	r := NewReader(strings.NewReader(`
+(define first
+  (lambda (x) (car x)))
+(define call-first (lambda (x) (+ 1 (first x))))
+(call-first 1)`))
+	r.SetFilename("test.lisp")
+	c := NewCompiler()
+	c.SetSourceMap(r.SourceMap())
+	var err error
+	for err == nil {
+		var obj Object
+		obj, err = r.Read()
+		if err != nil {
+			break
+		}
+		var code Code
+		code, err = c.Compile(obj)
+		assert.Nil(t, err)
+		_, err = NewVM(code).Run()
+	}
+	var lerr *Error
+	assert.True(t, errors.As(err, &lerr))
+	assert.Equal(t, []string{
+		"#<func first/1> (test.lisp:3:3)",
+		"#<func call-first/1> (test.lisp:4:20)",
+		"<toplevel>",
+	}, lerr.Backtrace())
+}
+
+func compileBenchmark(b *testing.B, def, input string) Code {
+	if _, err := run(def); err != nil {
+		b.Fatal(err)
+	}
+	obj, err := ReadFromString(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	code, err := Compile(obj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return code
+}
+
+func BenchmarkFib(b *testing.B) {
+	code := compileBenchmark(b, `
+(define bench-fib
+  (lambda (n)
+    (if (< n 2)
+        n
+        (+ (bench-fib (- n 1)) (bench-fib (- n 2))))))`,
+		"(bench-fib 20)")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewVM(code).Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
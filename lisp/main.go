@@ -2,32 +2,203 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	lisp "github.com/athos/go-playground/lisp/impl"
 )
 
-func step(input string) (lisp.Object, error) {
-	obj, err := lisp.ReadFromString(input)
-	if err != nil {
-		return nil, err
+var (
+	mu      sync.Mutex
+	running *lisp.Interpreter
+)
+
+func setRunning(in *lisp.Interpreter) {
+	mu.Lock()
+	defer mu.Unlock()
+	running = in
+}
+
+// handleInterrupts aborts the evaluation in progress on Ctrl-C, or exits
+// the REPL if nothing is being evaluated.
+func handleInterrupts(sigs <-chan os.Signal) {
+	for range sigs {
+		mu.Lock()
+		in := running
+		mu.Unlock()
+		if in == nil {
+			fmt.Println()
+			os.Exit(130)
+		}
+		in.Interrupt()
 	}
-	code, err := lisp.Compile(obj)
+}
+
+func eval(in *lisp.Interpreter, obj lisp.Object) (lisp.Object, error) {
+	setRunning(in)
+	defer setRunning(nil)
+	return in.Eval(obj)
+}
+
+// readFile calls f with each top-level form in the file at path, read with
+// rt, after telling c where in the file the forms come from.
+func readFile(path string, c *lisp.Compiler, rt *lisp.Readtable, f func(lisp.Object) error) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer file.Close()
+	r := lisp.NewReader(file)
+	r.SetReadtable(rt)
+	r.SetFilename(path)
+	c.SetSourceMap(r.SourceMap())
+	for {
+		obj, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := f(obj); err != nil {
+			return err
+		}
+	}
+}
+
+// loadFile evaluates the forms in the file at path. If inline is true, it
+// reads the whole file first to inline the calls to the functions it
+// defines.
+func loadFile(in *lisp.Interpreter, path string, inline bool) error {
+	if !inline {
+		return readFile(path, in.Compiler(), in.Readtable(), func(obj lisp.Object) error {
+			_, err := eval(in, obj)
+			return err
+		})
 	}
-	vm := lisp.NewVM(code)
-	v, err := vm.Run()
+	var forms []lisp.Object
+	err := readFile(path, in.Compiler(), in.Readtable(), func(obj lisp.Object) error {
+		forms = append(forms, obj)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	c := in.Compiler()
+	c.InlineGlobals(forms)
+	// the functions may be redefined after the file is loaded
+	defer c.InlineGlobals(nil)
+	for _, obj := range forms {
+		if _, err := eval(in, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFiles compiles the files without running them and prints the
+// warnings found, compiling the libraries imported from libpath as well.
+// It returns the exit status.
+func checkFiles(paths []string, libpath []fs.FS) int {
+	status := 0
+	d := lisp.NewDiagnostics()
+	for _, path := range paths {
+		c := lisp.NewCompiler()
+		c.SetDiagnostics(d)
+		c.SetLibraryPath(libpath...)
+		err := readFile(path, c, lisp.StandardReadtable(), func(obj lisp.Object) error {
+			_, err := c.Compile(obj)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+		}
+	}
+	for _, diag := range d.Report() {
+		fmt.Println(diag)
+	}
+	return status
+}
+
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	var lerr *lisp.Error
+	if errors.As(err, &lerr) {
+		for _, frame := range lerr.Backtrace() {
+			fmt.Fprintln(os.Stderr, "  at "+frame)
+		}
 	}
-	return v, nil
 }
 
 func main() {
+	engine := flag.String("engine", "secd", "engine to run code with: secd or closure")
+	closures := flag.String("closures", "linked", "closure representation: linked or flat")
+	inline := flag.Bool("inline", false, "inline small functions defined in the files loaded")
+	root := flag.String("root", ".", "directory the files accessed by programs are confined to")
+	libpath := flag.String("libpath", ".", "list of directories to search for the libraries imported")
+	profile := flag.String("profile", "full", "primitives programs may call: pure, io-readonly or full")
+	flag.Parse()
+	args := flag.Args()
+	var dirs []fs.FS
+	for _, dir := range filepath.SplitList(*libpath) {
+		dirs = append(dirs, os.DirFS(dir))
+	}
+	if len(args) > 0 && args[0] == "check" {
+		os.Exit(checkFiles(args[1:], dirs))
+	}
+
+	in := lisp.NewInterpreter()
+	in.Compiler().SetOptimize(true)
+	in.SetFileSystem(lisp.NewDirFS(*root))
+	in.SetLibraryPath(dirs...)
+	p, err := lisp.ParseProfile(*profile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	in.SetProfile(p)
+	switch *engine {
+	case "secd":
+	case "closure":
+		in.SetEngine(lisp.ClosureEngine)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine: %s\n", *engine)
+		os.Exit(2)
+	}
+
+	switch *closures {
+	case "linked":
+	case "flat":
+		in.Compiler().SetFlatClosures(true)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown closure representation: %s\n", *closures)
+		os.Exit(2)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go handleInterrupts(sigs)
+
+	// the REPL shares the standard input with the programs it runs
 	r := bufio.NewReader(os.Stdin)
+	in.SetCurrentInputPort(r)
+
+	for _, path := range args {
+		if err := loadFile(in, path, *inline); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	}
+
 	for {
 		fmt.Print("> ")
 		input, err := r.ReadString('\n')
@@ -37,9 +208,18 @@ func main() {
 			}
 			panic(err)
 		}
-		v, err := step(input)
+		obj, err := in.NewReader(strings.NewReader(input)).Read()
+		if err == io.EOF {
+			// blank line or comments only
+			continue
+		}
+		if err != nil {
+			printError(err)
+			continue
+		}
+		v, err := eval(in, obj)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
+			printError(err)
 			continue
 		}
 		fmt.Println(lisp.ToString(v))